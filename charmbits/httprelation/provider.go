@@ -21,10 +21,11 @@ type providerState struct {
 
 // Provider represents the provider of an http relation.
 type Provider struct {
-	prov       simplerelation.Provider
-	state      providerState
-	ctxt       *hook.Context
-	allowHTTPS bool
+	prov         simplerelation.Provider
+	state        providerState
+	ctxt         *hook.Context
+	relationName string
+	allowHTTPS   bool
 }
 
 // Register registers everything necessary on r for running the provider
@@ -39,6 +40,7 @@ type Provider struct {
 // configuration option.
 func (p *Provider) Register(r *hook.Registry, relationName string, allowHTTPS bool) {
 	p.allowHTTPS = allowHTTPS
+	p.relationName = relationName
 	// TODO provide https relation?
 	p.prov.Register(r.Clone("http"), relationName, "http")
 	r.RegisterConfig("http-port", charm.Option{
@@ -46,6 +48,7 @@ func (p *Provider) Register(r *hook.Registry, relationName string, allowHTTPS bo
 		Description: "Port for the HTTP server to listen on",
 		Default:     80,
 	})
+	r.RegisterConfigRule("http-port", hook.ConfigMin(1), hook.ConfigMax(65534))
 	if p.allowHTTPS {
 		r.RegisterConfig("https-certificate", charm.Option{
 			Type:        "string",
@@ -56,6 +59,7 @@ func (p *Provider) Register(r *hook.Registry, relationName string, allowHTTPS bo
 			Description: "Port for the HTTP server to listen on",
 			Default:     443,
 		})
+		r.RegisterConfigRule("https-port", hook.ConfigMin(1), hook.ConfigMax(65534))
 	}
 	r.RegisterHook("install", p.configChanged)
 	r.RegisterHook("config-changed", p.configChanged)
@@ -82,24 +86,20 @@ func (p *Provider) HTTPSPort() int {
 // HTTPSPort returns the configured port of the HTTPS server.
 // If the port has not been set, or there is no cert provided, it returns 0.
 func (p *Provider) configChanged() error {
-	if err := p.configurePort(&p.state.OpenedHTTPPort, "http-port"); err != nil {
+	// The configuration may have changed in a hook that this
+	// provider does not handle, so always compare the configured
+	// ports against the opened ports recorded in our own state
+	// rather than relying on ConfigChanged.
+	if err := p.configurePorts(); err != nil {
 		return errgo.Mask(err)
 	}
-	if p.allowHTTPS {
-		// If the TLSCert is invalid, ignore it.
-		if _, err := p.TLSCertPEM(); err == nil {
-			if err := p.configurePort(&p.state.OpenedHTTPSPort, "https-port"); err != nil {
-				return errgo.Mask(err)
-			}
-		}
-	}
 	if p.state.OpenedHTTPPort == 0 {
 		return p.prov.SetValues(map[string]string{
 			"hostname": "",
 			"port":     "",
 		})
 	}
-	addr, err := p.ctxt.PrivateAddress()
+	addr, err := p.ingressAddress()
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -112,6 +112,32 @@ func (p *Provider) configChanged() error {
 	return nil
 }
 
+// ingressAddress returns the address that units on the other
+// side of the relation should use to connect to the server.
+func (p *Provider) ingressAddress() (string, error) {
+	info, err := p.ctxt.NetworkGet(p.relationName)
+	if errgo.Cause(err) == hook.ErrUnimplemented {
+		// Older versions of juju do not support network-get,
+		// so fall back to the private address.
+		return p.privateAddress()
+	}
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if len(info.IngressAddresses) == 0 {
+		return p.privateAddress()
+	}
+	return info.IngressAddresses[0], nil
+}
+
+func (p *Provider) privateAddress() (string, error) {
+	addr, err := p.ctxt.PrivateAddress()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return addr, nil
+}
+
 var ErrHTTPSNotConfigured = errgo.New("HTTPS not configured")
 
 // TLSCertPEM returns the currently configured server certificate
@@ -128,14 +154,33 @@ func (p *Provider) TLSCertPEM() (string, error) {
 	return certPEM, nil
 }
 
+// configurePorts opens the ports specified in the configuration,
+// closing any previously opened ports that have changed.
+func (p *Provider) configurePorts() error {
+	if err := p.configurePort(&p.state.OpenedHTTPPort, "http-port"); err != nil {
+		return errgo.Mask(err)
+	}
+	if p.allowHTTPS {
+		// If the TLSCert is invalid, ignore it.
+		if _, err := p.TLSCertPEM(); err == nil {
+			if err := p.configurePort(&p.state.OpenedHTTPSPort, "https-port"); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return nil
+}
+
 func (p *Provider) configurePort(openedPort *int, configKey string) error {
 	port, err := p.ctxt.GetConfigInt(configKey)
 	if err != nil {
 		return errgo.Notef(err, "cannot get %s", configKey)
 	}
 	if port <= 0 || port >= 65535 {
+		// This should not happen because the configuration
+		// rules registered in Register will have prevented
+		// the hook from running.
 		p.ctxt.Logf("ignoring invalid %s %v", configKey, port)
-		// TODO status-set appropriately if/when status-set is implemented
 		return nil
 	}
 	if port == *openedPort {
@@ -106,11 +106,136 @@ func (s *providerSuite) TestOpensPortWhenConfigChanged(c *gc.C) {
 	})
 }
 
+func (s *providerSuite) TestAdvertisesIngressAddress(c *gc.C) {
+	ctxt := &context{
+		state: make(hooktest.MemState),
+		relationIds: map[string][]hook.RelationId{
+			"foo": {"foo:0"},
+		},
+		relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"foo:0": {
+				"remote/0": {},
+			},
+		},
+		networks: map[string]hook.NetworkInfo{
+			"foo": {
+				IngressAddresses: []string{"10.0.0.5", "10.0.0.6"},
+			},
+		},
+		config: map[string]interface{}{
+			"http-port": 1234,
+		},
+	}
+	rec := ctxt.runHook(c, "config-changed", "", "", nil)
+	c.Assert(rec, gc.HasLen, 2)
+	c.Assert(rec[0], jc.DeepEquals, []string{"open-port", "1234/tcp"})
+	// The order of the relation settings is undefined.
+	sort.Strings(rec[1][4:])
+	c.Assert(rec[1], jc.DeepEquals, []string{"relation-set", "-r", "foo:0", "--", "hostname=10.0.0.5", "port=1234"})
+}
+
+func (s *providerSuite) TestInvalidPortSetsBlockedStatus(c *gc.C) {
+	var p httprelation.Provider
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "foo", false)
+		},
+		HookStateDir: "/dev/null",
+		Config: map[string]interface{}{
+			"http-port": 70000,
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-get", "--format", "json", "--include-data"},
+		{"status-set", "blocked", `invalid configuration: option "http-port": 70000 is greater than maximum 65534`},
+	})
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusBlocked,
+		Message: `invalid configuration: option "http-port": 70000 is greater than maximum 65534`,
+	})
+
+	// When the configuration is fixed, the port is opened
+	// and the blocked status is cleared.
+	runner.Config["http-port"] = 8080
+	runner.Record = nil
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-get", "--format", "json", "--include-data"},
+		{"status-set", "active", ""},
+		{"open-port", "8080/tcp"},
+	})
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{
+		Status: hook.StatusActive,
+	})
+}
+
+func (s *providerSuite) TestPortsNotReconfiguredWhenConfigUnchanged(c *gc.C) {
+	ctxt := &context{
+		state: make(hooktest.MemState),
+		config: map[string]interface{}{
+			"http-port": 1234,
+		},
+	}
+	rec := ctxt.runHook(c, "config-changed", "", "", nil)
+	c.Assert(rec, jc.DeepEquals, [][]string{
+		{"open-port", "1234/tcp"},
+	})
+	rec = ctxt.runHook(c, "config-changed", "", "", func(p *httprelation.Provider, r *hook.Registry) {
+		r.RegisterHook("*", func() error {
+			c.Check(p.HTTPPort(), gc.Equals, 1234)
+			return nil
+		})
+	})
+	c.Assert(rec, gc.HasLen, 0)
+
+	ctxt.config["http-port"] = 5678
+	rec = ctxt.runHook(c, "config-changed", "", "", nil)
+	c.Assert(rec, jc.DeepEquals, [][]string{
+		{"close-port", "1234/tcp"},
+		{"open-port", "5678/tcp"},
+	})
+}
+
+func (s *providerSuite) TestPortsReconfiguredAfterOtherHook(c *gc.C) {
+	ctxt := &context{
+		state: make(hooktest.MemState),
+		config: map[string]interface{}{
+			"http-port": 1234,
+		},
+	}
+	registerStart := func(p *httprelation.Provider, r *hook.Registry) {
+		r.RegisterHook("start", func() error {
+			return nil
+		})
+	}
+	rec := ctxt.runHook(c, "config-changed", "", "", registerStart)
+	c.Assert(rec, jc.DeepEquals, [][]string{
+		{"open-port", "1234/tcp"},
+	})
+
+	// The configuration change is seen first by
+	// a hook that the provider does not handle.
+	ctxt.config["http-port"] = 5678
+	rec = ctxt.runHook(c, "start", "", "", registerStart)
+	c.Assert(rec, gc.HasLen, 0)
+
+	rec = ctxt.runHook(c, "config-changed", "", "", registerStart)
+	c.Assert(rec, jc.DeepEquals, [][]string{
+		{"close-port", "1234/tcp"},
+		{"open-port", "5678/tcp"},
+	})
+}
+
 type context struct {
 	withHTTPS   bool
 	relations   map[hook.RelationId]map[hook.UnitId]map[string]string
 	relationIds map[string][]hook.RelationId
 	config      map[string]interface{}
+	networks    map[string]hook.NetworkInfo
 	state       hook.PersistentState
 }
 
@@ -129,6 +254,8 @@ func (ctxt *context) runHook(c *gc.C, hookName string, relId hook.RelationId, re
 		Relations:   ctxt.relations,
 		RelationIds: ctxt.relationIds,
 		Config:      ctxt.config,
+		Networks:    ctxt.networks,
+		State:       ctxt.state,
 		Logger:      c,
 	}
 	err := runner.RunHook(hookName, relId, relUnit)
@@ -0,0 +1,104 @@
+// The jujuinfo package implements the requirer side of the juju-info
+// interface, which is implicitly provided by every charm. It is
+// intended for use by subordinate charms, which use a container-scoped
+// juju-info relation to attach themselves to any principal charm.
+//
+// For example, a subordinate charm might register itself like this:
+//
+//	func RegisterHooks(r *hook.Registry) {
+//		r.SetCharmInfo(hook.CharmInfo{
+//			Name:        "logagent",
+//			Summary:     "A log forwarding agent",
+//			Subordinate: true,
+//		})
+//		var info jujuinfo.Requirer
+//		info.Register(r.Clone("info"), "info")
+//		...
+//	}
+package jujuinfo
+
+import (
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"github.com/juju/gocharm/hook"
+)
+
+// Requirer represents the requirer side of a
+// container-scoped juju-info relation.
+type Requirer struct {
+	ctxt         *hook.Context
+	relationName string
+}
+
+// Register registers a container-scoped juju-info relation with the
+// given relation name with the given hook registry. Note that relation
+// names starting with "juju-" are reserved.
+//
+// To find out when the principal unit changes, register
+// a wildcard ("*") hook, which will trigger when the relation
+// changes.
+func (req *Requirer) Register(r *hook.Registry, relationName string) {
+	req.relationName = relationName
+	r.RegisterContext(req.setContext, nil)
+	r.RegisterRelation(charm.Relation{
+		Name:      relationName,
+		Interface: "juju-info",
+		Role:      charm.RoleRequirer,
+		Scope:     charm.ScopeContainer,
+	})
+	// We don't actually need to do anything in these hooks,
+	// but we need them so the hook is actually created
+	// and the user of this package will have a "*" hook
+	// triggered.
+	r.RegisterHook(relationName+"-relation-joined", nop)
+	r.RegisterHook(relationName+"-relation-changed", nop)
+	r.RegisterHook(relationName+"-relation-departed", nop)
+}
+
+func nop() error {
+	return nil
+}
+
+func (req *Requirer) setContext(ctxt *hook.Context) error {
+	req.ctxt = ctxt
+	return nil
+}
+
+// PrincipalUnit returns the principal unit that the subordinate
+// unit is attached to. It returns the empty string if the
+// relation has not yet been joined.
+func (req *Requirer) PrincipalUnit() hook.UnitId {
+	unit, _ := req.principal()
+	return unit
+}
+
+// PrincipalAddress returns the address of the principal unit
+// that the subordinate unit is attached to. It returns the
+// empty string if the relation has not yet been joined
+// or the principal has not yet made its address available.
+func (req *Requirer) PrincipalAddress() string {
+	_, settings := req.principal()
+	if addr := settings["ingress-address"]; addr != "" {
+		return addr
+	}
+	return settings["private-address"]
+}
+
+// principal returns the principal unit and its
+// relation settings.
+func (req *Requirer) principal() (hook.UnitId, map[string]string) {
+	ids := req.ctxt.RelationIdsFor(req.relationName)
+	if len(ids) == 0 {
+		return "", nil
+	}
+	if len(ids) > 1 {
+		req.ctxt.Logf("more than one principal for the %s relation", req.relationName)
+		return "", nil
+	}
+	// A container-scoped relation has at
+	// most one unit on the other side.
+	for unit, settings := range req.ctxt.RelationSettings(ids[0]) {
+		return unit, settings
+	}
+	return "", nil
+}
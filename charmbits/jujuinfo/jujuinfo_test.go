@@ -0,0 +1,95 @@
+package jujuinfo_test
+
+import (
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"github.com/juju/gocharm/charmbits/jujuinfo"
+	"github.com/juju/gocharm/hook"
+	"github.com/juju/gocharm/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+var _ = gc.Suite(&suite{})
+
+type suite struct {
+}
+
+func (s *suite) TestRegister(c *gc.C) {
+	r := hook.NewRegistry()
+	var req jujuinfo.Requirer
+	req.Register(r, "info")
+	c.Assert(r.RegisteredRelations(), jc.DeepEquals, map[string]charm.Relation{
+		"info": {
+			Name:      "info",
+			Interface: "juju-info",
+			Role:      charm.RoleRequirer,
+			Limit:     1,
+			Scope:     charm.ScopeContainer,
+		},
+	})
+}
+
+func (s *suite) TestPrincipal(c *gc.C) {
+	var req jujuinfo.Requirer
+	var unit hook.UnitId
+	var addr string
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			req.Register(r, "info")
+			r.RegisterHook("*", func() error {
+				unit = req.PrincipalUnit()
+				addr = req.PrincipalAddress()
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"info": {"info:3"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"info:3": {
+				"wordpress/1": {
+					"private-address": "10.0.0.1",
+				},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("info-relation-joined", "info:3", "wordpress/1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(unit, gc.Equals, hook.UnitId("wordpress/1"))
+	c.Assert(addr, gc.Equals, "10.0.0.1")
+
+	runner.Relations["info:3"]["wordpress/1"]["ingress-address"] = "192.168.0.1"
+	err = runner.RunHook("info-relation-changed", "info:3", "wordpress/1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr, gc.Equals, "192.168.0.1")
+}
+
+func (s *suite) TestNoPrincipal(c *gc.C) {
+	var req jujuinfo.Requirer
+	called := false
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			req.Register(r, "info")
+			r.RegisterHook("install", func() error {
+				c.Check(req.PrincipalUnit(), gc.Equals, hook.UnitId(""))
+				c.Check(req.PrincipalAddress(), gc.Equals, "")
+				called = true
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		Logger:       c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.IsTrue)
+}
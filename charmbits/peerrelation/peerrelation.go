@@ -0,0 +1,220 @@
+// The peerrelation package implements a peer relation
+// between the units of a service, providing a stable
+// view of the current members of the service and
+// notification of membership changes.
+package peerrelation
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"github.com/juju/gocharm/hook"
+)
+
+// Peer holds information about a unit taking
+// part in a peer relation.
+type Peer struct {
+	// Unit holds the id of the unit.
+	Unit hook.UnitId
+
+	// Address holds the address of the unit.
+	Address string
+}
+
+// MembershipChange holds the units that have joined and departed
+// the peer relation since the last time that a hook completed
+// successfully.
+type MembershipChange struct {
+	Joined   []hook.UnitId
+	Departed []hook.UnitId
+}
+
+// Peers represents a peer relation.
+type Peers struct {
+	ctxt         *hook.Context
+	relationName string
+	handlers     []func(MembershipChange) error
+	localAddress string
+}
+
+// Register registers a peer relation with the given relation name and
+// interface with the given hook registry.
+//
+// Functions registered with OnMembershipChange will be called
+// after all other hooks when units have joined or departed
+// the relation.
+func (p *Peers) Register(r *hook.Registry, relationName, interfaceName string) {
+	*p = Peers{
+		relationName: relationName,
+	}
+	r.RegisterRelation(charm.Relation{
+		Name:      relationName,
+		Interface: interfaceName,
+		Role:      charm.RolePeer,
+	})
+	r.RegisterContext(p.setContext, nil)
+	// We don't need to do anything in these hooks, but
+	// we need them so that the membership change
+	// notifications are triggered.
+	r.RegisterHook(relationName+"-relation-joined", nop)
+	r.RegisterHook(relationName+"-relation-changed", nop)
+	r.RegisterHook(relationName+"-relation-departed", nop)
+	r.RegisterHook("*", p.notify)
+}
+
+// OnMembershipChange registers a function that will be called when
+// units have joined or departed the peer relation. It must be called
+// at registration time, after Register. If f returns an error, the hook will fail and
+// the same change will be reported again when the hook is retried.
+func (p *Peers) OnMembershipChange(f func(MembershipChange) error) {
+	p.handlers = append(p.handlers, f)
+}
+
+func nop() error {
+	return nil
+}
+
+func (p *Peers) setContext(ctxt *hook.Context) error {
+	p.ctxt = ctxt
+	p.localAddress = ""
+	return nil
+}
+
+// relationId returns the id of the peer relation, or
+// the empty string if the relation has not been created yet.
+func (p *Peers) relationId() hook.RelationId {
+	ids := p.ctxt.RelationIdsFor(p.relationName)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// Peers returns all the other units in the peer relation,
+// sorted by unit number.
+func (p *Peers) Peers() []Peer {
+	units := p.ctxt.RelationSettings(p.relationId())
+	peers := make([]Peer, 0, len(units))
+	for unitId, settings := range units {
+		peers = append(peers, Peer{
+			Unit:    unitId,
+			Address: unitAddress(settings),
+		})
+	}
+	sort.Sort(peersByUnit(peers))
+	return peers
+}
+
+// Members returns all the units in the peer relation,
+// including the local unit, sorted by unit number.
+func (p *Peers) Members() ([]Peer, error) {
+	if p.localAddress == "" {
+		addr, err := p.ctxt.PrivateAddress()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get local address")
+		}
+		p.localAddress = addr
+	}
+	peers := append(p.Peers(), Peer{
+		Unit:    p.ctxt.Unit,
+		Address: p.localAddress,
+	})
+	sort.Sort(peersByUnit(peers))
+	return peers, nil
+}
+
+// IsFirstUnit reports whether the local unit has the lowest unit
+// number of all the units currently in the peer relation. This can be
+// used to decide which unit should bootstrap a cluster.
+//
+// Note that the first unit can change as units join and depart, and
+// that a unit may run hooks before it has seen all its peers, so
+// where possible leadership (see hook.Context.IsLeader) should be
+// preferred.
+func (p *Peers) IsFirstUnit() bool {
+	local := unitNumber(p.ctxt.Unit)
+	for unitId := range p.ctxt.RelationSettings(p.relationId()) {
+		if unitNumber(unitId) < local {
+			return false
+		}
+	}
+	return true
+}
+
+// notify calls any registered membership change
+// functions if the membership has changed.
+func (p *Peers) notify() error {
+	if len(p.handlers) == 0 {
+		return nil
+	}
+	var change MembershipChange
+	for _, delta := range p.ctxt.RelationDeltas(p.relationName) {
+		change.Joined = append(change.Joined, delta.Joined...)
+		change.Departed = append(change.Departed, delta.Departed...)
+	}
+	if len(change.Joined) == 0 && len(change.Departed) == 0 {
+		return nil
+	}
+	sort.Sort(unitIds(change.Joined))
+	sort.Sort(unitIds(change.Departed))
+	p.ctxt.Logf("peer membership changed; joined %v; departed %v", change.Joined, change.Departed)
+	for _, f := range p.handlers {
+		if err := f(change); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// unitAddress returns the address of a unit
+// from its relation settings.
+func unitAddress(settings map[string]string) string {
+	if addr := settings["ingress-address"]; addr != "" {
+		return addr
+	}
+	return settings["private-address"]
+}
+
+// unitNumber returns the number of the given unit,
+// or -1 if it is malformed.
+func unitNumber(id hook.UnitId) int {
+	s := string(id)
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+type peersByUnit []Peer
+
+func (p peersByUnit) Len() int      { return len(p) }
+func (p peersByUnit) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p peersByUnit) Less(i, j int) bool {
+	return unitLess(p[i].Unit, p[j].Unit)
+}
+
+type unitIds []hook.UnitId
+
+func (u unitIds) Len() int           { return len(u) }
+func (u unitIds) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u unitIds) Less(i, j int) bool { return unitLess(u[i], u[j]) }
+
+// unitLess reports whether unit id u0 sorts before u1.
+// Units are ordered by unit number so that, for
+// example, "app/2" sorts before "app/10".
+func unitLess(u0, u1 hook.UnitId) bool {
+	n0, n1 := unitNumber(u0), unitNumber(u1)
+	if n0 != n1 {
+		return n0 < n1
+	}
+	return u0 < u1
+}
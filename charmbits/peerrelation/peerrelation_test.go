@@ -0,0 +1,157 @@
+package peerrelation_test
+
+import (
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"github.com/juju/gocharm/charmbits/peerrelation"
+	"github.com/juju/gocharm/hook"
+	"github.com/juju/gocharm/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+var _ = gc.Suite(&suite{})
+
+type suite struct {
+}
+
+func (s *suite) TestRegister(c *gc.C) {
+	r := hook.NewRegistry()
+	var p peerrelation.Peers
+	p.Register(r, "cluster", "mycluster")
+	c.Assert(r.RegisteredRelations(), jc.DeepEquals, map[string]charm.Relation{
+		"cluster": {
+			Name:      "cluster",
+			Interface: "mycluster",
+			Role:      charm.RolePeer,
+			Limit:     1,
+			Scope:     charm.ScopeGlobal,
+		},
+	})
+}
+
+func (s *suite) TestMembers(c *gc.C) {
+	var p peerrelation.Peers
+	var peers, members []peerrelation.Peer
+	var isFirst bool
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "cluster", "mycluster")
+			r.RegisterHook("cluster-relation-changed", func() error {
+				peers = p.Peers()
+				var err error
+				members, err = p.Members()
+				c.Check(err, gc.IsNil)
+				isFirst = p.IsFirstUnit()
+				return nil
+			})
+		},
+		Unit:           "someunit/3",
+		HookStateDir:   "/dev/null",
+		PrivateAddress: "10.0.0.3",
+		RelationIds: map[string][]hook.RelationId{
+			"cluster": {"cluster:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"cluster:0": {
+				"someunit/10": {
+					"private-address": "10.0.0.10",
+				},
+				"someunit/5": {
+					"private-address": "10.0.0.5",
+					"ingress-address": "192.168.0.5",
+				},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("cluster-relation-changed", "cluster:0", "someunit/5")
+	c.Assert(err, gc.IsNil)
+	c.Assert(peers, jc.DeepEquals, []peerrelation.Peer{
+		{Unit: "someunit/5", Address: "192.168.0.5"},
+		{Unit: "someunit/10", Address: "10.0.0.10"},
+	})
+	c.Assert(members, jc.DeepEquals, []peerrelation.Peer{
+		{Unit: "someunit/3", Address: "10.0.0.3"},
+		{Unit: "someunit/5", Address: "192.168.0.5"},
+		{Unit: "someunit/10", Address: "10.0.0.10"},
+	})
+	c.Assert(isFirst, jc.IsTrue)
+
+	// When a lower-numbered unit joins, the local unit
+	// is no longer the first.
+	runner.Relations["cluster:0"]["someunit/1"] = map[string]string{
+		"private-address": "10.0.0.1",
+	}
+	err = runner.RunHook("cluster-relation-changed", "cluster:0", "someunit/1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(isFirst, jc.IsFalse)
+	c.Assert(members[0], jc.DeepEquals, peerrelation.Peer{
+		Unit:    "someunit/1",
+		Address: "10.0.0.1",
+	})
+}
+
+func (s *suite) TestMembershipChange(c *gc.C) {
+	var p peerrelation.Peers
+	var changes []peerrelation.MembershipChange
+	fail := false
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "cluster", "mycluster")
+			p.OnMembershipChange(func(change peerrelation.MembershipChange) error {
+				changes = append(changes, change)
+				if fail {
+					return errgo.New("cannot reconfigure cluster")
+				}
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"cluster": {"cluster:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"cluster:0": {
+				"someunit/1": {},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("cluster-relation-joined", "cluster:0", "someunit/1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, jc.DeepEquals, []peerrelation.MembershipChange{{
+		Joined: []hook.UnitId{"someunit/1"},
+	}})
+
+	// Settings changes do not trigger a notification.
+	changes = nil
+	runner.Relations["cluster:0"]["someunit/1"] = map[string]string{"foo": "bar"}
+	err = runner.RunHook("cluster-relation-changed", "cluster:0", "someunit/1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 0)
+
+	// When the notification fails, the change is
+	// reported again on the next hook.
+	fail = true
+	runner.Relations["cluster:0"] = map[hook.UnitId]map[string]string{
+		"someunit/2": {},
+	}
+	err = runner.RunHook("cluster-relation-departed", "cluster:0", "someunit/1")
+	c.Assert(err, gc.ErrorMatches, "cluster-relation-departed hook failed in root on unit someunit/0: cannot reconfigure cluster")
+	fail = false
+	err = runner.RunHook("cluster-relation-changed", "cluster:0", "someunit/2")
+	c.Assert(err, gc.IsNil)
+	expect := peerrelation.MembershipChange{
+		Joined:   []hook.UnitId{"someunit/2"},
+		Departed: []hook.UnitId{"someunit/1"},
+	}
+	c.Assert(changes, jc.DeepEquals, []peerrelation.MembershipChange{expect, expect})
+}
@@ -22,7 +22,14 @@ type serviceParams struct {
 
 // runServer runs the server side of the service. It is invoked
 // (indirectly) by upstart.
-func runServer(start func(ctxt *Context, args []string) (hook.Command, error), args []string) (hook.Command, error) {
+//
+// Panics in the start function, in the Kill and Wait methods of the
+// command that it returns and in the local RPC server's own goroutines
+// (see Context.ServeLocalRPC) are logged with their stack trace and
+// returned as errors with a *hook.PanicError cause holding the given
+// registry name. Panics in other goroutines started by the service
+// cannot be recovered and will crash it.
+func runServer(registryName string, start func(ctxt *Context, args []string) (hook.Command, error), args []string) (hook.Command, error) {
 	if len(args) != 1 {
 		return nil, errgo.Newf("expected exactly one argument, found %q", args)
 	}
@@ -35,19 +42,64 @@ func runServer(start func(ctxt *Context, args []string) (hook.Command, error), a
 		return nil, errgo.Notef(err, "cannot json unmarshal argument %q", pdata)
 	}
 	ctxt := &Context{
-		socketPath: p.SocketPath,
+		registryName: registryName,
+		socketPath:   p.SocketPath,
+	}
+	var cmd hook.Command
+	err = hook.CallRecovering(registryName, func() error {
+		var err error
+		cmd, err = start(ctxt, p.Args)
+		return err
+	})
+	logPanic("service start failed", err)
+	if cmd != nil {
+		cmd = recoveringCommand{
+			registryName: registryName,
+			cmd:          cmd,
+		}
+	}
+	return cmd, err
+}
+
+// logPanic logs the given error and the stack trace of the panic
+// that caused it, if any.
+func logPanic(what string, err error) {
+	if perr, ok := errgo.Cause(err).(*hook.PanicError); ok {
+		log.Printf("%s: %v\n%s", what, err, perr.Stack)
 	}
-	return start(ctxt, p.Args)
+}
+
+// recoveringCommand wraps the command returned by a service's start
+// function, recovering from panics in its Kill and Wait methods.
+type recoveringCommand struct {
+	registryName string
+	cmd          hook.Command
+}
+
+func (c recoveringCommand) Kill() {
+	err := hook.CallRecovering(c.registryName, func() error {
+		c.cmd.Kill()
+		return nil
+	})
+	logPanic("service kill failed", err)
+}
+
+func (c recoveringCommand) Wait() error {
+	err := hook.CallRecovering(c.registryName, c.cmd.Wait)
+	logPanic("service failed", err)
+	return err
 }
 
 // Context holds the context provided to a running service.
 type Context struct {
-	socketPath string
+	registryName string
+	socketPath   string
 }
 
 type rpcCommand struct {
-	tomb     tomb.Tomb
-	listener net.Listener
+	registryName string
+	tomb         tomb.Tomb
+	listener     net.Listener
 }
 
 func (c *rpcCommand) Kill() {
@@ -65,39 +117,103 @@ func (c *rpcCommand) run(srv *rpc.Server) {
 			log.Printf("local socket accept failed: %v", err)
 			return
 		}
-		c.tomb.Go(func() error {
+		c.goRecovering(func() {
+			defer conn.Close()
 			srv.ServeCodec(jsonrpc.NewServerCodec(conn))
-			conn.Close()
-			return nil
 		})
 	}
 }
 
+// goRecovering calls f in a goroutine tracked by the command's tomb.
+// If f panics, the panic is logged and the command is stopped
+// with an error holding a *hook.PanicError cause.
+func (c *rpcCommand) goRecovering(f func()) {
+	c.tomb.Go(func() error {
+		err := hook.CallRecovering(c.registryName, func() error {
+			f()
+			return nil
+		})
+		if err != nil {
+			logPanic("local RPC server failed", err)
+			c.listener.Close()
+		}
+		return err
+	})
+}
+
 // ServeLocalRPC starts a local RPC server serving methods on the given
 // receiver value, using the net/rpc package (see rpc.Server.Register).
 //
 // The methods may be invoked using the Service.Call method. Parameters
 // and return values will be marshaled as JSON.
 //
+// If rcvr implements MetricsCollector, its CollectMetrics method
+// will be called when the charm calls Service.CollectMetrics.
+// A panic in CollectMetrics is recovered and returned to the
+// charm as an error. The other methods are called by the net/rpc
+// package in goroutines of its own, so a panic in one of them
+// cannot be recovered and will crash the service.
+//
 // ServeLocalRPC returns the Command representing the running
 // service.
 func (ctxt *Context) ServeLocalRPC(rcvr interface{}) (hook.Command, error) {
 	srv := rpc.NewServer()
 	srv.Register(rcvr)
+	if collector, ok := rcvr.(MetricsCollector); ok {
+		srv.RegisterName(metricsServiceName, metricsServer{
+			registryName: ctxt.registryName,
+			collector:    collector,
+		})
+	}
 	listener, err := listen(ctxt.socketPath)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot listen on local socket")
 	}
 	cmd := &rpcCommand{
-		listener: listener,
+		registryName: ctxt.registryName,
+		listener:     listener,
 	}
-	cmd.tomb.Go(func() error {
+	cmd.goRecovering(func() {
 		cmd.run(srv)
-		return nil
 	})
 	return cmd, nil
 }
 
+// MetricsCollector may be implemented by the value passed to
+// ServeLocalRPC to supply metric values from the running service.
+type MetricsCollector interface {
+	// CollectMetrics returns the current value of each metric,
+	// keyed by metric name. The metrics should have
+	// been registered with hook.Registry.RegisterMetric.
+	CollectMetrics() (map[string]float64, error)
+}
+
+// metricsServiceName holds the name that the metrics
+// RPC server is registered under.
+const metricsServiceName = "GocharmMetrics"
+
+// metricsServer serves metrics from a MetricsCollector
+// over RPC.
+type metricsServer struct {
+	registryName string
+	collector    MetricsCollector
+}
+
+func (srv metricsServer) Collect(_ *struct{}, reply *map[string]float64) error {
+	var metrics map[string]float64
+	err := hook.CallRecovering(srv.registryName, func() error {
+		var err error
+		metrics, err = srv.collector.CollectMetrics()
+		return err
+	})
+	if err != nil {
+		logPanic("cannot collect metrics", err)
+		return errgo.Mask(err)
+	}
+	*reply = metrics
+	return nil
+}
+
 func listen(socketPath string) (net.Listener, error) {
 	// In case the unix socket is present, delete it.
 	os.Remove(socketPath)
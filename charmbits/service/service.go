@@ -12,6 +12,7 @@ import (
 	"net/rpc/jsonrpc"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/juju/utils"
@@ -68,8 +69,9 @@ func (svc *Service) Register(r *hook.Registry, serviceName string, start func(ct
 	// TODO Perhaps provide some way to do zero-downtime
 	// upgrades?
 	r.RegisterHook("upgrade-charm", svc.Restart)
+	registryName := r.Name()
 	r.RegisterCommand(func(args []string) (hook.Command, error) {
-		return runServer(start, args)
+		return runServer(registryName, start, args)
 	})
 }
 
@@ -176,6 +178,35 @@ func (svc *Service) Call(method string, args interface{}, reply interface{}) err
 	return nil
 }
 
+// CollectMetrics retrieves metric values from the running service
+// and adds them with hook.Context.AddMetric. The service must
+// implement MetricsCollector (see Context.ServeLocalRPC).
+// It is intended to be registered as the collect-metrics hook:
+//
+//	r.RegisterHook("collect-metrics", svc.CollectMetrics)
+//
+// If the service has not been started, it does nothing.
+func (svc *Service) CollectMetrics() error {
+	if !svc.state.Installed {
+		return nil
+	}
+	var metrics map[string]float64
+	if err := svc.Call(metricsServiceName+".Collect", &struct{}{}, &metrics); err != nil {
+		return errgo.Notef(err, "cannot collect metrics")
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := svc.ctxt.AddMetric(name, metrics[name]); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
 func (svc *Service) osService(args []string) OSService {
 	svc.ctxt.Logf("osService with args: %q", args)
 	exe := filepath.Join(svc.ctxt.CharmDir, "bin", "runhook")
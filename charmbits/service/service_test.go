@@ -117,6 +117,137 @@ func (TestRPCServer) TestCall(arg *TestCallArg, resp *TestCallResponse) error {
 	return nil
 }
 
+func (*suite) TestCollectMetrics(c *gc.C) {
+	startService := func(ctxt *service.Context, args []string) (hook.Command, error) {
+		return ctxt.ServeLocalRPC(metricsRPCServer{})
+	}
+	r := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			var svc service.Service
+			svc.Register(r.Clone("svc"), "servicename", startService)
+			r.RegisterHook("start", func() error {
+				return svc.Start()
+			})
+			r.RegisterHook("collect-metrics", svc.CollectMetrics)
+		},
+		Logger: c,
+	}
+	notify := make(chan hooktest.ServiceEvent, 10)
+	service.NewService = hooktest.NewServiceFunc(r, notify)
+
+	// Before the service is started, no metrics are added.
+	err := r.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(r.Record, gc.HasLen, 0)
+
+	err = r.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	expectEvent(c, notify, hooktest.ServiceEventInstall)
+	expectEvent(c, notify, hooktest.ServiceEventStart)
+
+	r.Record = nil
+	err = r.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(r.Record, jc.DeepEquals, [][]string{
+		{"add-metric", "--", "requests=1234"},
+		{"add-metric", "--", "users=2.5"},
+	})
+}
+
+type metricsRPCServer struct{}
+
+func (metricsRPCServer) CollectMetrics() (map[string]float64, error) {
+	return map[string]float64{
+		"requests": 1234,
+		"users":    2.5,
+	}, nil
+}
+
+func (*suite) TestCommandPanic(c *gc.C) {
+	startService := func(ctxt *service.Context, args []string) (hook.Command, error) {
+		return panickingCommand{}, nil
+	}
+	r := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			var svc service.Service
+			svc.Register(r.Clone("svc"), "servicename", startService)
+			r.RegisterHook("start", func() error {
+				return svc.Start()
+			})
+		},
+		Logger: c,
+	}
+	notify := make(chan hooktest.ServiceEvent, 10)
+	service.NewService = hooktest.NewServiceFunc(r, notify)
+
+	err := r.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	expectEvent(c, notify, hooktest.ServiceEventInstall)
+	expectEvent(c, notify, hooktest.ServiceEventStart)
+
+	// The panic in the running command is returned
+	// as an error rather than crashing the service.
+	e := expectEvent(c, notify, hooktest.ServiceEventError)
+	c.Assert(e.Error, gc.ErrorMatches, `command wait: panic in root.svc: wait panic`)
+	expectEvent(c, notify, hooktest.ServiceEventStop)
+}
+
+type panickingCommand struct{}
+
+func (panickingCommand) Kill() {}
+
+func (panickingCommand) Wait() error {
+	panic("wait panic")
+}
+
+func (*suite) TestCollectMetricsPanic(c *gc.C) {
+	startService := func(ctxt *service.Context, args []string) (hook.Command, error) {
+		return ctxt.ServeLocalRPC(panickingMetricsRPCServer{})
+	}
+	r := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			var svc service.Service
+			svc.Register(r.Clone("svc"), "servicename", startService)
+			r.RegisterHook("start", func() error {
+				return svc.Start()
+			})
+			r.RegisterHook("stop", func() error {
+				return svc.Stop()
+			})
+			r.RegisterHook("collect-metrics", svc.CollectMetrics)
+		},
+		Logger: c,
+	}
+	notify := make(chan hooktest.ServiceEvent, 10)
+	service.NewService = hooktest.NewServiceFunc(r, notify)
+
+	err := r.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	expectEvent(c, notify, hooktest.ServiceEventInstall)
+	expectEvent(c, notify, hooktest.ServiceEventStart)
+
+	// The panic is returned to the charm as an error.
+	err = r.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.ErrorMatches, `.*cannot collect metrics: local service call failed: panic in root.svc: metrics panic`)
+
+	// The service is still running.
+	err = r.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.ErrorMatches, `.*panic in root.svc: metrics panic`)
+
+	err = r.RunHook("stop", "", "")
+	c.Assert(err, gc.IsNil)
+	expectEvent(c, notify, hooktest.ServiceEventStop)
+}
+
+type panickingMetricsRPCServer struct{}
+
+func (panickingMetricsRPCServer) CollectMetrics() (map[string]float64, error) {
+	panic("metrics panic")
+}
+
 func expectEvent(c *gc.C, eventc <-chan hooktest.ServiceEvent, kind hooktest.ServiceEventKind) hooktest.ServiceEvent {
 	select {
 	case e := <-eventc:
@@ -9,6 +9,14 @@ import (
 
 // Provider represents the provider side of a simple relation.
 type Provider struct {
+	// AppData specifies that the values should be made available
+	// in the application-level relation settings rather than
+	// in the settings of each provider unit. Only the leader
+	// can set application-level settings, so values set
+	// on other units are saved until they become the leader.
+	// It must be set before Register is called.
+	AppData bool
+
 	state        providerState
 	ctxt         *hook.Context
 	relationName string
@@ -32,6 +40,9 @@ func (p *Provider) Register(r *hook.Registry, relationName, interfaceName string
 		Scope:     charm.ScopeGlobal,
 	})
 	r.RegisterHook(relationName+"-relation-joined", p.relationJoined)
+	if p.AppData {
+		r.RegisterHook("leader-elected", p.leaderElected)
+	}
 	r.RegisterContext(p.setContext, &p.state)
 	p.relationName = relationName
 }
@@ -43,25 +54,62 @@ func (p *Provider) setContext(ctxt *hook.Context) error {
 
 // SetValues makes the given relation attributes and values
 // available to all requirer-side units of the relation.
+// Any attributes set by an earlier call that are not
+// in vals are removed. Relations that already hold the
+// given values are not changed.
 func (p *Provider) SetValues(vals map[string]string) error {
+	// Set the current address in all requirers.
+	for _, id := range p.ctxt.RelationIdsFor(p.relationName) {
+		if err := p.setRelation(id, vals); err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	keyvals := make([]string, 0, 2*len(vals))
 	for attr, val := range vals {
 		keyvals = append(keyvals, attr)
 		keyvals = append(keyvals, val)
 	}
-	// Set the current address in all requirers.
-	for _, id := range p.ctxt.RelationIds[p.relationName] {
-		if err := p.ctxt.SetRelationWithId(id, keyvals...); err != nil {
-			return errgo.Mask(err)
-		}
-	}
 	p.state.Values = keyvals
 	return nil
 }
 
 func (p *Provider) relationJoined() error {
-	if err := p.ctxt.SetRelation(p.state.Values...); err != nil {
+	if err := p.setRelation(p.ctxt.RelationId, p.values()); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
 }
+
+// leaderElected makes the saved values available
+// when the unit becomes the leader.
+func (p *Provider) leaderElected() error {
+	vals := p.values()
+	for _, id := range p.ctxt.RelationIdsFor(p.relationName) {
+		if err := p.setRelation(id, vals); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// values returns the saved values as a map.
+func (p *Provider) values() map[string]string {
+	vals := make(map[string]string)
+	for i := 0; i+1 < len(p.state.Values); i += 2 {
+		vals[p.state.Values[i]] = p.state.Values[i+1]
+	}
+	return vals
+}
+
+// setRelation sets the given values on the relation with the
+// given id, using the application-level settings if p.AppData is set.
+func (p *Provider) setRelation(id hook.RelationId, vals map[string]string) error {
+	if !p.AppData {
+		return p.ctxt.SetRelationSettings(id, vals)
+	}
+	err := p.ctxt.SetAppRelationSettings(id, vals)
+	if errgo.Cause(err) == hook.ErrNotLeader {
+		return nil
+	}
+	return errgo.Mask(err)
+}
@@ -18,6 +18,13 @@ import (
 // set by units on the provider side of the relation available
 // through the Values method.
 type Requirer struct {
+	// AppData specifies that the values are provided
+	// in the application-level relation settings of the
+	// provider rather than the settings of each provider unit.
+	// When this is set, the Strings method uses AppValues
+	// rather than Values.
+	AppData bool
+
 	ctxt         *hook.Context
 	relationName string
 }
@@ -57,7 +64,21 @@ func (req *Requirer) setContext(ctxt *hook.Context) error {
 // Values returns the values provided by all the provider units,
 // as a map from unit id to attributes to values.
 func (req *Requirer) Values() map[hook.UnitId]map[string]string {
-	ids := req.ctxt.RelationIds[req.relationName]
+	ids := req.ctxt.RelationIdsFor(req.relationName)
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > 1 {
+		req.ctxt.Logf("more than one provider for the %s relation", req.relationName)
+		return nil
+	}
+	return req.ctxt.RelationSettings(ids[0])
+}
+
+// AppValues returns the application-level values
+// provided by the provider application.
+func (req *Requirer) AppValues() map[string]string {
+	ids := req.ctxt.RelationIdsFor(req.relationName)
 	if len(ids) == 0 {
 		return nil
 	}
@@ -65,12 +86,14 @@ func (req *Requirer) Values() map[hook.UnitId]map[string]string {
 		req.ctxt.Logf("more than one provider for the %s relation", req.relationName)
 		return nil
 	}
-	return req.ctxt.Relations[ids[0]]
+	return req.ctxt.AppRelationSettings(ids[0])
 }
 
 // Strings is a convenience method that converts the
 // values returned by Values into a slice of strings by
 // calling the given convert function for each unit.
+// If req.AppData is set, it converts the values returned
+// by AppValues instead, returning at most one string.
 //
 // Errors found when doing the conversion are logged
 // but otherwise ignored. If the convert function returns
@@ -79,6 +102,21 @@ func (req *Requirer) Values() map[hook.UnitId]map[string]string {
 //
 // The result is stable across calls.
 func (req *Requirer) Strings(convert func(map[string]string) (string, error)) []string {
+	if req.AppData {
+		vals := req.AppValues()
+		if vals == nil {
+			return nil
+		}
+		s, err := convert(vals)
+		if err != nil {
+			req.ctxt.Logf("application has invalid attributes: %v", err)
+			return nil
+		}
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
 	unitVals := req.Values()
 
 	// Sort the returned attributes by unit id so that
@@ -0,0 +1,159 @@
+package simplerelation_test
+
+import (
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/gocharm/charmbits/simplerelation"
+	"github.com/juju/gocharm/hook"
+	"github.com/juju/gocharm/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+var _ = gc.Suite(&suite{})
+
+type suite struct {
+}
+
+func (s *suite) TestSetValuesWithUnitData(c *gc.C) {
+	var p simplerelation.Provider
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "foo", "fooiface")
+			r.RegisterHook("install", func() error {
+				return p.SetValues(map[string]string{"a": "b"})
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"foo": {"foo:0"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"relation-set", "-r", "foo:0", "--", "a=b"},
+	})
+	c.Assert(runner.LocalAppRelations, gc.HasLen, 0)
+}
+
+func (s *suite) TestSetValuesWritesOnlyChanges(c *gc.C) {
+	var p simplerelation.Provider
+	var vals map[string]string
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "foo", "fooiface")
+			r.RegisterHook("config-changed", func() error {
+				return p.SetValues(vals)
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"foo": {"foo:0"},
+		},
+		Logger: c,
+	}
+	vals = map[string]string{"a": "b", "c": "d"}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"relation-set", "-r", "foo:0", "--", "a=b", "c=d"},
+	})
+
+	// Setting the same values again does nothing.
+	runner.Record = nil
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+
+	// Only changed values are written, and values
+	// that are no longer present are removed.
+	runner.Record = nil
+	vals = map[string]string{"a": "b", "e": "f"}
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"relation-set", "-r", "foo:0", "--", "c=", "e=f"},
+	})
+
+	// A newly joined relation gets all the values.
+	runner.Record = nil
+	runner.RelationIds["foo"] = append(runner.RelationIds["foo"], "foo:1")
+	err = runner.RunHook("foo-relation-joined", "foo:1", "requirer/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"relation-set", "-r", "foo:1", "--", "a=b", "e=f"},
+	})
+}
+
+func (s *suite) TestSetValuesWithAppData(c *gc.C) {
+	var p simplerelation.Provider
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.AppData = true
+			p.Register(r, "foo", "fooiface")
+			r.RegisterHook("install", func() error {
+				return p.SetValues(map[string]string{"a": "b"})
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"foo": {"foo:0"},
+		},
+		Logger: c,
+	}
+
+	// When the unit is not the leader, nothing is set.
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+	c.Assert(runner.LocalAppRelations, gc.HasLen, 0)
+
+	// When it becomes the leader, the saved values are set.
+	runner.IsLeader = true
+	err = runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+	c.Assert(runner.LocalAppRelations, jc.DeepEquals, map[hook.RelationId]map[string]string{
+		"foo:0": {"a": "b"},
+	})
+}
+
+func (s *suite) TestRequirerAppValues(c *gc.C) {
+	var req simplerelation.Requirer
+	var vals []string
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			req.AppData = true
+			req.Register(r, "foo", "fooiface")
+			r.RegisterHook("*", func() error {
+				vals = req.Strings(func(attrs map[string]string) (string, error) {
+					return attrs["a"], nil
+				})
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"foo": {"foo:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"foo:0": {
+				"provider/0": {"a": "unit"},
+			},
+		},
+		AppRelations: map[hook.RelationId]map[string]string{
+			"foo:0": {"a": "app"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("foo-relation-changed", "foo:0", "provider/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(vals, jc.DeepEquals, []string{"app"})
+}
@@ -0,0 +1,38 @@
+package typedrelation
+
+import (
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/gocharm/charmbits/simplerelation"
+	"github.com/juju/gocharm/hook"
+)
+
+// Provider represents the provider side of a relation
+// whose data is declared as a Go struct.
+type Provider struct {
+	prov   simplerelation.Provider
+	schema *relationSchema
+}
+
+// Register registers the provider side of a relation with the given
+// relation name and interface. The data argument holds a value (or
+// pointer to a value) of the struct type that declares the relation
+// data; Register panics if the type is not valid (see the package
+// documentation).
+func (p *Provider) Register(r *hook.Registry, relationName, interfaceName string, data interface{}) {
+	p.schema = mustNewSchema(data)
+	p.prov.Register(r, relationName, interfaceName)
+}
+
+// SetValue makes the given data available to all requirer-side units
+// of the relation. The data must be of the type passed to Register.
+func (p *Provider) SetValue(data interface{}) error {
+	settings, err := p.schema.encode(data)
+	if err != nil {
+		return errgo.Notef(err, "cannot encode relation data")
+	}
+	if err := p.prov.SetValues(settings); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
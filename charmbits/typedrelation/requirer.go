@@ -0,0 +1,75 @@
+package typedrelation
+
+import (
+	"reflect"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/gocharm/charmbits/simplerelation"
+	"github.com/juju/gocharm/hook"
+)
+
+// Requirer represents the requirer side of a relation
+// whose data is declared as a Go struct.
+// It allows only one provider service.
+type Requirer struct {
+	req    simplerelation.Requirer
+	schema *relationSchema
+}
+
+// Register registers the requirer side of a relation with the given
+// relation name and interface. The data argument holds a value (or
+// pointer to a value) of the struct type that declares the relation
+// data; Register panics if the type is not valid (see the package
+// documentation).
+//
+// To find out when the provider values change, register
+// a wildcard ("*") hook, which will trigger when any
+// value changes.
+func (req *Requirer) Register(r *hook.Registry, relationName, interfaceName string, data interface{}) {
+	req.schema = mustNewSchema(data)
+	req.req.Register(r, relationName, interfaceName)
+}
+
+// Values sets the slice pointed to by dst, which must be of type
+// *[]T where T is the type passed to Register, to the data provided
+// by all the provider units, sorted by unit id.
+//
+// Units that have not yet provided any data are omitted. Units whose
+// data is invalid are also omitted, and the returned map holds the
+// validation error for each of them. If all units are valid, it
+// returns nil.
+func (req *Requirer) Values(dst interface{}) map[hook.UnitId]error {
+	sliceVal := reflect.ValueOf(dst)
+	if sliceVal.Kind() != reflect.Ptr ||
+		sliceVal.Elem().Kind() != reflect.Slice ||
+		sliceVal.Elem().Type().Elem() != req.schema.t {
+		panic(errgo.Newf("destination has type %T, not *[]%s", dst, req.schema.t))
+	}
+	unitVals := req.req.Values()
+	unitIds := make([]string, 0, len(unitVals))
+	for unitId := range unitVals {
+		unitIds = append(unitIds, string(unitId))
+	}
+	sort.Strings(unitIds)
+	var errs map[hook.UnitId]error
+	result := reflect.MakeSlice(sliceVal.Elem().Type(), 0, len(unitIds))
+	for _, unitId := range unitIds {
+		settings := unitVals[hook.UnitId(unitId)]
+		if req.schema.isEmpty(settings) {
+			continue
+		}
+		v := reflect.New(req.schema.t).Elem()
+		if err := req.schema.decode(settings, v); err != nil {
+			if errs == nil {
+				errs = make(map[hook.UnitId]error)
+			}
+			errs[hook.UnitId(unitId)] = err
+			continue
+		}
+		result = reflect.Append(result, v)
+	}
+	sliceVal.Elem().Set(result)
+	return errs
+}
@@ -0,0 +1,273 @@
+// The typedrelation package implements relations whose data is
+// declared as a Go struct, so that charms do not need to parse
+// relation settings by hand.
+//
+// Each field in the struct that has a "relation" tag
+// corresponds to the relation setting named by the tag.
+// If the tag includes the "required" option, the setting
+// must be present for the data to be valid. An optional
+// "description" tag documents the setting in the schema.
+// Fields may be of string, boolean, integer or floating
+// point type.
+//
+// For example:
+//
+//	type mongodbData struct {
+//		Hostname string `relation:"hostname,required" description:"Host name of the server"`
+//		Port     int    `relation:"port,required" description:"Port the server listens on"`
+//		Replset  string `relation:"replset"`
+//	}
+//
+// The Schema function returns a JSON Schema describing the
+// relation settings for a given struct, so that the same
+// interface can be implemented by charms not written with gocharm.
+package typedrelation
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// relationSchema holds information about a relation data struct.
+type relationSchema struct {
+	t      reflect.Type
+	fields []schemaField
+}
+
+// schemaField holds information about a field in
+// a relation data struct.
+type schemaField struct {
+	key         string
+	index       int
+	required    bool
+	description string
+}
+
+// newSchema returns the schema for the given relation data
+// struct type.
+func newSchema(t reflect.Type) (*relationSchema, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, errgo.Newf("relation data has type %s, not struct", t)
+	}
+	s := &relationSchema{
+		t: t,
+	}
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("relation")
+		if f.PkgPath != "" || tag == "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		field := schemaField{
+			key:         parts[0],
+			index:       i,
+			description: f.Tag.Get("description"),
+		}
+		if field.key == "" {
+			return nil, errgo.Newf("field %s has empty relation key", f.Name)
+		}
+		if keys[field.key] {
+			return nil, errgo.Newf("duplicate relation key %q", field.key)
+		}
+		keys[field.key] = true
+		for _, opt := range parts[1:] {
+			switch opt {
+			case "required":
+				field.required = true
+			default:
+				return nil, errgo.Newf("field %s has unknown relation tag option %q", f.Name, opt)
+			}
+		}
+		if kindPattern(f.Type.Kind()) == "" {
+			return nil, errgo.Newf("field %s has unsupported type %s", f.Name, f.Type)
+		}
+		s.fields = append(s.fields, field)
+	}
+	if len(s.fields) == 0 {
+		return nil, errgo.Newf("no relation fields found in %s", t)
+	}
+	return s, nil
+}
+
+// mustNewSchema is like newSchema but panics on error.
+// It is used when registering relations, where an invalid
+// struct is a programming error.
+func mustNewSchema(data interface{}) *relationSchema {
+	s, err := newSchema(reflect.TypeOf(data))
+	if err != nil {
+		panic(errgo.Notef(err, "invalid relation data type %T", data))
+	}
+	return s
+}
+
+// encode returns the relation settings corresponding
+// to the given struct value. Settings for zero-valued
+// optional string fields are set to the empty string,
+// which removes them from the relation.
+func (s *relationSchema) encode(data interface{}) (map[string]string, error) {
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Type() != s.t {
+		return nil, errgo.Newf("relation data has type %s, not %s", v.Type(), s.t)
+	}
+	settings := make(map[string]string)
+	for _, f := range s.fields {
+		val := encodeValue(v.Field(f.index))
+		if val == "" && f.required {
+			return nil, errgo.Newf("required relation setting %q is empty", f.key)
+		}
+		settings[f.key] = val
+	}
+	return settings, nil
+}
+
+// decode fills in the struct pointed to by v from the given
+// relation settings.
+func (s *relationSchema) decode(settings map[string]string, v reflect.Value) error {
+	for _, f := range s.fields {
+		val := settings[f.key]
+		if val == "" {
+			if f.required {
+				return errgo.Newf("missing required relation setting %q", f.key)
+			}
+			continue
+		}
+		if err := decodeValue(val, v.Field(f.index)); err != nil {
+			return errgo.Notef(err, "invalid relation setting %q", f.key)
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether the given settings hold
+// none of the keys in the schema. This is usually because
+// the remote unit has not yet provided its data.
+func (s *relationSchema) isEmpty(settings map[string]string) bool {
+	for _, f := range s.fields {
+		if settings[f.key] != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	}
+	panic("unreachable")
+}
+
+func decodeValue(s string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errgo.Newf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return errgo.Newf("%q is not a valid %s", s, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return errgo.Newf("%q is not a valid %s", s, v.Type())
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return errgo.Newf("%q is not a valid %s", s, v.Type())
+		}
+		v.SetFloat(f)
+	default:
+		panic("unreachable")
+	}
+	return nil
+}
+
+// Schema returns a JSON Schema describing the relation settings for
+// the interface with the given name, where data holds a value of the
+// struct type that declares the interface's data (see the package
+// documentation). The result can be marshaled with encoding/json.
+//
+// All relation settings are strings, so the schema describes
+// non-string fields with a pattern that their values must match.
+func Schema(interfaceName string, data interface{}) (map[string]interface{}, error) {
+	s, err := newSchema(reflect.TypeOf(data))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	properties := make(map[string]interface{})
+	var required []string
+	for _, f := range s.fields {
+		prop := map[string]interface{}{
+			"type": "string",
+		}
+		if pattern := kindPattern(s.t.Field(f.index).Type.Kind()); pattern != ".*" {
+			prop["pattern"] = pattern
+		}
+		if f.description != "" {
+			prop["description"] = f.description
+		}
+		properties[f.key] = prop
+		if f.required {
+			required = append(required, f.key)
+		}
+	}
+	schema := map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-04/schema#",
+		"title":      interfaceName,
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema, nil
+}
+
+// kindPattern returns the regular expression that the
+// string representation of a value of the given kind
+// will match, or the empty string if the kind is not
+// supported.
+func kindPattern(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return ".*"
+	case reflect.Bool:
+		return "^(true|false)$"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "^-?[0-9]+$"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "^[0-9]+$"
+	case reflect.Float32, reflect.Float64:
+		return `^-?[0-9]+(\.[0-9]*)?([eE][-+]?[0-9]+)?$`
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package typedrelation_test
+
+import (
+	"strings"
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/gocharm/charmbits/typedrelation"
+	"github.com/juju/gocharm/hook"
+	"github.com/juju/gocharm/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+var _ = gc.Suite(&suite{})
+
+type suite struct {
+}
+
+type serverData struct {
+	Hostname string  `relation:"hostname,required" description:"Host name of the server"`
+	Port     int     `relation:"port,required"`
+	Secure   bool    `relation:"secure"`
+	Weight   float64 `relation:"weight"`
+	Replset  string  `relation:"replset"`
+	Ignored  string
+}
+
+func (s *suite) TestProviderSetValue(c *gc.C) {
+	var p typedrelation.Provider
+	var setErr error
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "server", "srv", serverData{})
+			r.RegisterHook("install", func() error {
+				setErr = p.SetValue(&serverData{
+					Hostname: "example.com",
+					Port:     8080,
+					Weight:   0.5,
+				})
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"server": {"server:0"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(setErr, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 1)
+	c.Assert(runner.Record[0][0:4], jc.DeepEquals, []string{"relation-set", "-r", "server:0", "--"})
+	c.Assert(keyvals(runner.Record[0][4:]), jc.DeepEquals, map[string]string{
+		"hostname": "example.com",
+		"port":     "8080",
+		"secure":   "false",
+		"weight":   "0.5",
+	})
+}
+
+func (s *suite) TestProviderSetValueMissingRequired(c *gc.C) {
+	var p typedrelation.Provider
+	var setErr error
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			p.Register(r, "server", "srv", serverData{})
+			r.RegisterHook("install", func() error {
+				setErr = p.SetValue(serverData{Port: 8080})
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		Logger:       c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(setErr, gc.ErrorMatches, `cannot encode relation data: required relation setting "hostname" is empty`)
+}
+
+func (s *suite) TestRequirerValues(c *gc.C) {
+	var req typedrelation.Requirer
+	var vals []serverData
+	var errs map[hook.UnitId]error
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			req.Register(r, "server", "srv", serverData{})
+			r.RegisterHook("*", func() error {
+				errs = req.Values(&vals)
+				return nil
+			})
+		},
+		HookStateDir: "/dev/null",
+		RelationIds: map[string][]hook.RelationId{
+			"server": {"server:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"server:0": {
+				"srv/0": {
+					"private-address": "10.0.0.1",
+					"hostname":        "a.example.com",
+					"port":            "1234",
+					"secure":          "true",
+				},
+				"srv/1": {
+					"private-address": "10.0.0.2",
+				},
+				"srv/2": {
+					"hostname": "c.example.com",
+					"port":     "bad",
+				},
+				"srv/3": {
+					"port": "99",
+				},
+				"srv/4": {
+					"hostname": "e.example.com",
+					"port":     "5678",
+					"weight":   "2.5",
+					"replset":  "rs0",
+				},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("server-relation-changed", "server:0", "srv/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(vals, jc.DeepEquals, []serverData{{
+		Hostname: "a.example.com",
+		Port:     1234,
+		Secure:   true,
+	}, {
+		Hostname: "e.example.com",
+		Port:     5678,
+		Weight:   2.5,
+		Replset:  "rs0",
+	}})
+	c.Assert(errs, gc.HasLen, 2)
+	c.Assert(errs["srv/2"], gc.ErrorMatches, `invalid relation setting "port": "bad" is not a valid int`)
+	c.Assert(errs["srv/3"], gc.ErrorMatches, `missing required relation setting "hostname"`)
+}
+
+func (s *suite) TestSchema(c *gc.C) {
+	schema, err := typedrelation.Schema("srv", serverData{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(schema, jc.DeepEquals, map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-04/schema#",
+		"title":   "srv",
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"hostname": map[string]interface{}{
+				"type":        "string",
+				"description": "Host name of the server",
+			},
+			"port": map[string]interface{}{
+				"type":    "string",
+				"pattern": "^-?[0-9]+$",
+			},
+			"secure": map[string]interface{}{
+				"type":    "string",
+				"pattern": "^(true|false)$",
+			},
+			"weight": map[string]interface{}{
+				"type":    "string",
+				"pattern": `^-?[0-9]+(\.[0-9]*)?([eE][-+]?[0-9]+)?$`,
+			},
+			"replset": map[string]interface{}{
+				"type": "string",
+			},
+		},
+		"required": []string{"hostname", "port"},
+	})
+}
+
+var schemaErrorTests = []struct {
+	about       string
+	data        interface{}
+	expectError string
+}{{
+	about:       "not a struct",
+	data:        "hello",
+	expectError: `relation data has type string, not struct`,
+}, {
+	about: "no fields",
+	data: struct {
+		A string
+	}{},
+	expectError: `no relation fields found in struct { A string }`,
+}, {
+	about: "unsupported type",
+	data: struct {
+		A []string `relation:"a"`
+	}{},
+	expectError: `field A has unsupported type \[\]string`,
+}, {
+	about: "duplicate key",
+	data: struct {
+		A string `relation:"a"`
+		B string `relation:"a"`
+	}{},
+	expectError: `duplicate relation key "a"`,
+}, {
+	about: "unknown option",
+	data: struct {
+		A string `relation:"a,optional"`
+	}{},
+	expectError: `field A has unknown relation tag option "optional"`,
+}}
+
+func (s *suite) TestSchemaError(c *gc.C) {
+	for i, test := range schemaErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		_, err := typedrelation.Schema("x", test.data)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func keyvals(args []string) map[string]string {
+	m := make(map[string]string)
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		m[kv[0]] = kv[1]
+	}
+	return m
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"go/build"
 	"io/ioutil"
 	"log"
@@ -13,6 +14,7 @@ import (
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 	"gopkg.in/yaml.v1"
 )
 
@@ -38,7 +40,12 @@ func main() {
 	r := hook.NewRegistry()
 	charm.RegisterHooks(r)
 	hook.RegisterMainHooks(r)
-	if len(os.Args) < 2 {
+{{if .StateStorage}}	storage, err := hook.ParseStateStorage({{.StateStorage | printf "%q"}})
+	if err != nil {
+		fatalf("%v", err)
+	}
+	r.SetStateStorage(storage)
+{{end}}	if len(os.Args) < 2 {
 		fatalf("hook name argument required")
 	}
 	// TODO would /etc/init be a better place for local state?		
@@ -82,17 +89,22 @@ type buildCharmParams struct {
 	// This also implies that the hooks will have the
 	// capability to recompile.
 	source bool
+
+	// stateStorage holds the name of the state storage
+	// that the hooks will use. If it is empty, the storage
+	// set by the charm is used.
+	stateStorage string
 }
 
 type charmBuilder buildCharmParams
 
 // buildCharm builds the runhook executable,
 // and all the other charm pieces (hooks, metadata.yaml,
-// config.yaml). It puts the runhook source file into goFile
+// config.yaml, actions). It puts the runhook source file into goFile
 // and the runhook executable into exe.
 func buildCharm(p buildCharmParams) error {
 	b := (*charmBuilder)(&p)
-	code := generateCode(hookMainCode, b.pkg.ImportPath)
+	code := generateCode(hookMainCode, b.pkg.ImportPath, b.stateStorage)
 	var exe string
 	if b.source {
 		// Build the runhook executable anyway, just to be sure
@@ -115,12 +127,18 @@ func buildCharm(p buildCharmParams) error {
 	if err := b.writeHooks(info.Hooks); err != nil {
 		return errgo.Notef(err, "cannot write hooks to charm")
 	}
-	if err := b.writeMeta(info.Relations); err != nil {
+	if err := b.writeMeta(info); err != nil {
 		return errgo.Notef(err, "cannot write metadata.yaml")
 	}
 	if err := b.writeConfig(info.Config); err != nil {
 		return errgo.Notef(err, "cannot write config.yaml")
 	}
+	if err := b.writeActions(info.Actions); err != nil {
+		return errgo.Notef(err, "cannot write actions")
+	}
+	if err := b.writeMetrics(info.Metrics); err != nil {
+		return errgo.Notef(err, "cannot write metrics")
+	}
 	// Sanity check that the new config files parse correctly.
 	_, err = charm.ReadCharmDir(b.charmDir)
 	if err != nil {
@@ -207,7 +225,7 @@ func (b *charmBuilder) hookStub(hookName string) []byte {
 	})
 }
 
-func (b *charmBuilder) writeMeta(relations map[string]charm.Relation) error {
+func (b *charmBuilder) writeMeta(info *charmInfo) error {
 	metaFile, err := os.Open(filepath.Join(b.pkg.Dir, "metadata.yaml"))
 	if err != nil {
 		return errgo.Mask(err)
@@ -224,7 +242,7 @@ func (b *charmBuilder) writeMeta(relations map[string]charm.Relation) error {
 	meta.Requires = make(map[string]charm.Relation)
 	meta.Peers = make(map[string]charm.Relation)
 
-	for name, rel := range relations {
+	for name, rel := range info.Relations {
 		switch rel.Role {
 		case charm.RoleProvider:
 			meta.Provides[name] = rel
@@ -236,12 +254,144 @@ func (b *charmBuilder) writeMeta(relations map[string]charm.Relation) error {
 			return errgo.Newf("unknown role %q in relation", rel.Role)
 		}
 	}
-	if err := writeYAML(filepath.Join(b.charmDir, "metadata.yaml"), meta); err != nil {
+	if len(info.Storage) > 0 && meta.Storage == nil {
+		meta.Storage = make(map[string]charm.Storage)
+	}
+	for name, st := range info.Storage {
+		meta.Storage[name] = st
+	}
+	if len(info.Resources) > 0 && meta.Resources == nil {
+		meta.Resources = make(map[string]resource.Meta)
+	}
+	for name, res := range info.Resources {
+		meta.Resources[name] = res
+	}
+	if len(info.ExtraBindings) > 0 && meta.ExtraBindings == nil {
+		meta.ExtraBindings = make(map[string]charm.ExtraBinding)
+	}
+	for name, binding := range info.ExtraBindings {
+		meta.ExtraBindings[name] = binding
+	}
+	if info.Subordinate {
+		meta.Subordinate = true
+	}
+	if err := checkSubordinate(meta); err != nil {
+		return errgo.Mask(err)
+	}
+	metaData, err := metaYAML(meta)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := writeYAML(filepath.Join(b.charmDir, "metadata.yaml"), metaData); err != nil {
 		return errgo.Notef(err, "cannot write metadata.yaml")
 	}
 	return nil
 }
 
+// checkSubordinate checks that, if meta describes a subordinate
+// charm, it has at least one container-scoped requirer relation.
+func checkSubordinate(meta *charm.Meta) error {
+	if !meta.Subordinate {
+		return nil
+	}
+	for _, rel := range meta.Requires {
+		if rel.Scope == charm.ScopeContainer {
+			return nil
+		}
+	}
+	return errgo.Newf("subordinate charm %q has no container-scoped requirer relation", meta.Name)
+}
+
+// metaYAML returns a value that marshals to the metadata.yaml
+// representation of meta. Not all the fields of charm.Meta marshal
+// to the form expected in metadata.yaml, so we convert those
+// explicitly.
+func metaYAML(meta *charm.Meta) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal metadata")
+	}
+	var out map[string]interface{}
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal metadata")
+	}
+	delete(out, "storage")
+	if len(meta.Storage) > 0 {
+		out["storage"] = storageYAML(meta.Storage)
+	}
+	delete(out, "resources")
+	if len(meta.Resources) > 0 {
+		out["resources"] = resourcesYAML(meta.Resources)
+	}
+	delete(out, "extrabindings")
+	if len(meta.ExtraBindings) > 0 {
+		bindings := make(map[string]interface{})
+		for name := range meta.ExtraBindings {
+			bindings[name] = nil
+		}
+		out["extra-bindings"] = bindings
+	}
+	return out, nil
+}
+
+// resourcesYAML returns the metadata.yaml representation
+// of the given resources.
+func resourcesYAML(resources map[string]resource.Meta) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for name, res := range resources {
+		m := map[string]interface{}{
+			"type":     res.Type.String(),
+			"filename": res.Path,
+		}
+		if res.Description != "" {
+			m["description"] = res.Description
+		}
+		out[name] = m
+	}
+	return out
+}
+
+// storageYAML returns the metadata.yaml representation
+// of the given storage.
+func storageYAML(storage map[string]charm.Storage) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for name, st := range storage {
+		m := map[string]interface{}{
+			"type": string(st.Type),
+		}
+		if st.Description != "" {
+			m["description"] = st.Description
+		}
+		if st.Shared {
+			m["shared"] = true
+		}
+		if st.ReadOnly {
+			m["read-only"] = true
+		}
+		switch {
+		case st.CountMin == 1 && st.CountMax == 1:
+			// This is the default.
+		case st.CountMax == -1:
+			m["multiple"] = map[string]string{"range": fmt.Sprintf("%d-", st.CountMin)}
+		case st.CountMin == st.CountMax:
+			m["multiple"] = map[string]string{"range": fmt.Sprintf("%d", st.CountMin)}
+		default:
+			m["multiple"] = map[string]string{"range": fmt.Sprintf("%d-%d", st.CountMin, st.CountMax)}
+		}
+		if st.MinimumSize > 0 {
+			m["minimum-size"] = fmt.Sprintf("%dM", st.MinimumSize)
+		}
+		if st.Location != "" {
+			m["location"] = st.Location
+		}
+		if len(st.Properties) > 0 {
+			m["properties"] = st.Properties
+		}
+		out[name] = m
+	}
+	return out
+}
+
 const yamlAutogenComment = "# " + autogenMessage + "\n"
 
 func writeYAML(file string, val interface{}) error {
@@ -269,6 +419,85 @@ func (b *charmBuilder) writeConfig(config map[string]charm.Option) error {
 	return nil
 }
 
+// writeMetrics writes metrics.yaml for the given metrics.
+func (b *charmBuilder) writeMetrics(metrics map[string]charm.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if *verbose {
+		log.Printf("writing metrics in %s", b.charmDir)
+	}
+	if err := writeYAML(filepath.Join(b.charmDir, "metrics.yaml"), metricsYAML(metrics)); err != nil {
+		return errgo.Notef(err, "cannot write metrics.yaml")
+	}
+	return nil
+}
+
+// metricsYAML returns the metrics.yaml representation
+// of the given metrics.
+func metricsYAML(metrics map[string]charm.Metric) map[string]interface{} {
+	out := make(map[string]map[string]string)
+	for name, m := range metrics {
+		out[name] = map[string]string{
+			"type":        string(m.Type),
+			"description": m.Description,
+		}
+	}
+	return map[string]interface{}{
+		"metrics": out,
+	}
+}
+
+// writeActions writes actions.yaml and the action stubs
+// for the given actions.
+func (b *charmBuilder) writeActions(actions map[string]charm.ActionSpec) error {
+	if len(actions) == 0 {
+		return nil
+	}
+	if *verbose {
+		log.Printf("writing actions in %s", b.charmDir)
+	}
+	if err := writeYAML(filepath.Join(b.charmDir, "actions.yaml"), actionsYAML(actions)); err != nil {
+		return errgo.Notef(err, "cannot write actions.yaml")
+	}
+	actionDir := filepath.Join(b.charmDir, "actions")
+	if err := os.MkdirAll(actionDir, 0777); err != nil {
+		return errgo.Notef(err, "failed to make actions directory")
+	}
+	for name := range actions {
+		if err := ioutil.WriteFile(filepath.Join(actionDir, name), b.hookStub(name+"-action"), 0755); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// actionsYAML returns the actions.yaml representation of the
+// given actions. The action parameters are held as JSON schema
+// in the Params field, but actions.yaml holds the parameter
+// properties in the "params" field, with the other schema fields
+// alongside it.
+func actionsYAML(actions map[string]charm.ActionSpec) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for name, spec := range actions {
+		action := map[string]interface{}{
+			"description": spec.Description,
+		}
+		for key, val := range spec.Params {
+			switch key {
+			case "title", "type", "description":
+				// These are implied by the action itself.
+			case "properties":
+				action["params"] = val
+			default:
+				action[key] = val
+			}
+		}
+		out[name] = action
+	}
+	return out
+}
+
 var listSep = string(filepath.ListSeparator)
 
 func (b *charmBuilder) vendorDeps() error {
@@ -313,13 +542,15 @@ type templateParams struct {
 	AutogenMessage string
 	CharmPackage   string
 	HookPackage    string
+	StateStorage   string
 }
 
-func generateCode(tmpl *template.Template, charmPackage string) []byte {
+func generateCode(tmpl *template.Template, charmPackage, stateStorage string) []byte {
 	return executeTemplate(tmpl, templateParams{
 		CharmPackage:   charmPackage,
 		HookPackage:    hookPackage,
 		AutogenMessage: autogenMessage,
+		StateStorage:   stateStorage,
 	})
 }
 
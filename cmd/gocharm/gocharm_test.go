@@ -6,8 +6,11 @@ import (
 	"path/filepath"
 	"syscall"
 
+	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/filetesting"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 )
 
 type suite struct{}
@@ -87,3 +90,218 @@ func (suite) TestCopyContents(c *gc.C) {
 		}
 	}
 }
+
+var storageYAMLTests = []struct {
+	about  string
+	st     charm.Storage
+	expect map[string]interface{}
+}{{
+	about: "defaults",
+	st: charm.Storage{
+		Type:     charm.StorageFilesystem,
+		CountMin: 1,
+		CountMax: 1,
+	},
+	expect: map[string]interface{}{
+		"type": "filesystem",
+	},
+}, {
+	about: "everything",
+	st: charm.Storage{
+		Description: "some data",
+		Type:        charm.StorageBlock,
+		Shared:      true,
+		ReadOnly:    true,
+		CountMin:    0,
+		CountMax:    -1,
+		MinimumSize: 1024,
+		Location:    "/srv/data",
+		Properties:  []string{"transient"},
+	},
+	expect: map[string]interface{}{
+		"type":         "block",
+		"description":  "some data",
+		"shared":       true,
+		"read-only":    true,
+		"multiple":     map[string]string{"range": "0-"},
+		"minimum-size": "1024M",
+		"location":     "/srv/data",
+		"properties":   []string{"transient"},
+	},
+}, {
+	about: "fixed count",
+	st: charm.Storage{
+		Type:     charm.StorageFilesystem,
+		CountMin: 3,
+		CountMax: 3,
+	},
+	expect: map[string]interface{}{
+		"type":     "filesystem",
+		"multiple": map[string]string{"range": "3"},
+	},
+}, {
+	about: "count range",
+	st: charm.Storage{
+		Type:     charm.StorageFilesystem,
+		CountMin: 1,
+		CountMax: 5,
+	},
+	expect: map[string]interface{}{
+		"type":     "filesystem",
+		"multiple": map[string]string{"range": "1-5"},
+	},
+}}
+
+func (suite) TestStorageYAML(c *gc.C) {
+	for i, test := range storageYAMLTests {
+		c.Logf("test %d: %s", i, test.about)
+		test.st.Name = "data"
+		out := storageYAML(map[string]charm.Storage{"data": test.st})
+		c.Assert(out, jc.DeepEquals, map[string]map[string]interface{}{
+			"data": test.expect,
+		})
+	}
+}
+
+func (suite) TestResourcesYAML(c *gc.C) {
+	out := resourcesYAML(map[string]resource.Meta{
+		"res0": {
+			Name:        "res0",
+			Type:        resource.TypeFile,
+			Path:        "res0.tgz",
+			Description: "something",
+		},
+		"res1": {
+			Name: "res1",
+			Type: resource.TypeFile,
+			Path: "res1.zip",
+		},
+	})
+	c.Assert(out, jc.DeepEquals, map[string]map[string]interface{}{
+		"res0": {
+			"type":        "file",
+			"filename":    "res0.tgz",
+			"description": "something",
+		},
+		"res1": {
+			"type":     "file",
+			"filename": "res1.zip",
+		},
+	})
+}
+
+func (suite) TestMetaYAML(c *gc.C) {
+	out, err := metaYAML(&charm.Meta{
+		Name:    "foo",
+		Summary: "a charm",
+		Storage: map[string]charm.Storage{
+			"data": {
+				Name:     "data",
+				Type:     charm.StorageFilesystem,
+				CountMin: 1,
+				CountMax: 1,
+			},
+		},
+		Resources: map[string]resource.Meta{
+			"res": {
+				Name: "res",
+				Type: resource.TypeFile,
+				Path: "res.tgz",
+			},
+		},
+		ExtraBindings: map[string]charm.ExtraBinding{
+			"admin": {Name: "admin"},
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(out["name"], gc.Equals, "foo")
+	c.Assert(out["summary"], gc.Equals, "a charm")
+	c.Assert(out["storage"], jc.DeepEquals, map[string]map[string]interface{}{
+		"data": {"type": "filesystem"},
+	})
+	c.Assert(out["resources"], jc.DeepEquals, map[string]map[string]interface{}{
+		"res": {"type": "file", "filename": "res.tgz"},
+	})
+	c.Assert(out["extra-bindings"], jc.DeepEquals, map[string]interface{}{
+		"admin": nil,
+	})
+	_, ok := out["extrabindings"]
+	c.Assert(ok, gc.Equals, false)
+}
+
+var checkSubordinateTests = []struct {
+	about       string
+	meta        charm.Meta
+	expectError string
+}{{
+	about: "not subordinate",
+	meta: charm.Meta{
+		Name: "foo",
+	},
+}, {
+	about: "subordinate with container-scoped requirer",
+	meta: charm.Meta{
+		Name:        "foo",
+		Subordinate: true,
+		Requires: map[string]charm.Relation{
+			"juju-info": {
+				Name:      "juju-info",
+				Role:      charm.RoleRequirer,
+				Interface: "juju-info",
+				Scope:     charm.ScopeContainer,
+			},
+		},
+	},
+}, {
+	about: "subordinate with only global requirer",
+	meta: charm.Meta{
+		Name:        "foo",
+		Subordinate: true,
+		Requires: map[string]charm.Relation{
+			"db": {
+				Name:      "db",
+				Role:      charm.RoleRequirer,
+				Interface: "mysql",
+				Scope:     charm.ScopeGlobal,
+			},
+		},
+		Provides: map[string]charm.Relation{
+			"logs": {
+				Name:      "logs",
+				Role:      charm.RoleProvider,
+				Interface: "logs",
+				Scope:     charm.ScopeContainer,
+			},
+		},
+	},
+	expectError: `subordinate charm "foo" has no container-scoped requirer relation`,
+}}
+
+func (suite) TestCheckSubordinate(c *gc.C) {
+	for i, test := range checkSubordinateTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := checkSubordinate(&test.meta)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+		} else {
+			c.Assert(err, gc.IsNil)
+		}
+	}
+}
+
+func (suite) TestMetricsYAML(c *gc.C) {
+	out := metricsYAML(map[string]charm.Metric{
+		"requests": {
+			Type:        charm.MetricTypeAbsolute,
+			Description: "number of requests",
+		},
+	})
+	c.Assert(out, jc.DeepEquals, map[string]interface{}{
+		"metrics": map[string]map[string]string{
+			"requests": {
+				"type":        "absolute",
+				"description": "number of requests",
+			},
+		},
+	})
+}
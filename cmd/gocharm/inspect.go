@@ -11,10 +11,11 @@ import (
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 )
 
 func registeredCharmInfo(pkg, tempDir string) (*charmInfo, error) {
-	code := generateCode(inspectCode, pkg)
+	code := generateCode(inspectCode, pkg, "")
 	inspectExe := filepath.Join(tempDir, "inspect")
 	err := compile(filepath.Join(tempDir, "inspect.go"), inspectExe, code, false)
 	if err != nil {
@@ -38,6 +39,14 @@ func registeredCharmInfo(pkg, tempDir string) (*charmInfo, error) {
 		log.Printf("registered hooks: %v", out.Hooks)
 		log.Printf("%d registered relations", len(out.Relations))
 		log.Printf("%d registered config options", len(out.Config))
+		log.Printf("%d registered actions", len(out.Actions))
+		log.Printf("%d registered storage", len(out.Storage))
+		log.Printf("%d registered resources", len(out.Resources))
+		log.Printf("%d registered extra bindings", len(out.ExtraBindings))
+		log.Printf("%d registered metrics", len(out.Metrics))
+		if out.Subordinate {
+			log.Printf("charm is subordinate")
+		}
 	}
 	return &out, nil
 }
@@ -47,9 +56,15 @@ func registeredCharmInfo(pkg, tempDir string) (*charmInfo, error) {
 // Note that this must be kept in sync with the
 // version in inspectCode below.
 type charmInfo struct {
-	Hooks     []string
-	Relations map[string]charm.Relation
-	Config    map[string]charm.Option
+	Hooks         []string
+	Relations     map[string]charm.Relation
+	Config        map[string]charm.Option
+	Actions       map[string]charm.ActionSpec
+	Storage       map[string]charm.Storage
+	Resources     map[string]resource.Meta
+	ExtraBindings map[string]charm.ExtraBinding
+	Metrics       map[string]charm.Metric
+	Subordinate   bool
 }
 
 var inspectCode = template.Must(template.New("").Parse(`
@@ -60,6 +75,7 @@ package main
 import (
 	"encoding/json"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 	"os"
 
 	inspect {{.CharmPackage | printf "%q"}}
@@ -69,9 +85,15 @@ import (
 // charmInfo must be kept in sync with the charmInfo
 // type above.
 type charmInfo struct {
-	Hooks     []string
-	Relations map[string]charm.Relation
-	Config    map[string]charm.Option
+	Hooks         []string
+	Relations     map[string]charm.Relation
+	Config        map[string]charm.Option
+	Actions       map[string]charm.ActionSpec
+	Storage       map[string]charm.Storage
+	Resources     map[string]resource.Meta
+	ExtraBindings map[string]charm.ExtraBinding
+	Metrics       map[string]charm.Metric
+	Subordinate   bool
 }
 
 func main() {
@@ -79,9 +101,15 @@ func main() {
 	inspect.RegisterHooks(r)
 	hook.RegisterMainHooks(r)
 	data, err := json.Marshal(charmInfo{
-		Hooks:     r.RegisteredHooks(),
-		Relations: r.RegisteredRelations(),
-		Config:    r.RegisteredConfig(),
+		Hooks:         r.RegisteredHooks(),
+		Relations:     r.RegisteredRelations(),
+		Config:        r.RegisteredConfig(),
+		Actions:       r.RegisteredActions(),
+		Storage:       r.RegisteredStorage(),
+		Resources:     r.RegisteredResources(),
+		ExtraBindings: r.RegisteredExtraBindings(),
+		Metrics:       r.RegisteredMetrics(),
+		Subordinate:   r.CharmInfo().Subordinate,
 	})
 	if err != nil {
 		panic(err)
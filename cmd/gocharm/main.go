@@ -8,6 +8,7 @@
 //	  -repo="": charm repo directory (defaults to $JUJU_REPOSITORY)
 //	  -series="trusty": select the os version to deploy the charm as
 //	  -source=false: include source code instead of binary executable
+//	  -state-storage="": how to store persistent charm state (files, single-file, unit or leader)
 //	  -v=false: print information about charms being built
 //
 // If the -source flag is specified, all source dependencies are installed
@@ -53,6 +54,11 @@
 // all registered charm configuration options.
 // A hooks directory will be created containing an entry
 // for each registered hook.
+// If any actions are registered, a $charmdir/actions.yaml file
+// will be created describing them, and an actions directory
+// will be created containing an entry for each one.
+// If any metrics are registered, a $charmdir/metrics.yaml
+// file will be created describing them.
 package main
 
 import (
@@ -69,6 +75,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/juju/gocharm/hook"
 	"github.com/juju/utils/fs"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
@@ -80,6 +87,8 @@ var (
 	source  = flag.Bool("source", false, "include source code instead of binary executable")
 	godeps  = flag.Bool("godeps", false, "include godeps output in $CHARM_DIR/dependencies.tsv")
 	keep    = flag.Bool("keep", false, "do not delete temporary files")
+
+	stateStorage = flag.String("state-storage", "", "how to store persistent charm state (files, single-file, unit or leader); overrides the charm's own choice")
 )
 
 // TODO select current OS version by default
@@ -93,6 +102,11 @@ func main() {
 		os.Exit(2)
 	}
 	flag.Parse()
+	if *stateStorage != "" {
+		if _, err := hook.ParseStateStorage(*stateStorage); err != nil {
+			fatalf("%v", err)
+		}
+	}
 	if *repo == "" {
 		if *repo = os.Getenv("JUJU_REPOSITORY"); *repo == "" {
 			fatalf("JUJU_REPOSITORY environment variable not set")
@@ -162,6 +176,8 @@ func main1(pkgPath string) error {
 		charmDir: tempCharmDir,
 		tempDir:  tempDir,
 		source:   *source,
+
+		stateStorage: *stateStorage,
 		// TODO godeps
 	}); err != nil {
 		return errgo.Mask(err)
@@ -245,6 +261,8 @@ func cleanDestination(dir string) error {
 }
 
 var allowed = map[string]bool{
+	"actions":          true,
+	"actions.yaml":     true,
 	"assets":           true,
 	"bin":              true,
 	"compile":          true,
@@ -252,6 +270,7 @@ var allowed = map[string]bool{
 	"dependencies.tsv": true,
 	"hooks":            true,
 	"metadata.yaml":    true,
+	"metrics.yaml":     true,
 	"pkg":              true, // This allows us to test the compile scripts in the charm dir.
 	"README.md":        true,
 	"revision":         true,
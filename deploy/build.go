@@ -2,6 +2,7 @@ package deploy
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -13,6 +14,7 @@ import (
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 	"gopkg.in/yaml.v2"
 )
 
@@ -50,6 +52,12 @@ type BuildCharmParams struct {
 	// NoCompress specifies that the binary should
 	// not be compressed in the charm.
 	NoCompress bool
+
+	// StateStorage holds the name of the state storage
+	// to use when running hooks (see hook.ParseStateStorage).
+	// If it is non-empty, it overrides any storage set
+	// with Registry.SetStateStorage.
+	StateStorage string
 }
 
 type charmBuilder BuildCharmParams
@@ -67,16 +75,27 @@ func BuildCharm(p BuildCharmParams) error {
 			return errgo.Newf("no hook binary provided")
 		}
 	}
+	if p.StateStorage != "" {
+		if _, err := hook.ParseStateStorage(p.StateStorage); err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	r := b.Registry
 	if err := b.writeHooks(r.RegisteredHooks()); err != nil {
 		return errgo.Notef(err, "cannot write hooks to charm")
 	}
-	if err := b.writeMeta(r.RegisteredRelations()); err != nil {
+	if err := b.writeMeta(); err != nil {
 		return errgo.Notef(err, "cannot write metadata.yaml")
 	}
 	if err := b.writeConfig(r.RegisteredConfig()); err != nil {
 		return errgo.Notef(err, "cannot write config.yaml")
 	}
+	if err := b.writeActions(r.RegisteredActions()); err != nil {
+		return errgo.Notef(err, "cannot write actions")
+	}
+	if err := b.writeMetrics(r.RegisteredMetrics()); err != nil {
+		return errgo.Notef(err, "cannot write metrics")
+	}
 	if p.HookBinary != "" {
 		if err := b.writeBinary(p.HookBinary); err != nil {
 			return errgo.Notef(err, "cannot write hook binary")
@@ -138,7 +157,7 @@ fi
 {{else if not .NoCompress }}
 "$CHARM_DIR/uncompress"
 {{end}}
-$CHARM_DIR/bin/runhook -run-hook {{.HookName}}
+$CHARM_DIR/bin/runhook{{if .StateStorage}} -state-storage {{.StateStorage}}{{end}} -run-hook {{.HookName}}
 `))
 
 func (b *charmBuilder) writeUncompressor() error {
@@ -163,32 +182,36 @@ fi
 `
 
 type hookStubParams struct {
-	Source     bool
-	HookName   string
-	GodepPath  string
-	NoCompress bool
+	Source       bool
+	HookName     string
+	GodepPath    string
+	NoCompress   bool
+	StateStorage string
 }
 
 func (b *charmBuilder) hookStub(hookName string) []byte {
 	return executeTemplate(hookStubTemplate, hookStubParams{
-		Source:     b.Source,
-		HookName:   hookName,
-		GodepPath:  godepPath,
-		NoCompress: b.NoCompress,
+		Source:       b.Source,
+		HookName:     hookName,
+		GodepPath:    godepPath,
+		NoCompress:   b.NoCompress,
+		StateStorage: b.StateStorage,
 	})
 }
 
-func (b *charmBuilder) writeMeta(relations map[string]charm.Relation) error {
+func (b *charmBuilder) writeMeta() error {
+	r := b.Registry
 	var meta charm.Meta
-	info := b.Registry.CharmInfo()
+	info := r.CharmInfo()
 	meta.Name = info.Name
 	meta.Summary = info.Summary
 	meta.Description = info.Description
+	meta.Subordinate = info.Subordinate
 	meta.Provides = make(map[string]charm.Relation)
 	meta.Requires = make(map[string]charm.Relation)
 	meta.Peers = make(map[string]charm.Relation)
 
-	for name, rel := range relations {
+	for name, rel := range r.RegisteredRelations() {
 		switch rel.Role {
 		case charm.RoleProvider:
 			meta.Provides[name] = rel
@@ -200,12 +223,126 @@ func (b *charmBuilder) writeMeta(relations map[string]charm.Relation) error {
 			return errgo.Newf("unknown role %q in relation", rel.Role)
 		}
 	}
-	if err := writeYAML(filepath.Join(b.CharmDir, "metadata.yaml"), &meta); err != nil {
+	meta.Storage = r.RegisteredStorage()
+	meta.Resources = r.RegisteredResources()
+	meta.ExtraBindings = r.RegisteredExtraBindings()
+	if err := checkSubordinate(&meta); err != nil {
+		return errgo.Mask(err)
+	}
+	metaData, err := metaYAML(&meta)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := writeYAML(filepath.Join(b.CharmDir, "metadata.yaml"), metaData); err != nil {
 		return errgo.Notef(err, "cannot write metadata.yaml")
 	}
 	return nil
 }
 
+// checkSubordinate checks that, if meta describes a subordinate
+// charm, it has at least one container-scoped requirer relation.
+func checkSubordinate(meta *charm.Meta) error {
+	if !meta.Subordinate {
+		return nil
+	}
+	for _, rel := range meta.Requires {
+		if rel.Scope == charm.ScopeContainer {
+			return nil
+		}
+	}
+	return errgo.Newf("subordinate charm %q has no container-scoped requirer relation", meta.Name)
+}
+
+// metaYAML returns a value that marshals to the metadata.yaml
+// representation of meta. Not all the fields of charm.Meta marshal
+// to the form expected in metadata.yaml, so we convert those
+// explicitly.
+func metaYAML(meta *charm.Meta) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal metadata")
+	}
+	var out map[string]interface{}
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal metadata")
+	}
+	delete(out, "storage")
+	if len(meta.Storage) > 0 {
+		out["storage"] = storageYAML(meta.Storage)
+	}
+	delete(out, "resources")
+	if len(meta.Resources) > 0 {
+		out["resources"] = resourcesYAML(meta.Resources)
+	}
+	delete(out, "extrabindings")
+	if len(meta.ExtraBindings) > 0 {
+		bindings := make(map[string]interface{})
+		for name := range meta.ExtraBindings {
+			bindings[name] = nil
+		}
+		out["extra-bindings"] = bindings
+	}
+	return out, nil
+}
+
+// resourcesYAML returns the metadata.yaml representation
+// of the given resources.
+func resourcesYAML(resources map[string]resource.Meta) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for name, res := range resources {
+		m := map[string]interface{}{
+			"type":     res.Type.String(),
+			"filename": res.Path,
+		}
+		if res.Description != "" {
+			m["description"] = res.Description
+		}
+		out[name] = m
+	}
+	return out
+}
+
+// storageYAML returns the metadata.yaml representation
+// of the given storage.
+func storageYAML(storage map[string]charm.Storage) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for name, st := range storage {
+		m := map[string]interface{}{
+			"type": string(st.Type),
+		}
+		if st.Description != "" {
+			m["description"] = st.Description
+		}
+		if st.Shared {
+			m["shared"] = true
+		}
+		if st.ReadOnly {
+			m["read-only"] = true
+		}
+		switch {
+		case st.CountMin == 1 && st.CountMax == 1:
+			// This is the default.
+		case st.CountMax == -1:
+			m["multiple"] = map[string]string{"range": fmt.Sprintf("%d-", st.CountMin)}
+		case st.CountMin == st.CountMax:
+			m["multiple"] = map[string]string{"range": fmt.Sprintf("%d", st.CountMin)}
+		default:
+			m["multiple"] = map[string]string{"range": fmt.Sprintf("%d-%d", st.CountMin, st.CountMax)}
+		}
+		if st.MinimumSize > 0 {
+			m["minimum-size"] = fmt.Sprintf("%dM", st.MinimumSize)
+		}
+		if st.Location != "" {
+			m["location"] = st.Location
+		}
+		if len(st.Properties) > 0 {
+			m["properties"] = st.Properties
+		}
+		out[name] = m
+	}
+	return out
+}
+
 func (b *charmBuilder) writeConfig(config map[string]charm.Option) error {
 	configPath := filepath.Join(b.CharmDir, "config.yaml")
 	if len(config) == 0 {
@@ -219,6 +356,79 @@ func (b *charmBuilder) writeConfig(config map[string]charm.Option) error {
 	return nil
 }
 
+// writeMetrics writes metrics.yaml for the given metrics.
+func (b *charmBuilder) writeMetrics(metrics map[string]charm.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if err := writeYAML(filepath.Join(b.CharmDir, "metrics.yaml"), metricsYAML(metrics)); err != nil {
+		return errgo.Notef(err, "cannot write metrics.yaml")
+	}
+	return nil
+}
+
+// metricsYAML returns the metrics.yaml representation
+// of the given metrics.
+func metricsYAML(metrics map[string]charm.Metric) map[string]interface{} {
+	out := make(map[string]map[string]string)
+	for name, m := range metrics {
+		out[name] = map[string]string{
+			"type":        string(m.Type),
+			"description": m.Description,
+		}
+	}
+	return map[string]interface{}{
+		"metrics": out,
+	}
+}
+
+// writeActions writes actions.yaml and the action stubs
+// for the given actions.
+func (b *charmBuilder) writeActions(actions map[string]charm.ActionSpec) error {
+	if len(actions) == 0 {
+		return nil
+	}
+	if err := writeYAML(filepath.Join(b.CharmDir, "actions.yaml"), actionsYAML(actions)); err != nil {
+		return errgo.Notef(err, "cannot write actions.yaml")
+	}
+	actionDir := filepath.Join(b.CharmDir, "actions")
+	if err := os.MkdirAll(actionDir, 0777); err != nil {
+		return errgo.Notef(err, "failed to make actions directory")
+	}
+	for name := range actions {
+		if err := ioutil.WriteFile(filepath.Join(actionDir, name), b.hookStub(name+"-action"), 0755); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// actionsYAML returns the actions.yaml representation of the
+// given actions. The action parameters are held as JSON schema
+// in the Params field, but actions.yaml holds the parameter
+// properties in the "params" field, with the other schema fields
+// alongside it.
+func actionsYAML(actions map[string]charm.ActionSpec) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	for name, spec := range actions {
+		action := map[string]interface{}{
+			"description": spec.Description,
+		}
+		for key, val := range spec.Params {
+			switch key {
+			case "title", "type", "description":
+				// These are implied by the action itself.
+			case "properties":
+				action["params"] = val
+			default:
+				action[key] = val
+			}
+		}
+		out[name] = action
+	}
+	return out
+}
+
 func (b *charmBuilder) writeBinary(exe string) error {
 	// TODO compress
 	f, err := os.Open(exe)
@@ -20,10 +20,11 @@ import (
 )
 
 var (
-	deployFlag     string
-	buildFlag      string
-	runHookFlag    string
-	noCompressFlag bool
+	deployFlag       string
+	buildFlag        string
+	runHookFlag      string
+	noCompressFlag   bool
+	stateStorageFlag string
 )
 
 // MainFlags adds charm flags to the global flags.
@@ -32,6 +33,7 @@ func MainFlags() {
 	flag.StringVar(&buildFlag, "build-charm", "", "build Juju charm - argument is path to directory to write charm to")
 	flag.StringVar(&runHookFlag, "run-hook", "", "run as charm hook")
 	flag.BoolVar(&noCompressFlag, "no-charm-compress", false, "disable charm binary compression")
+	flag.StringVar(&stateStorageFlag, "state-storage", "", "how to store persistent charm state (files, single-file, unit or leader); overrides the charm's own choice")
 }
 
 var (
@@ -63,6 +65,13 @@ func RunMain(r *hook.Registry) {
 
 func runMain(r *hook.Registry) error {
 	hook.RegisterMainHooks(r)
+	if stateStorageFlag != "" {
+		storage, err := hook.ParseStateStorage(stateStorageFlag)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		r.SetStateStorage(storage)
+	}
 	switch {
 	case runHookFlag != "":
 		if err := hookMain(r, runHookFlag, flag.Args()); err != nil {
@@ -82,10 +91,11 @@ func runMain(r *hook.Registry) error {
 			return errgo.Notef(err, "cannot find executable")
 		}
 		if err := BuildCharm(BuildCharmParams{
-			Registry:   r,
-			CharmDir:   dir,
-			HookBinary: exe,
-			NoCompress: noCompressFlag,
+			Registry:     r,
+			CharmDir:     dir,
+			HookBinary:   exe,
+			NoCompress:   noCompressFlag,
+			StateStorage: stateStorageFlag,
 		}); err != nil {
 			return errgo.Notef(err, "cannot build charm")
 		}
@@ -98,10 +108,11 @@ func runMain(r *hook.Registry) error {
 			return errgo.Notef(err, "cannot find executable")
 		}
 		if err := BuildCharm(BuildCharmParams{
-			Registry:   r,
-			CharmDir:   buildFlag,
-			HookBinary: exe,
-			NoCompress: noCompressFlag,
+			Registry:     r,
+			CharmDir:     buildFlag,
+			HookBinary:   exe,
+			NoCompress:   noCompressFlag,
+			StateStorage: stateStorageFlag,
 		}); err != nil {
 			return errgo.Notef(err, "cannot build charm")
 		}
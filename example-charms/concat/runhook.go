@@ -110,6 +110,10 @@ func (c *concatenator) setContext(ctxt *hook.Context) error {
 }
 
 func (c *concatenator) changed() error {
+	// Always recompute the value rather than relying on
+	// ConfigChanged or RelationDeltas, because the changes
+	// may have been seen first by another hook. The finally
+	// method compares the result with the committed state.
 	var vals []string
 	localVal, err := c.ctxt.GetConfigString("val")
 	if err != nil {
@@ -118,8 +122,8 @@ func (c *concatenator) changed() error {
 	if localVal != "" {
 		vals = append(vals, localVal)
 	}
-	for _, id := range c.ctxt.RelationIds["upstream"] {
-		units := c.ctxt.Relations[id]
+	for _, id := range c.ctxt.RelationIdsFor("upstream") {
+		units := c.ctxt.RelationSettings(id)
 		// Use all the values sorted by the unit they come from, so the charm
 		// output is deterministic.
 		unitIds := make(unitIdSlice, 0, len(units))
@@ -159,7 +163,7 @@ func (c *concatenator) finally() error {
 	if err := c.notifyServer(); err != nil {
 		return errgo.Mask(err)
 	}
-	ids := c.ctxt.RelationIds["downstream"]
+	ids := c.ctxt.RelationIdsFor("downstream")
 	for _, id := range ids {
 		if err := c.setDownstreamVal(id, c.newState.Val); err != nil {
 			return errgo.Notef(err, "cannot set relation %v", id)
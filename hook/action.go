@@ -0,0 +1,107 @@
+package hook
+
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// actionParamsSchema returns the JSON schema for an action with the
+// given name and description that takes the parameters described by
+// params. See Registry.RegisterAction for details.
+func actionParamsSchema(name, description string, params interface{}) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	schema := map[string]interface{}{
+		"title":                name,
+		"description":          description,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if params == nil {
+		return schema, nil
+	}
+	t := reflect.TypeOf(params)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, errgo.Newf("parameters have type %s, not struct", t)
+	}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		paramName, omitEmpty := jsonFieldName(f)
+		if paramName == "" {
+			continue
+		}
+		paramType := jsonSchemaType(f.Type)
+		if paramType == "" {
+			return nil, errgo.Newf("field %s has unsupported type %s", f.Name, f.Type)
+		}
+		prop := map[string]interface{}{
+			"type": paramType,
+		}
+		if desc := f.Tag.Get("description"); desc != "" {
+			prop["description"] = desc
+		}
+		properties[paramName] = prop
+		if !omitEmpty {
+			required = append(required, paramName)
+		}
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema, nil
+}
+
+// jsonFieldName returns the name that the given field will be
+// marshaled to by the encoding/json package, and whether it has the
+// omitempty option. It returns the empty string if the field is
+// ignored.
+func jsonFieldName(f reflect.StructField) (name string, omitEmpty bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty
+}
+
+// jsonSchemaType returns the JSON schema type name corresponding
+// to the given Go type, or the empty string if there is none.
+func jsonSchemaType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return ""
+}
@@ -0,0 +1,687 @@
+package hook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/hooks"
+)
+
+// configStruct holds a configuration struct registered
+// with Registry.RegisterConfigStruct.
+type configStruct struct {
+	// val holds the pointer to the struct.
+	val reflect.Value
+
+	// fields maps from configuration option name
+	// to the index of the corresponding field.
+	fields map[string]int
+}
+
+// RegisterConfigStruct registers a configuration option for each field
+// in the struct pointed to by cfg that has a "config" tag holding the
+// name of the option. Before any hooks run, the struct will be filled
+// in with the current configuration values.
+//
+// The type of each option is derived from the type of the field,
+// which must be a string, bool, integer or floating point type.
+// If a "type" tag is present, it must agree with that.
+// The option's description is taken from the "description"
+// tag, and its default value from the "default" tag, which
+// is parsed according to the option's type.
+//
+// Validation rules (see RegisterConfigRule) may be specified
+// with the "min" and "max" tags for numeric options,
+// and the "enum" (a comma-separated list of allowed values)
+// and "pattern" tags for string options.
+//
+// For example:
+//
+//	type config struct {
+//		Port    int    `config:"port" description:"Port to listen on" default:"8080" min:"1" max:"65535"`
+//		Message string `config:"message" description:"Message to display"`
+//	}
+//
+// As with RegisterConfig, if an option is registered twice with the
+// same name, all of the details must also match.
+func (r *Registry) RegisterConfigStruct(cfg interface{}) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic(errgo.Newf("configuration value is not pointer to struct but type %T", cfg))
+	}
+	opts, fields, rules, err := configStructOptions(v.Elem().Type())
+	if err != nil {
+		panic(errgo.Notef(err, "invalid configuration struct %T", cfg))
+	}
+	for name, opt := range opts {
+		r.RegisterConfig(name, opt)
+	}
+	for name, rules := range rules {
+		r.RegisterConfigRule(name, rules...)
+	}
+	r.configStructs = append(r.configStructs, configStruct{
+		val:    v,
+		fields: fields,
+	})
+}
+
+// configStructOptions returns the configuration options described by
+// the given struct type, the index of the field for each option,
+// and any validation rules for each option.
+func configStructOptions(t reflect.Type) (map[string]charm.Option, map[string]int, map[string][]ConfigRule, error) {
+	opts := make(map[string]charm.Option)
+	fields := make(map[string]int)
+	rules := make(map[string][]ConfigRule)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("config")
+		if name == "" || name == "-" {
+			continue
+		}
+		if f.PkgPath != "" {
+			return nil, nil, nil, errgo.Newf("field %s is not exported", f.Name)
+		}
+		if _, ok := opts[name]; ok {
+			return nil, nil, nil, errgo.Newf("duplicate option name %q", name)
+		}
+		optType := configOptionType(f.Type)
+		if optType == "" {
+			return nil, nil, nil, errgo.Newf("field %s has unsupported type %s", f.Name, f.Type)
+		}
+		if tagType := f.Tag.Get("type"); tagType != "" && tagType != optType {
+			return nil, nil, nil, errgo.Newf("field %s has type %s, incompatible with option type %q", f.Name, f.Type, tagType)
+		}
+		opt := charm.Option{
+			Type:        optType,
+			Description: f.Tag.Get("description"),
+		}
+		if def := f.Tag.Get("default"); def != "" {
+			val, err := parseConfigDefault(optType, def)
+			if err != nil {
+				return nil, nil, nil, errgo.Notef(err, "invalid default value for field %s", f.Name)
+			}
+			opt.Default = val
+		}
+		fieldRules, err := configTagRules(optType, f.Tag)
+		if err != nil {
+			return nil, nil, nil, errgo.Notef(err, "invalid validation rule for field %s", f.Name)
+		}
+		opts[name] = opt
+		fields[name] = i
+		if len(fieldRules) > 0 {
+			rules[name] = fieldRules
+		}
+	}
+	return opts, fields, rules, nil
+}
+
+// configTagRules returns the validation rules specified
+// by the given struct tag for an option of the given type.
+func configTagRules(optType string, tag reflect.StructTag) ([]ConfigRule, error) {
+	var rules []ConfigRule
+	numeric := optType == "int" || optType == "float"
+	for _, key := range []string{"min", "max"} {
+		s := tag.Get(key)
+		if s == "" {
+			continue
+		}
+		if !numeric {
+			return nil, errgo.Newf("%q specified for non-numeric option", key)
+		}
+		val, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid %q value", key)
+		}
+		if key == "min" {
+			rules = append(rules, ConfigMin(val))
+		} else {
+			rules = append(rules, ConfigMax(val))
+		}
+	}
+	if s := tag.Get("enum"); s != "" {
+		if optType != "string" {
+			return nil, errgo.Newf("%q specified for non-string option", "enum")
+		}
+		rules = append(rules, ConfigEnum(strings.Split(s, ",")...))
+	}
+	if s := tag.Get("pattern"); s != "" {
+		if optType != "string" {
+			return nil, errgo.Newf("%q specified for non-string option", "pattern")
+		}
+		if _, err := regexp.Compile(s); err != nil {
+			return nil, errgo.Notef(err, "invalid pattern")
+		}
+		rules = append(rules, ConfigPattern(s))
+	}
+	return rules, nil
+}
+
+// configOptionType returns the configuration option type
+// corresponding to the given Go type, or the empty string
+// if there is none.
+func configOptionType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	}
+	return ""
+}
+
+// parseConfigDefault parses the default value s
+// of an option with the given type.
+func parseConfigDefault(optType, s string) (interface{}, error) {
+	switch optType {
+	case "string":
+		return s, nil
+	case "boolean":
+		return strconv.ParseBool(s)
+	case "int":
+		val, err := strconv.ParseInt(s, 10, 64)
+		return int(val), err
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	}
+	panic("unreachable")
+}
+
+// configValues returns the current charm configuration if
+// any configuration options, structs or rules have been
+// registered with r, or nil otherwise.
+func (ctxt *Context) configValues(r *Registry) (map[string]interface{}, error) {
+	if len(r.config) == 0 && len(r.configStructs) == 0 && len(r.configRules) == 0 {
+		return nil, nil
+	}
+	var config map[string]interface{}
+	if err := ctxt.runJSON(&config, "config-get", "--format", "json"); err != nil {
+		return nil, errgo.Notef(err, "cannot get configuration")
+	}
+	return config, nil
+}
+
+// fillConfigStructs fills all the given configuration
+// structs from the given configuration values.
+func fillConfigStructs(structs []configStruct, config map[string]interface{}) error {
+	for _, s := range structs {
+		for name, index := range s.fields {
+			val, ok := config[name]
+			if !ok || val == nil {
+				continue
+			}
+			data, err := json.Marshal(val)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			field := s.val.Elem().Field(index)
+			if err := json.Unmarshal(data, field.Addr().Interface()); err != nil {
+				return errgo.Notef(err, "cannot unmarshal configuration option %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// configErrorPrefix is the prefix of the status message set when
+// the configuration fails validation. It is used to recognize when
+// the blocked status was set by us.
+const configErrorPrefix = "invalid configuration: "
+
+// ConfigRule represents a validation rule for a configuration option.
+// It is called with the name of the option to check and the current
+// values of all configuration options, and should return an error
+// describing the problem if the option's value is not valid.
+// Unset options have a nil value.
+type ConfigRule func(name string, config map[string]interface{}) error
+
+// RegisterConfigRule registers validation rules for the configuration
+// option with the given name. Before any hook functions run, all the
+// rules are checked. If any fail, the unit's status is set to
+// StatusBlocked with a message describing the problem, and the hook
+// functions registered with r and its clones (but not those registered
+// with other registries) are not run. Functions for hooks that Juju
+// will not run again, or that must always work, are run regardless:
+// install, upgrade-charm, stop, the leadership, storage and
+// collect-metrics hooks, and actions. When the configuration becomes
+// valid again, the status that was in place before the unit was
+// blocked is restored.
+//
+// While any hook functions are being skipped, the configuration and
+// relation changes are not recorded, so that the skipped functions see
+// them when the configuration becomes valid. This means that the
+// functions that do run will see the same changes reported by
+// ConfigChanged, ConfigChanges and RelationDeltas in each hook until
+// then.
+func (r *Registry) RegisterConfigRule(name string, rules ...ConfigRule) {
+	for _, rule := range rules {
+		r.configRules[name] = append(r.configRules[name], configRule{
+			registryName: r.name,
+			check:        rule,
+		})
+	}
+}
+
+// configBlocks reports whether the hook functions registered with the
+// registry with the given name are blocked by the given invalid
+// registries, as returned by checkConfig. Rules registered with a
+// registry also block the functions of its clones.
+func configBlocks(invalid map[string]bool, registryName string) bool {
+	for name := range invalid {
+		if registryName == name || strings.HasPrefix(registryName, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// configRule holds a rule registered with RegisterConfigRule.
+type configRule struct {
+	// registryName holds the name of the registry
+	// that the rule was registered with.
+	registryName string
+	check        ConfigRule
+}
+
+// runsWithInvalidConfig reports whether the functions for
+// the hook with the given name are run even when the
+// configuration is not valid.
+func runsWithInvalidConfig(hookName string) bool {
+	if actionHookPattern.MatchString(hookName) || storageHookPattern.MatchString(hookName) {
+		return true
+	}
+	switch hooks.Kind(hookName) {
+	case hooks.Install,
+		hooks.UpgradeCharm,
+		hooks.Stop,
+		hooks.LeaderElected,
+		hooks.LeaderDeposed,
+		hooks.LeaderSettingsChanged,
+		hooks.CollectMetrics:
+		return true
+	}
+	return false
+}
+
+// ConfigMin returns a rule that checks that a numeric
+// option is not less than min.
+func ConfigMin(min float64) ConfigRule {
+	return func(name string, config map[string]interface{}) error {
+		val, ok, err := configNumber(config[name])
+		if !ok || err != nil {
+			return err
+		}
+		if val < min {
+			return errgo.Newf("%v is less than minimum %v", val, min)
+		}
+		return nil
+	}
+}
+
+// ConfigMax returns a rule that checks that a numeric
+// option is not greater than max.
+func ConfigMax(max float64) ConfigRule {
+	return func(name string, config map[string]interface{}) error {
+		val, ok, err := configNumber(config[name])
+		if !ok || err != nil {
+			return err
+		}
+		if val > max {
+			return errgo.Newf("%v is greater than maximum %v", val, max)
+		}
+		return nil
+	}
+}
+
+// ConfigEnum returns a rule that checks that a string
+// option holds one of the given values. An empty value is
+// always allowed.
+func ConfigEnum(vals ...string) ConfigRule {
+	return func(name string, config map[string]interface{}) error {
+		val, ok, err := configString(config[name])
+		if !ok || err != nil {
+			return err
+		}
+		for _, allowed := range vals {
+			if val == allowed {
+				return nil
+			}
+		}
+		return errgo.Newf("%q is not one of %q", val, vals)
+	}
+}
+
+// ConfigPattern returns a rule that checks that a string option
+// matches the given regular expression, which is anchored at both
+// ends. An empty value is always allowed. It panics if the
+// pattern is not a valid regular expression.
+func ConfigPattern(pattern string) ConfigRule {
+	re := regexp.MustCompile("^(?:" + pattern + ")$")
+	return func(name string, config map[string]interface{}) error {
+		val, ok, err := configString(config[name])
+		if !ok || err != nil {
+			return err
+		}
+		if !re.MatchString(val) {
+			return errgo.Newf("%q does not match pattern %q", val, pattern)
+		}
+		return nil
+	}
+}
+
+// ConfigRequiredIf returns a rule that checks that an
+// option is set whenever the other option is set.
+func ConfigRequiredIf(other string) ConfigRule {
+	return func(name string, config map[string]interface{}) error {
+		if configIsSet(config[other]) && !configIsSet(config[name]) {
+			return errgo.Newf("must be set when %q is set", other)
+		}
+		return nil
+	}
+}
+
+// configIsSet reports whether the given
+// configuration value has been set.
+func configIsSet(val interface{}) bool {
+	return val != nil && val != ""
+}
+
+// configNumber returns the numeric value of the given
+// configuration value. It reports whether the value is set.
+func configNumber(val interface{}) (float64, bool, error) {
+	if val == nil {
+		return 0, false, nil
+	}
+	switch val := val.(type) {
+	case float64:
+		return val, true, nil
+	case int:
+		return float64(val), true, nil
+	}
+	return 0, false, errgo.Newf("%v is not a number", val)
+}
+
+// configString returns the string value of the given
+// configuration value. It reports whether the value is
+// set to a non-empty string.
+func configString(val interface{}) (string, bool, error) {
+	if val == nil {
+		return "", false, nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return "", false, errgo.Newf("%v is not a string", val)
+	}
+	return s, s != "", nil
+}
+
+// statusStateName holds the name under which the unit's status
+// is stored in the persistent state when it is replaced by
+// a blocked status because of invalid configuration.
+const statusStateName = "_status"
+
+// checkConfig checks the given configuration values against the rules
+// registered with r, and sets the unit's status accordingly. It returns
+// the names of the registries that registered rules that failed,
+// which is empty if the configuration is valid.
+func (ctxt *Context) checkConfig(r *Registry, state PersistentState, config map[string]interface{}) (map[string]bool, error) {
+	if len(r.configRules) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(r.configRules))
+	for name := range r.configRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	invalid := make(map[string]bool)
+	for _, name := range names {
+		var problem string
+		for _, rule := range r.configRules[name] {
+			if err := rule.check(name, config); err != nil {
+				if problem == "" {
+					problem = fmt.Sprintf("option %q: %v", name, err)
+				}
+				invalid[rule.registryName] = true
+			}
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		msg := configErrorPrefix + strings.Join(problems, "; ")
+		ctxt.Logf("%s", msg)
+		if err := ctxt.saveStatus(state); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if err := ctxt.SetStatus(StatusBlocked, msg); err != nil {
+			return nil, errgo.Notef(err, "cannot set blocked status")
+		}
+		return invalid, nil
+	}
+	// The configuration is valid; clear any blocked
+	// status that we set earlier.
+	if err := ctxt.restoreStatus(state); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return nil, nil
+}
+
+// settableStatus holds the statuses that can be set with SetStatus.
+var settableStatus = map[Status]bool{
+	StatusMaintenance: true,
+	StatusBlocked:     true,
+	StatusWaiting:     true,
+	StatusActive:      true,
+}
+
+// isConfigBlocked reports whether the given status
+// was set by checkConfig.
+func isConfigBlocked(st *StatusInfo) bool {
+	return st.Status == StatusBlocked && strings.HasPrefix(st.Message, configErrorPrefix)
+}
+
+// loadSavedStatus returns the status saved by saveStatus,
+// or nil if there is none.
+func loadSavedStatus(state PersistentState) (*StatusInfo, error) {
+	data, err := state.Load(statusStateName)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot load saved status")
+	}
+	var st *StatusInfo
+	if data != nil {
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal saved status")
+		}
+	}
+	return st, nil
+}
+
+// saveStatus saves the unit's current status so that it can be
+// restored by restoreStatus. If a status has already been saved,
+// the unit is already blocked because of invalid configuration,
+// so the saved status is kept.
+func (ctxt *Context) saveStatus(state PersistentState) error {
+	saved, err := loadSavedStatus(state)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if saved != nil {
+		return nil
+	}
+	st, err := ctxt.StatusGet()
+	if err != nil {
+		ctxt.Logf("cannot get status: %v", err)
+		st = &StatusInfo{}
+	}
+	if isConfigBlocked(st) {
+		// We do not know what the status was before.
+		st = &StatusInfo{}
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal status")
+	}
+	if err := state.Save(statusStateName, data); err != nil {
+		return errgo.Notef(err, "cannot save status")
+	}
+	return nil
+}
+
+// restoreStatus restores the status saved by saveStatus, if any,
+// unless the charm has set another status since it was saved.
+// If the saved status cannot be set by a charm (for example
+// "unknown"), the status is set to StatusActive.
+func (ctxt *Context) restoreStatus(state PersistentState) error {
+	saved, err := loadSavedStatus(state)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if saved == nil {
+		return nil
+	}
+	current, err := ctxt.StatusGet()
+	if err != nil {
+		ctxt.Logf("cannot get status: %v", err)
+		return nil
+	}
+	if isConfigBlocked(current) {
+		if !settableStatus[saved.Status] {
+			saved = &StatusInfo{
+				Status: StatusActive,
+			}
+		}
+		if err := ctxt.SetStatus(saved.Status, saved.Message); err != nil {
+			return errgo.Notef(err, "cannot restore status")
+		}
+	}
+	if err := state.Save(statusStateName, []byte("null")); err != nil {
+		return errgo.Notef(err, "cannot save status")
+	}
+	return nil
+}
+
+// configStateName holds the name under which the last-seen
+// configuration is stored in the persistent state. It cannot
+// clash with any registry name because those always start
+// with "root".
+const configStateName = "_config"
+
+// ConfigChange holds the value of a configuration option
+// before and after a change. Old is nil if the option
+// had not been seen before; New is nil if the option
+// has been removed.
+type ConfigChange struct {
+	Old interface{}
+	New interface{}
+}
+
+// ConfigChanged reports whether any of the given configuration
+// options have changed since the last time that a hook completed
+// successfully. If no options are given, it reports whether any
+// option has changed.
+//
+// The changes are seen by whichever hook runs next, which is not
+// necessarily config-changed, so code that only runs in some hooks
+// should not rely on ConfigChanged to notice every change.
+//
+// Configuration changes are only tracked when the charm
+// has registered configuration options. If it has not,
+// ConfigChanged always returns true.
+func (ctxt *Context) ConfigChanged(names ...string) bool {
+	if ctxt.configChanges == nil {
+		return true
+	}
+	if len(names) == 0 {
+		return len(ctxt.configChanges) > 0
+	}
+	for _, name := range names {
+		if _, ok := ctxt.configChanges[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigChanges returns all the configuration options that
+// have changed since the last time that a hook completed
+// successfully, keyed by option name. When no hook has
+// previously completed, all options are reported as changed.
+//
+// It returns nil if configuration changes are not being
+// tracked (see ConfigChanged).
+func (ctxt *Context) ConfigChanges() map[string]ConfigChange {
+	if ctxt.configChanges == nil {
+		return nil
+	}
+	changes := make(map[string]ConfigChange)
+	for name, change := range ctxt.configChanges {
+		changes[name] = change
+	}
+	return changes
+}
+
+// loadConfigChanges compares the given configuration values against
+// the configuration snapshot saved in state and records the
+// differences in ctxt.
+func (ctxt *Context) loadConfigChanges(r *Registry, state PersistentState, config map[string]interface{}) error {
+	if len(r.config) == 0 {
+		return nil
+	}
+	data, err := state.Load(configStateName)
+	if err != nil {
+		return errgo.Notef(err, "cannot load configuration snapshot")
+	}
+	var old map[string]interface{}
+	if data != nil {
+		if err := json.Unmarshal(data, &old); err != nil {
+			return errgo.Notef(err, "cannot unmarshal configuration snapshot")
+		}
+	}
+	changes := make(map[string]ConfigChange)
+	for name, val := range config {
+		oldVal, ok := old[name]
+		if !ok || !reflect.DeepEqual(oldVal, val) {
+			changes[name] = ConfigChange{
+				Old: oldVal,
+				New: val,
+			}
+		}
+	}
+	for name, oldVal := range old {
+		if _, ok := config[name]; !ok {
+			changes[name] = ConfigChange{
+				Old: oldVal,
+			}
+		}
+	}
+	ctxt.configChanges = changes
+	return nil
+}
+
+// saveConfigSnapshot saves the given configuration values
+// so that the next hook can find out what has changed.
+func saveConfigSnapshot(r *Registry, state PersistentState, config map[string]interface{}) error {
+	if len(r.config) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal configuration snapshot")
+	}
+	if err := state.Save(configStateName, data); err != nil {
+		return errgo.Notef(err, "cannot save configuration snapshot")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ var (
 	CtxtGetAllRelationUnit = (*Context).getAllRelationUnit
 	CtxtRelationUnits      = (*Context).relationUnits
 	CtxtRelationIds        = (*Context).relationIds
+	NewCachingToolRunner   = newCachingToolRunner
 	ValidHookName          = validHookName
 	ExecHookTools          = &execHookTools
 	JujucSymlinks          = &jujucSymlinks
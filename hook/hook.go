@@ -38,6 +38,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/juju/names"
@@ -49,9 +51,22 @@ import (
 // juju add-relation command.
 type RelationId string
 
+// StorageId is the type of the id of a storage instance,
+// for example "data/0".
+type StorageId string
+
 // UnitId is the type of the id of a unit.
 type UnitId string
 
+// Application returns the name of the application
+// that the unit belongs to.
+func (id UnitId) Application() string {
+	if i := strings.Index(string(id), "/"); i >= 0 {
+		return string(id[0:i])
+	}
+	return string(id)
+}
+
 // Tag returns the juju "tag" name of the unit.
 func (id UnitId) Tag() names.UnitTag {
 	return names.NewUnitTag(string(id))
@@ -64,6 +79,26 @@ type Context struct {
 	// the context is associated with.
 	registryName string
 
+	// configChanges holds the configuration options that
+	// have changed since the last successful hook.
+	// It is nil if configuration changes are not tracked.
+	configChanges map[string]ConfigChange
+
+	// relationSnapshot holds the relation data as it was
+	// at the end of the last successful hook.
+	// It is nil if relation changes are not tracked.
+	relationSnapshot map[RelationId]map[UnitId]map[string]string
+
+	// published holds the relation settings most recently
+	// published by the local unit. It is nil if they
+	// are not tracked.
+	published *publishedSettings
+
+	// relations is used to load relation data on demand.
+	// It is nil if the relation fields have been
+	// filled in directly.
+	relations *relationLoader
+
 	// Fields valid for all hooks
 
 	// UUID holds the globally unique environment id.
@@ -87,13 +122,28 @@ type Context struct {
 	// each of those units.
 	//
 	// This does not include settings for the charm unit itself.
+	//
+	// When the context has been created by NewContextFromEnvironment
+	// for a charm that has called Registry.SetLazyRelations,
+	// relation data is loaded on demand, so this holds only
+	// the data that has been loaded so far. Use the RelationSettings
+	// method or call LoadRelations before reading it.
 	Relations map[RelationId]map[UnitId]map[string]string
 
+	// AppRelations holds the application-level relation settings
+	// of the remote application for each relation id. These
+	// settings can only be set by the leader of that application.
+	// Like Relations, it may be loaded on demand; see
+	// the AppRelationSettings method.
+	AppRelations map[RelationId]map[string]string
+
 	// RelationIds holds the relation ids for each relation declared
 	// in the charm. For example, if the charm has a relation named
 	// "webserver" in its metadata.yaml, the current ids for that
 	// relation (i.e. all the relations have have been made by the
 	// user) will be in RelationIds["webserver"].
+	// Like Relations, it may be loaded on demand; see
+	// the RelationIdsFor method.
 	RelationIds map[string][]RelationId
 
 	// Fields valid for relation-related hooks only.
@@ -112,7 +162,16 @@ type Context struct {
 	// for a relation-broken hook.
 	RemoteUnit UnitId
 
+	// Fields valid for storage-related hooks only.
+
+	// StorageId holds the id of the storage instance that
+	// the current storage hook is running for.
+	StorageId StorageId
+
 	// Runner is used to run hook tools by methods on the context.
+	// When the context has been created by NewContextFromEnvironment,
+	// the results of read-only hook tools are cached for the
+	// duration of the hook.
 	Runner ToolRunner
 
 	// RunCommandName holds the name of the command, when
@@ -134,7 +193,7 @@ func (ctxt *Context) Relation() map[string]string {
 	if ctxt.RemoteUnit == "" || ctxt.RelationId == "" {
 		panic(fmt.Errorf("Relation called in non-relation hook %s", ctxt.HookName))
 	}
-	return ctxt.Relations[ctxt.RelationId][ctxt.RemoteUnit]
+	return ctxt.RelationSettings(ctxt.RelationId)[ctxt.RemoteUnit]
 }
 
 // Close closes ctxt.Runner, if it is not nil.
@@ -235,6 +294,17 @@ func (ctxt *Context) getAllRelationUnit(relationId RelationId, unit UnitId) (map
 	return val, nil
 }
 
+// getAllRelationApp returns all the application-level settings
+// from the given application associated with the relation with
+// the given id.
+func (ctxt *Context) getAllRelationApp(relationId RelationId, app string) (map[string]string, error) {
+	var val map[string]string
+	if err := ctxt.runJSON(&val, "relation-get", "-r", string(relationId), "--format", "json", "--app", "--", "-", app); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return val, nil
+}
+
 // relationIds returns all the relation ids associated
 // with the relation with the given name.
 func (ctxt *Context) relationIds(relationName string) ([]RelationId, error) {
@@ -255,27 +325,61 @@ func (ctxt *Context) relationUnits(relationId RelationId) ([]UnitId, error) {
 }
 
 // SetRelation sets the given key-value pairs on the current relation instance.
+// See SetRelationWithId for details.
 func (ctxt *Context) SetRelation(keyvals ...string) error {
 	err := ctxt.SetRelationWithId(ctxt.RelationId, keyvals...)
 	return errgo.Mask(err)
 }
 
 // SetRelationWithId sets the given key-value pairs
-// on the relation with the given id.
+// on the relation with the given id. Setting a key
+// to the empty string removes it.
+//
+// Pairs whose values have not changed since they were last
+// published by the local unit are not written, so that
+// other units do not see spurious relation-changed hooks.
 func (ctxt *Context) SetRelationWithId(relationId RelationId, keyvals ...string) error {
-	if len(keyvals)%2 != 0 {
-		return errgo.Newf("invalid key/value count")
+	err := ctxt.setRelation(relationId, false, keyvals)
+	return errgo.Mask(err)
+}
+
+// ErrNotLeader is returned when an operation that
+// requires leadership is attempted by a unit that is
+// not the leader.
+var ErrNotLeader = errgo.New("unit is not the leader")
+
+// SetAppRelation sets the given key-value pairs in the application-level
+// settings of the current relation instance. It returns an error
+// with an ErrNotLeader cause if the current unit is not the leader.
+func (ctxt *Context) SetAppRelation(keyvals ...string) error {
+	err := ctxt.SetAppRelationWithId(ctxt.RelationId, keyvals...)
+	return errgo.Mask(err, errgo.Is(ErrNotLeader))
+}
+
+// SetAppRelationWithId sets the given key-value pairs in the
+// application-level settings of the relation with the given id.
+// It returns an error with an ErrNotLeader cause if the current
+// unit is not the leader.
+func (ctxt *Context) SetAppRelationWithId(relationId RelationId, keyvals ...string) error {
+	if err := ctxt.checkLeader(relationId); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotLeader))
 	}
-	if len(keyvals) == 0 {
-		return nil
+	err := ctxt.setRelation(relationId, true, keyvals)
+	return errgo.Mask(err)
+}
+
+// checkLeader returns an error with an ErrNotLeader cause
+// if the current unit cannot set the application settings
+// of the relation with the given id.
+func (ctxt *Context) checkLeader(relationId RelationId) error {
+	isLeader, err := ctxt.IsLeader()
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	args := make([]string, 0, 3+len(keyvals)/2)
-	args = append(args, "-r", string(relationId), "--")
-	for i := 0; i < len(keyvals); i += 2 {
-		args = append(args, fmt.Sprintf("%s=%s", keyvals[i], keyvals[i+1]))
+	if !isLeader {
+		return errgo.WithCausef(nil, ErrNotLeader, "cannot set application settings on relation %s", relationId)
 	}
-	_, err := ctxt.Runner.Run("relation-set", args...)
-	return errgo.Mask(err)
+	return nil
 }
 
 // GetConfig reads the charm configuration value for the given
@@ -284,8 +388,21 @@ func (ctxt *Context) SetRelationWithId(relationId RelationId, keyvals ...string)
 // types (string, int, float64 or boolean).
 // To find out whether a value has actually been set (is non-null)
 // pass a pointer to a pointer to the desired type.
+//
+// All the configuration values are fetched at once, so
+// getting several options in the same hook costs no more
+// than getting one.
 func (ctxt *Context) GetConfig(key string, val interface{}) error {
-	if err := ctxt.runJSON(val, "config-get", "--format", "json", "--", key); err != nil {
+	var config map[string]json.RawMessage
+	if err := ctxt.runJSON(&config, "config-get", "--format", "json"); err != nil {
+		return errgo.Notef(err, "cannot get configuration option %q", key)
+	}
+	data, ok := config[key]
+	if !ok {
+		// The option has no value.
+		return nil
+	}
+	if err := json.Unmarshal(data, val); err != nil {
 		return errgo.Notef(err, "cannot get configuration option %q", key)
 	}
 	return nil
@@ -369,6 +486,203 @@ func (ctxt *Context) SetStatus(st Status, message string) error {
 	return errgo.Mask(err)
 }
 
+// SetApplicationStatus sets the status of the charm's application
+// as a whole and an associated message. Only the leader may set the
+// application status; it returns an error with an ErrNotLeader
+// cause if the current unit is not the leader. As with SetStatus,
+// if the version of juju does not support it, the error will be
+// silently discarded.
+func (ctxt *Context) SetApplicationStatus(st Status, message string) error {
+	isLeader, err := ctxt.IsLeader()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !isLeader {
+		return errgo.WithCausef(nil, ErrNotLeader, "cannot set application status")
+	}
+	_, err = ctxt.Runner.Run("status-set", "--application", string(st), message)
+	if errgo.Cause(err) == ErrUnimplemented {
+		return nil
+	}
+	return errgo.Mask(err)
+}
+
+// StatusInfo holds status information as returned by StatusGet.
+type StatusInfo struct {
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+}
+
+// StatusGet returns the current status of the unit,
+// as set by SetStatus.
+func (ctxt *Context) StatusGet() (*StatusInfo, error) {
+	var info StatusInfo
+	if err := ctxt.runJSON(&info, "status-get", "--format", "json", "--include-data"); err != nil {
+		return nil, errgo.Notef(err, "cannot get status")
+	}
+	return &info, nil
+}
+
+// SetWorkloadVersion sets the version of the workload that
+// the charm is running, for display to the user. If the version
+// of juju does not support it, the error will be silently discarded.
+func (ctxt *Context) SetWorkloadVersion(version string) error {
+	_, err := ctxt.Runner.Run("application-version-set", version)
+	if errgo.Cause(err) == ErrUnimplemented {
+		return nil
+	}
+	return errgo.Mask(err)
+}
+
+// StorageInstance holds information about an attached
+// storage instance.
+type StorageInstance struct {
+	// Kind holds the kind of the storage
+	// ("block" or "filesystem").
+	Kind string `json:"kind"`
+
+	// Location holds the location of the storage.
+	// For filesystem storage, this is the mount point;
+	// for block storage, it is the block device path.
+	Location string `json:"location"`
+}
+
+// StorageGet returns information about the storage instance
+// with the given id.
+func (ctxt *Context) StorageGet(id StorageId) (*StorageInstance, error) {
+	var st StorageInstance
+	if err := ctxt.runJSON(&st, "storage-get", "--format", "json", "-s", string(id)); err != nil {
+		return nil, errgo.Notef(err, "cannot get storage %q", id)
+	}
+	return &st, nil
+}
+
+// StorageList returns the ids of all storage instances attached to the
+// unit with the given storage name, as registered with
+// Registry.RegisterStorage. If name is empty, the ids of all attached
+// storage instances are returned.
+func (ctxt *Context) StorageList(name string) ([]StorageId, error) {
+	args := []string{"--format", "json"}
+	if name != "" {
+		args = append(args, name)
+	}
+	var ids []StorageId
+	if err := ctxt.runJSON(&ids, "storage-list", args...); err != nil {
+		return nil, errgo.Notef(err, "cannot list storage")
+	}
+	return ids, nil
+}
+
+// StorageAdd requests that count more storage instances
+// with the given storage name be added to the unit.
+func (ctxt *Context) StorageAdd(name string, count int) error {
+	_, err := ctxt.Runner.Run("storage-add", fmt.Sprintf("%s=%d", name, count))
+	return errgo.Mask(err)
+}
+
+// ResourceGet fetches the resource with the given name,
+// as registered with Registry.RegisterResource, and returns
+// the path of the local file holding it.
+func (ctxt *Context) ResourceGet(name string) (string, error) {
+	out, err := ctxt.Runner.Run("resource-get", name)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot get resource %q", name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// AddMetric records a value for the metric with the given name, as
+// registered with Registry.RegisterMetric. It may only be called from
+// the collect-metrics hook.
+func (ctxt *Context) AddMetric(name string, value float64) error {
+	_, err := ctxt.Runner.Run("add-metric", "--", name+"="+strconv.FormatFloat(value, 'f', -1, 64))
+	return errgo.Mask(err)
+}
+
+// ActionParams unmarshals the parameters of the currently running
+// action into the value pointed to by val, which will usually be a
+// pointer to a value of the type passed as the params argument to
+// Registry.RegisterAction.
+func (ctxt *Context) ActionParams(val interface{}) error {
+	if err := ctxt.runJSON(val, "action-get", "--format", "json"); err != nil {
+		return errgo.Notef(err, "cannot get action parameters")
+	}
+	return nil
+}
+
+// ActionSet sets the given key-value pairs as results of the currently
+// running action. Keys may contain dots to create nested results.
+func (ctxt *Context) ActionSet(results map[string]string) error {
+	if len(results) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(results)+1)
+	args = append(args, "--")
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("%s=%s", key, results[key]))
+	}
+	_, err := ctxt.Runner.Run("action-set", args...)
+	return errgo.Mask(err)
+}
+
+// ActionFail marks the currently running action as failed
+// with the given message. Note that the action hook function
+// should still return nil, otherwise the failure will be
+// treated as an error in the charm.
+func (ctxt *Context) ActionFail(message string) error {
+	_, err := ctxt.Runner.Run("action-fail", "--", message)
+	return errgo.Mask(err)
+}
+
+// IsLeader reports whether the current unit is the leader
+// of its service.
+func (ctxt *Context) IsLeader() (bool, error) {
+	var isLeader bool
+	if err := ctxt.runJSON(&isLeader, "is-leader", "--format", "json"); err != nil {
+		return false, errgo.Notef(err, "cannot determine leadership")
+	}
+	return isLeader, nil
+}
+
+// LeaderGet returns the value of the leadership setting with the given
+// key. It returns the empty string if the setting has not been set.
+func (ctxt *Context) LeaderGet(key string) (string, error) {
+	var val string
+	if err := ctxt.runJSON(&val, "leader-get", "--format", "json", "--", key); err != nil {
+		return "", errgo.Notef(err, "cannot get leadership setting %q", key)
+	}
+	return val, nil
+}
+
+// LeaderSet sets the given leadership settings, which will be
+// visible to all units of the service through LeaderGet.
+// Setting a key to the empty string removes it.
+// It returns an error if the current unit is not the leader.
+func (ctxt *Context) LeaderSet(settings map[string]string) error {
+	if len(settings) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(settings)+1)
+	args = append(args, "--")
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("%s=%s", key, settings[key]))
+	}
+	if _, err := ctxt.Runner.Run("leader-set", args...); err != nil {
+		return errgo.Notef(err, "cannot set leadership settings")
+	}
+	return nil
+}
+
 func (ctxt *Context) runJSON(dst interface{}, cmd string, args ...string) error {
 	out, err := ctxt.Runner.Run(cmd, args...)
 	if err != nil {
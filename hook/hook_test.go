@@ -1,9 +1,15 @@
 package hook_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/juju/cmd"
 	"github.com/juju/juju/worker/uniter/runner/jujuc"
@@ -11,8 +17,10 @@ import (
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 
 	"github.com/juju/gocharm/hook"
+	"github.com/juju/gocharm/hook/hooktest"
 )
 
 type HookSuite struct {
@@ -152,6 +160,76 @@ func (s *HookSuite) TestSimple(c *gc.C) {
 	})
 }
 
+func (s *HookSuite) TestStatusGet(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	err := ctxt.SetStatus(hook.StatusMaintenance, "hello, world")
+	c.Assert(err, gc.IsNil)
+
+	st, err := ctxt.StatusGet()
+	c.Assert(err, gc.IsNil)
+	c.Assert(st, jc.DeepEquals, &hook.StatusInfo{
+		Status:  hook.StatusMaintenance,
+		Message: "hello, world",
+	})
+}
+
+func (s *HookSuite) TestSetApplicationStatus(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	ctxt := &hook.Context{
+		Runner: runner,
+	}
+	err := ctxt.SetApplicationStatus(hook.StatusActive, "ready")
+	c.Assert(err, gc.ErrorMatches, `cannot set application status`)
+	c.Assert(errgo.Cause(err), gc.Equals, hook.ErrNotLeader)
+	c.Assert(runner.ApplicationStatus, jc.DeepEquals, hook.StatusInfo{})
+
+	runner.IsLeader = true
+	err = ctxt.SetApplicationStatus(hook.StatusActive, "ready")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.ApplicationStatus, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusActive,
+		Message: "ready",
+	})
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "--application", "active", "ready"},
+	})
+}
+
+func (s *HookSuite) TestHooktestStatus(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	ctxt := &hook.Context{
+		Runner: runner,
+	}
+	err := ctxt.SetStatus(hook.StatusWaiting, "waiting for database")
+	c.Assert(err, gc.IsNil)
+	st, err := ctxt.StatusGet()
+	c.Assert(err, gc.IsNil)
+	c.Assert(st, jc.DeepEquals, &hook.StatusInfo{
+		Status:  hook.StatusWaiting,
+		Message: "waiting for database",
+	})
+	c.Assert(runner.Status, jc.DeepEquals, *st)
+
+	err = ctxt.SetWorkloadVersion("1.2.3")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.WorkloadVersion, gc.Equals, "1.2.3")
+
+	// The calls are still recorded.
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "waiting", "waiting for database"},
+		{"status-get", "--format", "json", "--include-data"},
+		{"application-version-set", "1.2.3"},
+	})
+}
+
 // TODO(rog) test methods that make changes!
 // TestOpenPort
 // TestClosePort
@@ -203,363 +281,2114 @@ func (s *HookSuite) TestLocalState(c *gc.C) {
 	})
 }
 
-func (s *HookSuite) TestContextGetter(c *gc.C) {
-	// TODO
-}
+func (s *HookSuite) TestDiskState(c *gc.C) {
+	dir := c.MkDir()
+	state := hook.NewDiskState(dir)
+	data, err := state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.IsNil)
 
-func (s *HookSuite) TestRelationValuesFromRelationHook(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
-	c.Assert(ctxt.RelationIds, jc.DeepEquals, allRelationIds)
-	c.Assert(ctxt.Relations, jc.DeepEquals, allRelationValues)
-}
+	err = state.Save("root", []byte(`{"a":1}`))
+	c.Assert(err, gc.IsNil)
+	data, err = state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
 
-func (s *HookSuite) TestRelationValuesFromNonRelationHook(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "config-changed")
-	defer ctxt.Close()
-	c.Assert(ctxt.RelationIds, jc.DeepEquals, allRelationIds)
-	c.Assert(ctxt.Relations, jc.DeepEquals, allRelationValues)
+	// No temporary files are left behind.
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Name(), gc.Equals, "root.json")
+
+	err = ioutil.WriteFile(filepath.Join(dir, "root.json"), []byte(`{"a":`), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = state.Load("root")
+	c.Assert(err, gc.ErrorMatches, `state file ".*/root.json" is corrupt`)
 }
 
-func (s *HookSuite) TestGetAllRelationUnit(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+func (s *HookSuite) TestSingleFileState(c *gc.C) {
+	dir := c.MkDir()
 
-	val, err := hook.CtxtGetAllRelationUnit(ctxt, "peer1:1", "peer1/1")
+	// State saved in separate files is read when
+	// there is no single state file.
+	err := hook.NewDiskState(dir).Save("root.old", []byte(`"old"`))
 	c.Assert(err, gc.IsNil)
-	c.Assert(val, gc.DeepEquals, map[string]string{"private-address": "peer1-1.example.com"})
-}
+	state := hook.NewSingleFileState(dir)
+	data, err := state.Load("root.old")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"old"`)
 
-func (s *HookSuite) TestRelationIds(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+	err = state.SaveAll(map[string][]byte{
+		"root":   []byte(`{"a":1}`),
+		"_other": []byte(`[1,2]`),
+	})
+	c.Assert(err, gc.IsNil)
+	err = state.Save("root", []byte(`{"a":2}`))
+	c.Assert(err, gc.IsNil)
 
-	val, err := hook.CtxtRelationIds(ctxt, "peer0")
+	state = hook.NewSingleFileState(dir)
+	data, err = state.Load("root")
 	c.Assert(err, gc.IsNil)
-	c.Assert(val, gc.DeepEquals, []hook.RelationId{"peer0:0"})
-}
+	c.Assert(string(data), gc.Equals, `{"a":2}`)
+	data, err = state.Load("_other")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `[1,2]`)
+	// The state saved in separate files
+	// is carried over to the single file.
+	data, err = state.Load("root.old")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"old"`)
+	err = os.Remove(filepath.Join(dir, "root.old.json"))
+	c.Assert(err, gc.IsNil)
+	data, err = hook.NewSingleFileState(dir).Load("root.old")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"old"`)
 
-func (s *HookSuite) TestRelationUnits(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+	err = state.Save("root", []byte(`not json`))
+	c.Assert(err, gc.ErrorMatches, `cannot save state "root": data is not valid JSON`)
 
-	val, err := hook.CtxtRelationUnits(ctxt, "peer1:1")
+	err = ioutil.WriteFile(filepath.Join(dir, "state.json"), []byte(`{"root":`), 0600)
 	c.Assert(err, gc.IsNil)
-	c.Assert(val, gc.DeepEquals, []hook.UnitId{"peer1/0", "peer1/1"})
+	_, err = hook.NewSingleFileState(dir).Load("root")
+	c.Assert(err, gc.ErrorMatches, `state file ".*/state.json" is corrupt: .*`)
 }
 
-func (s *HookSuite) TestGetFloatConfig(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+func (s *HookSuite) TestUnitState(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	state := hook.NewUnitState(&hook.Context{
+		Runner: runner,
+	})
+	data, err := state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.IsNil)
 
-	var valInterface interface{}
-	err := ctxt.GetConfig("spline-reticulation", &valInterface)
+	err = state.SaveAll(map[string][]byte{
+		"root":     []byte(`{"a":1}`),
+		"root.sub": []byte(`"x=y"`),
+	})
 	c.Assert(err, gc.IsNil)
-	c.Assert(valInterface, gc.Equals, 45.0)
+	c.Assert(runner.UnitState, jc.DeepEquals, map[string]string{
+		"root":     `{"a":1}`,
+		"root.sub": `"x=y"`,
+	})
+	data, err = state.Load("root.sub")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"x=y"`)
 
-	valFloat64, err := ctxt.GetConfigFloat64("spline-reticulation")
+	// Saving empty data deletes the item.
+	err = state.Save("root.sub", nil)
 	c.Assert(err, gc.IsNil)
-	c.Assert(valFloat64, gc.Equals, 45.0)
+	c.Assert(runner.UnitState, jc.DeepEquals, map[string]string{
+		"root": `{"a":1}`,
+	})
+}
 
-	valInt, err := ctxt.GetConfigInt("spline-reticulation")
+func (s *HookSuite) TestLeaderState(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	state := hook.NewLeaderState(&hook.Context{
+		Runner: runner,
+	})
+	data, err := state.Load("root")
 	c.Assert(err, gc.IsNil)
-	c.Assert(valInt, gc.Equals, 45)
+	c.Assert(data, gc.IsNil)
 
-	valBool, err := ctxt.GetConfigBool("spline-reticulation")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("spline-reticulation", "bool"))
-	c.Assert(valBool, gc.Equals, false)
+	// Unchanged state can be saved by any unit, and
+	// reserved state is always saved as unit state.
+	err = state.SaveAll(map[string][]byte{
+		"root":   nil,
+		"_other": []byte(`[1]`),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, gc.HasLen, 0)
+	c.Assert(runner.UnitState, jc.DeepEquals, map[string]string{
+		"_other": `[1]`,
+	})
 
-	valString, err := ctxt.GetConfigString("spline-reticulation")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("spline-reticulation", "string"))
-	c.Assert(valString, gc.Equals, "")
-}
+	// Changed state can only be saved by the leader;
+	// other units discard their changes.
+	err = state.Save("root", []byte(`{"a":1}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, gc.HasLen, 0)
+	data, err = state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.IsNil)
 
-func badConfigTypeErrorPat(key, type_ string) string {
-	return fmt.Sprintf(`cannot get configuration option %q: cannot parse command output ".*": json: cannot unmarshal .* into Go value of type %s`, key, type_)
+	runner.IsLeader = true
+	err = state.Save("root", []byte(`{"a":1}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, jc.DeepEquals, map[string]string{
+		"gocharm-state.root": `{"a":1}`,
+	})
+
+	// Other units see the saved state.
+	state = hook.NewLeaderState(&hook.Context{
+		Runner: runner,
+	})
+	data, err = state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
+	data, err = state.Load("_other")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `[1]`)
 }
 
-func (s *HookSuite) TestGetStringConfig(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+func (s *HookSuite) TestMainWithLeaderState(c *gc.C) {
+	var appState struct {
+		N int
+	}
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(*hook.Context) error {
+				return nil
+			}, &appState)
+			r.RegisterHook("leader-elected", func() error {
+				appState.N++
+				return nil
+			})
+			r.RegisterHook("config-changed", func() error {
+				return nil
+			})
+		},
+		HookStateDir: c.MkDir(),
+		IsLeader:     true,
+		Logger:       c,
+	}
+	runner.State = hook.NewLeaderState(&hook.Context{
+		Runner: runner,
+	})
+	err := runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, jc.DeepEquals, map[string]string{
+		"gocharm-state.root": `{"N":1}`,
+	})
 
-	var valInterface interface{}
-	err := ctxt.GetConfig("title", &valInterface)
+	// A unit that is not the leader sees the state saved
+	// by the leader.
+	runner.IsLeader = false
+	appState.N = 0
+	runner.State = hook.NewLeaderState(&hook.Context{
+		Runner: runner,
+	})
+	err = runner.RunHook("config-changed", "", "")
 	c.Assert(err, gc.IsNil)
-	c.Assert(valInterface, gc.Equals, "My Title")
+	c.Assert(appState.N, gc.Equals, 1)
 
-	valFloat64, err := ctxt.GetConfigFloat64("title")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("title", "float64"))
-	c.Assert(valFloat64, gc.Equals, 0.0)
+	// Its changes to the state are not saved, but
+	// the hook does not fail.
+	err = runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, jc.DeepEquals, map[string]string{
+		"gocharm-state.root": `{"N":1}`,
+	})
+}
 
-	valInt, err := ctxt.GetConfigInt("title")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("title", "int"))
-	c.Assert(valInt, gc.Equals, 0)
+func (s *HookSuite) TestMainWithLeaderStateBeforeLeaderSaved(c *gc.C) {
+	var appState struct {
+		N int
+	}
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(*hook.Context) error {
+				return nil
+			}, &appState)
+			r.RegisterHook("install", func() error {
+				return nil
+			})
+		},
+		HookStateDir: c.MkDir(),
+		Logger:       c,
+	}
+	runner.State = hook.NewLeaderState(&hook.Context{
+		Runner: runner,
+	})
+	// A unit that is not the leader can run install
+	// before the leader has saved any state.
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, gc.HasLen, 0)
+}
 
-	valBool, err := ctxt.GetConfigBool("title")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("title", "bool"))
-	c.Assert(valBool, gc.Equals, false)
+func (s *HookSuite) TestParseStateStorage(c *gc.C) {
+	for _, storage := range []hook.StateStorage{
+		hook.StateStorageFiles,
+		hook.StateStorageSingleFile,
+		hook.StateStorageUnit,
+		hook.StateStorageLeader,
+	} {
+		got, err := hook.ParseStateStorage(storage.String())
+		c.Assert(err, gc.IsNil)
+		c.Assert(got, gc.Equals, storage)
+	}
+	_, err := hook.ParseStateStorage("foo")
+	c.Assert(err, gc.ErrorMatches, `unknown state storage "foo"`)
+}
 
-	valString, err := ctxt.GetConfigString("title")
+func (s *HookSuite) TestEncryptedState(c *gc.C) {
+	ctxt := &hook.Context{
+		HookStateDir: c.MkDir(),
+	}
+	keyFile := filepath.Join(c.MkDir(), "key")
+	keys := hook.StateKeyFile(keyFile)
+	mem := hooktest.MemState{
+		"root.old": []byte(`{"Password":"old"}`),
+	}
+	state := hook.NewEncryptedState(mem, ctxt, keys)
+
+	// State saved without encryption can be read.
+	data, err := state.Load("root.old")
 	c.Assert(err, gc.IsNil)
-	c.Assert(valString, gc.Equals, "My Title")
-}
+	c.Assert(string(data), gc.Equals, `{"Password":"old"}`)
 
-func (s *HookSuite) TestGetBoolConfig(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+	// The key file is created when first needed.
+	err = state.SaveAll(map[string][]byte{
+		"root":     []byte(`{"Password":"hunter2"}`),
+		"root.old": []byte(`{"Password":"old"}`),
+	})
+	c.Assert(err, gc.IsNil)
+	info, err := os.Stat(keyFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0600))
+	c.Assert(string(mem["root"]), gc.Not(jc.Contains), "hunter2")
+	c.Assert(string(mem["root.old"]), gc.Not(jc.Contains), "old")
 
-	var valInterface interface{}
-	err := ctxt.GetConfig("monsters", &valInterface)
+	state = hook.NewEncryptedState(mem, ctxt, keys)
+	data, err = state.Load("root")
 	c.Assert(err, gc.IsNil)
-	c.Assert(valInterface, gc.Equals, true)
+	c.Assert(string(data), gc.Equals, `{"Password":"hunter2"}`)
 
-	valFloat64, err := ctxt.GetConfigFloat64("monsters")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("monsters", "float64"))
-	c.Assert(valFloat64, gc.Equals, 0.0)
+	// Saving unchanged state does not change the saved data.
+	saved := string(mem["root"])
+	err = state.Save("root", data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(mem["root"]), gc.Equals, saved)
 
-	valInt, err := ctxt.GetConfigInt("monsters")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("monsters", "int"))
-	c.Assert(valInt, gc.Equals, 0)
+	// After the key is rotated, old state can still be read
+	// and state is encrypted with the new key when it is saved.
+	err = keys.RotateStateKey(ctxt)
+	c.Assert(err, gc.IsNil)
+	err = state.Save("root", data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(mem["root"]), gc.Not(gc.Equals), saved)
+	state = hook.NewEncryptedState(mem, ctxt, keys)
+	data, err = state.Load("root.old")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"Password":"old"}`)
+	data, err = state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"Password":"hunter2"}`)
 
-	valBool, err := ctxt.GetConfigBool("monsters")
+	// Without the key, the state cannot be read.
+	otherKeys := hook.StateKeyFile(filepath.Join(c.MkDir(), "key"))
+	_, err = otherKeys.StateKeys(ctxt)
 	c.Assert(err, gc.IsNil)
-	c.Assert(valBool, gc.Equals, true)
+	_, err = hook.NewEncryptedState(mem, ctxt, otherKeys).Load("root")
+	c.Assert(err, gc.ErrorMatches, `cannot decrypt state "root": unknown key "[0-9a-f]+"`)
 
-	valString, err := ctxt.GetConfigString("monsters")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("monsters", "string"))
-	c.Assert(valString, gc.Equals, "")
-}
+	// Data moved from one name to another cannot be read.
+	mem["root.other"] = mem["root"]
+	_, err = hook.NewEncryptedState(mem, ctxt, keys).Load("root.other")
+	c.Assert(err, gc.ErrorMatches, `cannot decrypt state "root.other" with key "[0-9a-f]+": wrong key or corrupt data`)
 
-func (s *HookSuite) TestGetIntConfig(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+	// The key file must be private.
+	err = os.Chmod(keyFile, 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = hook.NewEncryptedState(mem, ctxt, keys).Load("root")
+	c.Assert(err, gc.ErrorMatches, `cannot get state keys: state key file ".*" is accessible by other users`)
+}
 
-	var valInterface interface{}
-	err := ctxt.GetConfig("red-balloon-count", &valInterface)
+func (s *HookSuite) TestMainWithEncryptedState(c *gc.C) {
+	var localState struct {
+		Password string
+	}
+	password := "hunter2"
+	encrypt := true
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(ctxt *hook.Context) error {
+				return nil
+			}, &localState)
+			if encrypt {
+				r.SetStateEncryption(hook.StateKeySecret("state-key"))
+			}
+			r.RegisterHook("config-changed", func() error {
+				localState.Password = password
+				return nil
+			})
+		},
+		HookStateDir: c.MkDir(),
+		Logger:       c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Secrets["state-key"], gc.HasLen, 2)
+	err = runner.CheckNoCleartext(password)
 	c.Assert(err, gc.IsNil)
-	c.Assert(valInterface, gc.Equals, 99.0)
 
-	valFloat64, err := ctxt.GetConfigFloat64("red-balloon-count")
+	// The state can be read by the next hook, and is encrypted
+	// with a new key after the key has been rotated.
+	localState.Password = ""
+	oldSecret := runner.Secrets["state-key"]
+	err = hook.StateKeySecret("state-key").RotateStateKey(&hook.Context{
+		Runner: runner,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Secrets["state-key"], gc.HasLen, 3)
+	c.Assert(runner.Secrets["state-key"]["current"], gc.Not(gc.Equals), oldSecret["current"])
+	password = "hunter3"
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	err = runner.CheckNoCleartext("hunter2", "hunter3")
 	c.Assert(err, gc.IsNil)
-	c.Assert(valFloat64, gc.Equals, 99.0)
 
-	valInt, err := ctxt.GetConfigInt("red-balloon-count")
+	// Without encryption, the password is found.
+	encrypt = false
+	runner.State = nil
+	err = runner.RunHook("config-changed", "", "")
 	c.Assert(err, gc.IsNil)
-	c.Assert(valInt, gc.Equals, 99)
+	err = runner.CheckNoCleartext("hunter3")
+	c.Assert(err, gc.ErrorMatches, `"hunter3" found in cleartext in state "root"`)
+}
 
-	valBool, err := ctxt.GetConfigBool("red-balloon-count")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("red-balloon-count", "bool"))
-	c.Assert(valBool, gc.Equals, false)
+func (s *HookSuite) TestStateKeySecretContentNotInArgs(c *gc.C) {
+	tmpDir := c.MkDir()
+	oldTmpDir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", tmpDir)
+	defer os.Setenv("TMPDIR", oldTmpDir)
 
-	valString, err := ctxt.GetConfigString("red-balloon-count")
-	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("red-balloon-count", "string"))
-	c.Assert(valString, gc.Equals, "")
-}
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	ctxt := &hook.Context{
+		Runner: runner,
+	}
+	// The hooktest runner panics if the secret content
+	// is found in the arguments or the content file
+	// is accessible by others.
+	keys, err := hook.StateKeySecret("state-key").StateKeys(ctxt)
+	c.Assert(err, gc.IsNil)
+	err = hook.StateKeySecret("state-key").RotateStateKey(ctxt)
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Secrets["state-key"], gc.HasLen, 3)
+	c.Assert(runner.Secrets["state-key"]["key-"+keys.Current], gc.Equals, base64.StdEncoding.EncodeToString(keys.Keys[keys.Current]))
 
-func (s *HookSuite) TestGetAllConfig(c *gc.C) {
-	s.StartServer(c, 0, "peer0/0")
-	ctxt := s.newContext(c, "peer-relation-changed")
-	defer ctxt.Close()
+	// The content files have been removed.
+	files, err := ioutil.ReadDir(tmpDir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 0)
 
-	var m map[string]interface{}
-	err := ctxt.GetAllConfig(&m)
+	path := filepath.Join(tmpDir, "content")
+	err = ioutil.WriteFile(path, []byte(`{"key":"sekrit-value"}`), 0600)
 	c.Assert(err, gc.IsNil)
-	c.Assert(m, gc.DeepEquals, map[string]interface{}{
-		"monsters":            true,
-		"spline-reticulation": 45.0,
-		"red-balloon-count":   99.0,
-		"title":               "My Title",
-		"username":            "admin001",
+	c.Assert(func() {
+		runner.Run("secret-add", "--owner", "unit", "--label", "sekrit-value", "--file", path)
+	}, gc.PanicMatches, `secret content found in command arguments .*`)
+	// Empty and short values are not checked.
+	err = ioutil.WriteFile(path, []byte(`{"empty":"","short":"unit"}`), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = runner.Run("secret-add", "--owner", "unit", "--label", "short", "--file", path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Secrets["short"], jc.DeepEquals, map[string]string{
+		"empty": "",
+		"short": "unit",
 	})
 
-	var cfg struct {
-		Monsters *bool  `json:"monsters"`
-		Title    string `json:"title"`
-		Other    string
-	}
-	err = ctxt.GetAllConfig(&cfg)
+	err = os.Chmod(path, 0644)
 	c.Assert(err, gc.IsNil)
-	c.Assert(*cfg.Monsters, gc.Equals, true)
-	c.Assert(cfg.Title, gc.Equals, "My Title")
-	c.Assert(cfg.Other, gc.Equals, "")
+	c.Assert(func() {
+		runner.Run("secret-add", "--owner", "unit", "--label", "other", "--file", path)
+	}, gc.PanicMatches, `secret content file ".*" is accessible by other users`)
 }
 
-func (s *HookSuite) TestRegister(c *gc.C) {
-	r := hook.NewRegistry()
+func (s *HookSuite) TestEncryptedLeaderStateRejected(c *gc.C) {
+	for _, setStorage := range []bool{false, true} {
+		runner := &hooktest.Runner{
+			RegisterHooks: func(r *hook.Registry) {
+				r.SetStateEncryption(hook.StateKeySecret("state-key"))
+				if setStorage {
+					r.SetStateStorage(hook.StateStorageLeader)
+				}
+				r.RegisterHook("config-changed", func() error {
+					c.Errorf("hook function called unexpectedly")
+					return nil
+				})
+			},
+			IsLeader:     true,
+			HookStateDir: "/dev/null",
+			Logger:       c,
+		}
+		if !setStorage {
+			runner.State = hook.NewLeaderState(&hook.Context{
+				Runner: runner,
+			})
+		}
+		err := runner.RunHook("config-changed", "", "")
+		c.Assert(err, gc.ErrorMatches, `state encryption cannot be used with leader state storage`)
+		c.Assert(runner.Secrets, gc.HasLen, 0)
+	}
+}
+
+func (s *HookSuite) TestMainSavesStateInOneBatch(c *gc.C) {
+	r := hook.NewRegistry()
+	registerDefaultRelations(r)
+	var localState struct {
+		N int
+	}
+	r.RegisterContext(func(*hook.Context) error {
+		return nil
+	}, &localState)
+	r.Clone("sub").RegisterContext(func(*hook.Context) error {
+		return nil
+	}, &localState)
+	r.RegisterHook("install", func() error {
+		localState.N++
+		return nil
+	})
+	state := &batchRecordingState{
+		BatchState: hook.NewSingleFileState(c.MkDir()),
+	}
+	_, err := hook.Main(r, &hook.Context{
+		HookName: "install",
+		Runner:   nopRunner{},
+	}, state)
+	c.Assert(err, gc.IsNil)
+	c.Assert(state.saves, gc.Equals, 0)
+	c.Assert(state.batches, jc.DeepEquals, [][]string{
+		{"_published", "_relations", "root", "root.sub"},
+	})
+}
+
+// batchRecordingState records the names of
+// the state items that are saved.
+type batchRecordingState struct {
+	hook.BatchState
+	saves   int
+	batches [][]string
+}
+
+func (s *batchRecordingState) Save(name string, data []byte) error {
+	s.saves++
+	return s.BatchState.Save(name, data)
+}
+
+func (s *batchRecordingState) SaveAll(items map[string][]byte) error {
+	var names []string
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s.batches = append(s.batches, names)
+	return s.BatchState.SaveAll(items)
+}
+
+type versionedState struct {
+	Name string
+	Port int
+}
+
+func registerVersionedState(r *hook.Registry, state *versionedState, migrated *int) {
+	r.RegisterContext(func(*hook.Context) error {
+		return nil
+	}, state)
+	r.SetStateVersion(2, func(old []byte) ([]byte, error) {
+		// Version 1 renamed Host to Name.
+		*migrated++
+		var v0 struct {
+			Host string
+			Port string
+		}
+		if err := json.Unmarshal(old, &v0); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return json.Marshal(map[string]string{
+			"Name": v0.Host,
+			"Port": v0.Port,
+		})
+	}, func(old []byte) ([]byte, error) {
+		// Version 2 changed Port from a string to an int.
+		*migrated++
+		var v1 struct {
+			Name string
+			Port string
+		}
+		if err := json.Unmarshal(old, &v1); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		port, err := strconv.Atoi(v1.Port)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return json.Marshal(versionedState{
+			Name: v1.Name,
+			Port: port,
+		})
+	})
+	r.RegisterHook("install", func() error {
+		return nil
+	})
+}
+
+func (s *HookSuite) TestStateMigration(c *gc.C) {
+	var state versionedState
+	migrated := 0
+	r := hook.NewRegistry()
+	registerVersionedState(r, &state, &migrated)
+	pstate := hook.NewDiskState(c.MkDir())
+	err := pstate.Save("root", []byte(`{"Host":"example.com","Port":"8080"}`))
+	c.Assert(err, gc.IsNil)
+
+	runMain := func() error {
+		_, err := hook.Main(r, &hook.Context{
+			HookName: "install",
+			Runner:   nopRunner{},
+		}, pstate)
+		return err
+	}
+	err = runMain()
+	c.Assert(err, gc.IsNil)
+	c.Assert(state, jc.DeepEquals, versionedState{
+		Name: "example.com",
+		Port: 8080,
+	})
+	c.Assert(migrated, gc.Equals, 2)
+	data, err := pstate.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), jc.JSONEquals, map[string]interface{}{
+		"_version": 2,
+		"_state": map[string]interface{}{
+			"Name": "example.com",
+			"Port": 8080,
+		},
+	})
+
+	// The state is not migrated again.
+	state = versionedState{}
+	err = runMain()
+	c.Assert(err, gc.IsNil)
+	c.Assert(migrated, gc.Equals, 2)
+	c.Assert(state.Port, gc.Equals, 8080)
+
+	// State from a later version is rejected.
+	err = pstate.Save("root", []byte(`{"_version":3,"_state":{}}`))
+	c.Assert(err, gc.IsNil)
+	err = runMain()
+	c.Assert(err, gc.ErrorMatches, `install hook failed in root: cannot load state: saved state has version 3, which is newer than current version 2`)
+}
+
+func (s *HookSuite) TestCheckStateMigration(c *gc.C) {
+	var state versionedState
+	migrated := 0
+	registerHooks := func(r *hook.Registry) {
+		registerVersionedState(r.Clone("sub"), &state, &migrated)
+	}
+	err := hooktest.CheckStateMigration(registerHooks, "root.sub", []byte(`{"Host":"a","Port":"1"}`), versionedState{
+		Name: "a",
+		Port: 1,
+	})
+	c.Assert(err, gc.IsNil)
+	err = hooktest.CheckStateMigration(registerHooks, "root.sub", []byte(`{"_version":1,"_state":{"Name":"b","Port":"2"}}`), versionedState{
+		Name: "b",
+		Port: 2,
+	})
+	c.Assert(err, gc.IsNil)
+	err = hooktest.CheckStateMigration(registerHooks, "root.sub", []byte(`{"Host":"a","Port":"1"}`), versionedState{
+		Name: "a",
+		Port: 2,
+	})
+	c.Assert(err, gc.ErrorMatches, `unexpected migrated state; got .* want .*`)
+	err = hooktest.CheckStateMigration(registerHooks, "root.sub", []byte(`{"Host":"a","Port":"x"}`), versionedState{})
+	c.Assert(err, gc.ErrorMatches, `cannot migrate state from version 1 to 2: .*`)
+}
+
+func (s *HookSuite) TestSetStateVersionWithoutState(c *gc.C) {
+	r := hook.NewRegistry()
+	c.Assert(func() {
+		r.SetStateVersion(1, func(old []byte) ([]byte, error) {
+			return old, nil
+		})
+	}, gc.PanicMatches, "SetStateVersion called with no registered state")
+	r.RegisterContext(func(*hook.Context) error {
+		return nil
+	}, new(int))
+	c.Assert(func() {
+		r.SetStateVersion(1)
+	}, gc.PanicMatches, "state version 1 requires 1 migrations, but 0 provided")
+}
+
+type counterState struct {
+	Count int
+	Names []string
+}
+
+func (s *HookSuite) TestTransactionalState(c *gc.C) {
+	var txnState, plainState counterState
+	var hookErr error
+	r := hook.NewRegistry()
+	txn := r.Clone("txn")
+	txn.RegisterContext(func(*hook.Context) error {
+		return nil
+	}, &txnState)
+	txn.SetTransactionalState(true)
+	plain := r.Clone("plain")
+	plain.RegisterContext(func(*hook.Context) error {
+		return nil
+	}, &plainState)
+	r.RegisterHook("config-changed", func() error {
+		txnState.Count++
+		txnState.Names = append(txnState.Names, "x")
+		plainState.Count++
+		return hookErr
+	})
+	r.RegisterHook("upgrade-charm", func() error {
+		txnState.Count++
+		panic("oops")
+	})
+	pstate := hook.NewDiskState(c.MkDir())
+	runMain := func(hookName string) error {
+		_, err := hook.Main(r, &hook.Context{
+			HookName: hookName,
+			Runner:   nopRunner{},
+		}, pstate)
+		return err
+	}
+	assertSaved := func(name string, want counterState) {
+		data, err := pstate.Load(name)
+		c.Assert(err, gc.IsNil)
+		var got counterState
+		err = json.Unmarshal(data, &got)
+		c.Assert(err, gc.IsNil)
+		c.Assert(got, jc.DeepEquals, want)
+	}
+
+	// When the hook succeeds, all state is saved.
+	err := runMain("config-changed")
+	c.Assert(err, gc.IsNil)
+	assertSaved("root.txn", counterState{Count: 1, Names: []string{"x"}})
+	assertSaved("root.plain", counterState{Count: 1})
+
+	// When the hook fails, the transactional state is not
+	// saved and its changes are discarded, but other
+	// state is saved as usual.
+	hookErr = errgo.New("failure")
+	err = runMain("config-changed")
+	c.Assert(err, gc.ErrorMatches, "config-changed hook failed in root: failure")
+	assertSaved("root.txn", counterState{Count: 1, Names: []string{"x"}})
+	assertSaved("root.plain", counterState{Count: 2})
+	c.Assert(txnState, jc.DeepEquals, counterState{Count: 1, Names: []string{"x"}})
+	c.Assert(plainState.Count, gc.Equals, 2)
+
+	// The same applies when a hook panics.
+	err = runMain("upgrade-charm")
+	c.Assert(err, gc.ErrorMatches, "upgrade-charm hook failed in root: panic in root: oops")
+	assertSaved("root.txn", counterState{Count: 1, Names: []string{"x"}})
+	c.Assert(txnState.Count, gc.Equals, 1)
+
+	// When the hook is retried successfully, it starts
+	// from the last committed state.
+	hookErr = nil
+	err = runMain("config-changed")
+	c.Assert(err, gc.IsNil)
+	assertSaved("root.txn", counterState{Count: 2, Names: []string{"x", "x"}})
+	assertSaved("root.plain", counterState{Count: 3})
+}
+
+func (s *HookSuite) TestSetTransactionalStateWithoutState(c *gc.C) {
+	r := hook.NewRegistry()
+	c.Assert(func() {
+		r.SetTransactionalState(true)
+	}, gc.PanicMatches, "SetTransactionalState called with no registered state")
+}
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Logf(f string, a ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(f, a...))
+}
+
+var errHookTest = errgo.New("test error")
+
+func (s *HookSuite) TestHookErrorContext(c *gc.C) {
+	logger := &recordingLogger{}
+	errorStatus := hook.Status("")
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.SetErrorStatus(errorStatus)
+			r.RegisterHook("config-changed", func() error {
+				return nil
+			})
+			r.Clone("sub").RegisterHook("config-changed", func() error {
+				return errgo.WithCausef(nil, errHookTest, "cannot reticulate splines")
+			})
+		},
+		HookStateDir: "/dev/null",
+		Logger:       logger,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook failed in root.sub on unit someunit/0: cannot reticulate splines`)
+	c.Assert(errgo.Cause(err), gc.Equals, errHookTest)
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{})
+
+	// The full error details are logged.
+	var logged string
+	for _, msg := range logger.msgs {
+		if strings.HasPrefix(msg, "hook config-changed failed: ") {
+			logged = msg
+		}
+	}
+	c.Assert(logged, gc.Matches, `.*_test.go:[0-9]+: cannot reticulate splines.*`)
+
+	// When an error status is registered, it is set.
+	errorStatus = hook.StatusBlocked
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.NotNil)
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusBlocked,
+		Message: err.Error(),
+	})
+}
+
+func (s *HookSuite) TestHookSetupErrorContext(c *gc.C) {
+	var localState struct {
+		N int
+	}
+	setterErr := error(nil)
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterConfig("port", charm.Option{
+				Type: "int",
+			})
+			r.RegisterConfigRule("port", hook.ConfigMax(65535))
+			r.RegisterHook("config-changed", func() error {
+				return nil
+			})
+			sub := r.Clone("sub")
+			sub.RegisterContext(func(*hook.Context) error {
+				return setterErr
+			}, &localState)
+			sub.RegisterHook("config-changed", func() error {
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"port": 8080,
+		},
+		State:        hooktest.MemState{},
+		HookStateDir: "/dev/null",
+		Logger:       c,
+	}
+
+	// Errors from context setters name the registry
+	// that registered the setter.
+	setterErr = errgo.WithCausef(nil, errHookTest, "cannot frob")
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook failed in root.sub on unit someunit/0: cannot set context: cannot frob`)
+	c.Assert(errgo.Cause(err), gc.Equals, errHookTest)
+	setterErr = nil
+
+	// Errors checking the configuration name the root registry.
+	runner.Config["port"] = 99999
+	runner.RunFunc = func(cmd string, args ...string) ([]byte, error) {
+		if cmd == "status-set" {
+			return nil, errgo.New("no status for you")
+		}
+		return nil, nil
+	}
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook failed in root on unit someunit/0: cannot set blocked status: no status for you`)
+	runner.RunFunc = nil
+	runner.Config["port"] = 8080
+
+	// Errors loading state name the registry
+	// that registered the state.
+	runner.State.(hooktest.MemState)["root.sub"] = []byte("{")
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook failed in root.sub on unit someunit/0: cannot unmarshal state: unexpected end of JSON input`)
+}
+
+func (s *HookSuite) TestHookPanic(c *gc.C) {
+	logger := &recordingLogger{}
+	var localState struct {
+		N int
+	}
+	panicIn := ""
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			sub := r.Clone("sub")
+			sub.RegisterContext(func(*hook.Context) error {
+				if panicIn == "setter" {
+					panic("setter panic")
+				}
+				return nil
+			}, &localState)
+			sub.RegisterHook("config-changed", func() error {
+				localState.N++
+				if panicIn == "hook" {
+					panic(errgo.New("hook panic"))
+				}
+				return nil
+			})
+			sub.RegisterCommand(func(args []string) (hook.Command, error) {
+				panic("command panic")
+			})
+		},
+		HookStateDir: "/dev/null",
+		Logger:       logger,
+	}
+	panicIn = "hook"
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook failed in root.sub on unit someunit/0: panic in root.sub: hook panic`)
+	perr, ok := errgo.Cause(err).(*hook.PanicError)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(perr.RegistryName, gc.Equals, "root.sub")
+	c.Assert(string(perr.Stack), gc.Matches, `(?s).*_test.go:[0-9]+.*`)
+
+	// The stack trace is logged.
+	var logged string
+	for _, msg := range logger.msgs {
+		if strings.HasPrefix(msg, "panic stack trace:") {
+			logged = msg
+		}
+	}
+	c.Assert(logged, gc.Equals, "panic stack trace:\n"+string(perr.Stack))
+
+	// The local state is still saved.
+	c.Assert(string(runner.State.(hooktest.MemState)["root.sub"]), gc.Equals, `{"N":1}`)
+
+	panicIn = "setter"
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook failed in root.sub on unit someunit/0: cannot set context: panic in root.sub: setter panic`)
+	c.Assert(errgo.Cause(err), gc.FitsTypeOf, (*hook.PanicError)(nil))
+
+	_, err = runner.RunCommand("cmd-root.sub", nil)
+	c.Assert(err, gc.ErrorMatches, `panic in root.sub: command panic`)
+	c.Assert(errgo.Cause(err), gc.FitsTypeOf, (*hook.PanicError)(nil))
+}
+
+type failRecordingLogger struct {
+	recordingLogger
+	errors []string
+}
+
+func (l *failRecordingLogger) Errorf(f string, a ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(f, a...))
+}
+
+func (s *HookSuite) TestHooktestReportsPanic(c *gc.C) {
+	logger := &failRecordingLogger{}
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterHook("install", func() error {
+				panic("oops")
+			})
+		},
+		HookStateDir: "/dev/null",
+		Logger:       logger,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.ErrorMatches, `install hook failed in root on unit someunit/0: panic in root: oops`)
+	c.Assert(logger.errors, gc.HasLen, 1)
+	c.Assert(logger.errors[0], gc.Matches, `(?s)install hook failed in root on unit someunit/0: panic in root: oops\n.*_test.go:[0-9]+.*`)
+}
+
+func (s *HookSuite) TestContextGetter(c *gc.C) {
+	// TODO
+}
+
+func (s *HookSuite) TestRelationValuesFromRelationHook(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+	c.Assert(ctxt.RelationIds, jc.DeepEquals, allRelationIds)
+	c.Assert(ctxt.Relations, jc.DeepEquals, allRelationValues)
+}
+
+func (s *HookSuite) TestRelationValuesFromNonRelationHook(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "config-changed")
+	defer ctxt.Close()
+	c.Assert(ctxt.RelationIds, jc.DeepEquals, allRelationIds)
+	c.Assert(ctxt.Relations, jc.DeepEquals, allRelationValues)
+}
+
+func (s *HookSuite) TestRelationValuesLoadedLazily(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	r := hook.NewRegistry()
+	registerDefaultRelations(r)
+	r.SetLazyRelations()
+	ctxt, _, err := hook.NewContextFromEnvironment(r, s.stateDir, "config-changed", nil)
+	c.Assert(err, gc.IsNil)
+	defer ctxt.Close()
+	c.Assert(ctxt.RelationIds, gc.HasLen, 0)
+	c.Assert(ctxt.Relations, gc.HasLen, 0)
+
+	c.Assert(ctxt.RelationIdsFor("peer1"), jc.DeepEquals, []hook.RelationId{"peer1:1"})
+	c.Assert(ctxt.Relations, gc.HasLen, 0)
+
+	c.Assert(ctxt.RelationSettings("peer1:1"), jc.DeepEquals, allRelationValues["peer1:1"])
+	c.Assert(ctxt.RelationIds, jc.DeepEquals, map[string][]hook.RelationId{
+		"peer1": {"peer1:1"},
+	})
+	c.Assert(ctxt.Relations, jc.DeepEquals, map[hook.RelationId]map[hook.UnitId]map[string]string{
+		"peer1:1": allRelationValues["peer1:1"],
+	})
+
+	// Once loaded, the values are not fetched again.
+	s.srvCtxt.rels[1].units["peer1/0"] = Settings{"private-address": "changed"}
+	c.Assert(ctxt.RelationSettings("peer1:1"), jc.DeepEquals, allRelationValues["peer1:1"])
+}
+
+func (s *HookSuite) TestRelationFromRelationHook(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+	c.Assert(ctxt.Relation(), jc.DeepEquals, map[string]string{
+		"private-address": "peer0-0.example.com",
+	})
+}
+
+func (s *HookSuite) TestGetAllRelationUnit(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	val, err := hook.CtxtGetAllRelationUnit(ctxt, "peer1:1", "peer1/1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(val, gc.DeepEquals, map[string]string{"private-address": "peer1-1.example.com"})
+}
+
+func (s *HookSuite) TestRelationIds(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	val, err := hook.CtxtRelationIds(ctxt, "peer0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(val, gc.DeepEquals, []hook.RelationId{"peer0:0"})
+}
+
+func (s *HookSuite) TestRelationUnits(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	val, err := hook.CtxtRelationUnits(ctxt, "peer1:1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(val, gc.DeepEquals, []hook.UnitId{"peer1/0", "peer1/1"})
+}
+
+func (s *HookSuite) TestGetFloatConfig(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	var valInterface interface{}
+	err := ctxt.GetConfig("spline-reticulation", &valInterface)
+	c.Assert(err, gc.IsNil)
+	c.Assert(valInterface, gc.Equals, 45.0)
+
+	valFloat64, err := ctxt.GetConfigFloat64("spline-reticulation")
+	c.Assert(err, gc.IsNil)
+	c.Assert(valFloat64, gc.Equals, 45.0)
+
+	valInt, err := ctxt.GetConfigInt("spline-reticulation")
+	c.Assert(err, gc.IsNil)
+	c.Assert(valInt, gc.Equals, 45)
+
+	valBool, err := ctxt.GetConfigBool("spline-reticulation")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("spline-reticulation", "bool"))
+	c.Assert(valBool, gc.Equals, false)
+
+	valString, err := ctxt.GetConfigString("spline-reticulation")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("spline-reticulation", "string"))
+	c.Assert(valString, gc.Equals, "")
+}
+
+func badConfigTypeErrorPat(key, type_ string) string {
+	return fmt.Sprintf(`cannot get configuration option %q: cannot parse command output ".*": json: cannot unmarshal .* into Go value of type %s`, key, type_)
+}
+
+func (s *HookSuite) TestGetStringConfig(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	var valInterface interface{}
+	err := ctxt.GetConfig("title", &valInterface)
+	c.Assert(err, gc.IsNil)
+	c.Assert(valInterface, gc.Equals, "My Title")
+
+	valFloat64, err := ctxt.GetConfigFloat64("title")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("title", "float64"))
+	c.Assert(valFloat64, gc.Equals, 0.0)
+
+	valInt, err := ctxt.GetConfigInt("title")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("title", "int"))
+	c.Assert(valInt, gc.Equals, 0)
+
+	valBool, err := ctxt.GetConfigBool("title")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("title", "bool"))
+	c.Assert(valBool, gc.Equals, false)
+
+	valString, err := ctxt.GetConfigString("title")
+	c.Assert(err, gc.IsNil)
+	c.Assert(valString, gc.Equals, "My Title")
+}
+
+func (s *HookSuite) TestGetBoolConfig(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	var valInterface interface{}
+	err := ctxt.GetConfig("monsters", &valInterface)
+	c.Assert(err, gc.IsNil)
+	c.Assert(valInterface, gc.Equals, true)
+
+	valFloat64, err := ctxt.GetConfigFloat64("monsters")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("monsters", "float64"))
+	c.Assert(valFloat64, gc.Equals, 0.0)
+
+	valInt, err := ctxt.GetConfigInt("monsters")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("monsters", "int"))
+	c.Assert(valInt, gc.Equals, 0)
+
+	valBool, err := ctxt.GetConfigBool("monsters")
+	c.Assert(err, gc.IsNil)
+	c.Assert(valBool, gc.Equals, true)
+
+	valString, err := ctxt.GetConfigString("monsters")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("monsters", "string"))
+	c.Assert(valString, gc.Equals, "")
+}
+
+func (s *HookSuite) TestGetIntConfig(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	var valInterface interface{}
+	err := ctxt.GetConfig("red-balloon-count", &valInterface)
+	c.Assert(err, gc.IsNil)
+	c.Assert(valInterface, gc.Equals, 99.0)
+
+	valFloat64, err := ctxt.GetConfigFloat64("red-balloon-count")
+	c.Assert(err, gc.IsNil)
+	c.Assert(valFloat64, gc.Equals, 99.0)
+
+	valInt, err := ctxt.GetConfigInt("red-balloon-count")
+	c.Assert(err, gc.IsNil)
+	c.Assert(valInt, gc.Equals, 99)
+
+	valBool, err := ctxt.GetConfigBool("red-balloon-count")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("red-balloon-count", "bool"))
+	c.Assert(valBool, gc.Equals, false)
+
+	valString, err := ctxt.GetConfigString("red-balloon-count")
+	c.Assert(err, gc.ErrorMatches, badConfigTypeErrorPat("red-balloon-count", "string"))
+	c.Assert(valString, gc.Equals, "")
+}
+
+func (s *HookSuite) TestGetAllConfig(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer-relation-changed")
+	defer ctxt.Close()
+
+	var m map[string]interface{}
+	err := ctxt.GetAllConfig(&m)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m, gc.DeepEquals, map[string]interface{}{
+		"monsters":            true,
+		"spline-reticulation": 45.0,
+		"red-balloon-count":   99.0,
+		"title":               "My Title",
+		"username":            "admin001",
+	})
+
+	var cfg struct {
+		Monsters *bool  `json:"monsters"`
+		Title    string `json:"title"`
+		Other    string
+	}
+	err = ctxt.GetAllConfig(&cfg)
+	c.Assert(err, gc.IsNil)
+	c.Assert(*cfg.Monsters, gc.Equals, true)
+	c.Assert(cfg.Title, gc.Equals, "My Title")
+	c.Assert(cfg.Other, gc.Equals, "")
+}
+
+func (s *HookSuite) TestRegister(c *gc.C) {
+	r := hook.NewRegistry()
 	r.RegisterHook("install", func() error { return nil })
 	c.Assert(r.RegisteredHooks(), gc.DeepEquals, []string{"install"})
 }
 
-var registerRelationTests = []struct {
-	about       string
-	rel         charm.Relation
-	expect      charm.Relation
-	expectPanic string
-}{{
-	about: "requirer limit default = 1, scope default to global",
-	rel: charm.Relation{
+var registerRelationTests = []struct {
+	about       string
+	rel         charm.Relation
+	expect      charm.Relation
+	expectPanic string
+}{{
+	about: "requirer limit default = 1, scope default to global",
+	rel: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RoleRequirer,
+	},
+	expect: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RoleRequirer,
+		Scope:     charm.ScopeGlobal,
+		Limit:     1,
+	},
+}, {
+	about: "provider limit default = 0, scope default to global",
+	rel: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RoleProvider,
+	},
+	expect: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RoleProvider,
+		Scope:     charm.ScopeGlobal,
+	},
+}, {
+	about: "peer limit default = 1, scope default to global",
+	rel: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RolePeer,
+	},
+	expect: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Limit:     1,
+		Role:      charm.RolePeer,
+		Scope:     charm.ScopeGlobal,
+	},
+}, {
+	about: "no defaults",
+	rel: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RoleProvider,
+		Limit:     2,
+		Scope:     charm.ScopeContainer,
+		Optional:  true,
+	},
+	expect: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Role:      charm.RoleProvider,
+		Limit:     2,
+		Scope:     charm.ScopeContainer,
+		Optional:  true,
+	},
+}, {
+	about: "no name",
+	rel: charm.Relation{
+		Interface: "bar",
+		Role:      charm.RoleProvider,
+		Limit:     2,
+		Scope:     charm.ScopeContainer,
+		Optional:  true,
+	},
+	expectPanic: "no relation name given in .*",
+}, {
+	about: "no interface name",
+	rel: charm.Relation{
+		Name:     "foo",
+		Role:     charm.RoleProvider,
+		Limit:    2,
+		Scope:    charm.ScopeContainer,
+		Optional: true,
+	},
+	expectPanic: "no interface name given in .*",
+}, {
+	about: "no role",
+	rel: charm.Relation{
+		Name:      "foo",
+		Interface: "bar",
+		Limit:     2,
+		Scope:     charm.ScopeContainer,
+		Optional:  true,
+	},
+	expectPanic: "no role given in .*",
+}}
+
+func (s *HookSuite) TestRegisterRelation(c *gc.C) {
+	all := hook.NewRegistry()
+	allExpect := make(map[string]charm.Relation)
+	for i, test := range registerRelationTests {
+		c.Logf("%d: %s", i, test.about)
+		r := hook.NewRegistry()
+		if test.expectPanic != "" {
+			c.Assert(func() { r.RegisterRelation(test.rel) }, gc.PanicMatches, test.expectPanic)
+		} else {
+			r.RegisterRelation(test.rel)
+			c.Assert(r.RegisteredRelations(), jc.DeepEquals, map[string]charm.Relation{
+				test.rel.Name: test.expect,
+			})
+			rel := test.rel
+			rel.Name = fmt.Sprintf("%s%d", test.rel.Name, i)
+			all.RegisterRelation(rel)
+			expect := test.expect
+			expect.Name = rel.Name
+			allExpect[expect.Name] = expect
+		}
+	}
+	c.Assert(all.RegisteredRelations(), jc.DeepEquals, allExpect)
+}
+
+func (s *HookSuite) TestRegisterSameNameDifferentRelation(c *gc.C) {
+	r := hook.NewRegistry()
+	rel := charm.Relation{
 		Name:      "foo",
 		Interface: "bar",
 		Role:      charm.RoleRequirer,
+	}
+	r.RegisterRelation(rel)
+
+	// Check that it's OK to register again with the same relation.
+	r.RegisterRelation(rel)
+
+	// Check that it panics when something changes.
+	rel.Interface = "baz"
+	c.Assert(func() {
+		r.RegisterRelation(rel)
+	}, gc.PanicMatches, `relation "foo" is already registered with different details .*`)
+}
+
+func (s *HookSuite) TestRegisterConfig(c *gc.C) {
+	r := hook.NewRegistry()
+	opt0 := charm.Option{
+		Type:        "string",
+		Description: "d",
+		Default:     134,
+	}
+	r.RegisterConfig("opt0", opt0)
+	// Check that it's OK to register again with the same option.
+	r.RegisterConfig("opt0", opt0)
+
+	opt1 := opt0
+	opt1.Default = 135
+	c.Assert(func() {
+		r.RegisterConfig("opt0", opt1)
+	}, gc.PanicMatches, `configuration option "opt0" is already registered with different details .*`)
+
+	r.RegisterConfig("opt1", opt1)
+
+	c.Assert(r.RegisteredConfig(), jc.DeepEquals, map[string]charm.Option{
+		"opt0": opt0,
+		"opt1": opt1,
+	})
+}
+
+var registerStorageTests = []struct {
+	about       string
+	st          charm.Storage
+	expect      charm.Storage
+	expectPanic string
+}{{
+	about: "count defaults to 1",
+	st: charm.Storage{
+		Name: "data",
+		Type: charm.StorageFilesystem,
 	},
-	expect: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RoleRequirer,
-		Scope:     charm.ScopeGlobal,
-		Limit:     1,
+	expect: charm.Storage{
+		Name:     "data",
+		Type:     charm.StorageFilesystem,
+		CountMin: 1,
+		CountMax: 1,
 	},
 }, {
-	about: "provider limit default = 0, scope default to global",
-	rel: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RoleProvider,
+	about: "no defaults",
+	st: charm.Storage{
+		Name:        "data",
+		Description: "some data",
+		Type:        charm.StorageBlock,
+		CountMin:    0,
+		CountMax:    -1,
+		MinimumSize: 1024,
 	},
-	expect: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RoleProvider,
-		Scope:     charm.ScopeGlobal,
+	expect: charm.Storage{
+		Name:        "data",
+		Description: "some data",
+		Type:        charm.StorageBlock,
+		CountMin:    0,
+		CountMax:    -1,
+		MinimumSize: 1024,
 	},
 }, {
-	about: "peer limit default = 1, scope default to global",
-	rel: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RolePeer,
+	about: "invalid name",
+	st: charm.Storage{
+		Name: "data_0",
+		Type: charm.StorageFilesystem,
 	},
-	expect: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Limit:     1,
-		Role:      charm.RolePeer,
-		Scope:     charm.ScopeGlobal,
+	expectPanic: `invalid storage name "data_0"`,
+}, {
+	about: "no type",
+	st: charm.Storage{
+		Name: "data",
 	},
+	expectPanic: `invalid type "" in storage "data"`,
 }, {
-	about: "no defaults",
-	rel: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RoleProvider,
-		Limit:     2,
-		Scope:     charm.ScopeContainer,
-		Optional:  true,
+	about: "invalid count range",
+	st: charm.Storage{
+		Name:     "data",
+		Type:     charm.StorageFilesystem,
+		CountMin: 2,
+		CountMax: 1,
 	},
-	expect: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RoleProvider,
-		Limit:     2,
-		Scope:     charm.ScopeContainer,
-		Optional:  true,
+	expectPanic: `invalid count range 2-1 in storage "data"`,
+}}
+
+func (s *HookSuite) TestRegisterStorage(c *gc.C) {
+	for i, test := range registerStorageTests {
+		c.Logf("%d: %s", i, test.about)
+		r := hook.NewRegistry()
+		if test.expectPanic != "" {
+			c.Assert(func() { r.RegisterStorage(test.st) }, gc.PanicMatches, test.expectPanic)
+			continue
+		}
+		r.RegisterStorage(test.st)
+		c.Assert(r.RegisteredStorage(), jc.DeepEquals, map[string]charm.Storage{
+			test.st.Name: test.expect,
+		})
+	}
+}
+
+func (s *HookSuite) TestRegisterSameNameDifferentStorage(c *gc.C) {
+	r := hook.NewRegistry()
+	st := charm.Storage{
+		Name: "data",
+		Type: charm.StorageFilesystem,
+	}
+	r.RegisterStorage(st)
+
+	// Check that it's OK to register again with the same storage.
+	r.RegisterStorage(st)
+
+	st.Type = charm.StorageBlock
+	c.Assert(func() {
+		r.RegisterStorage(st)
+	}, gc.PanicMatches, `storage "data" is already registered with different details .*`)
+}
+
+func (s *HookSuite) TestRegisterResource(c *gc.C) {
+	r := hook.NewRegistry()
+	res0 := resource.Meta{
+		Name:        "res0",
+		Path:        "res0.tgz",
+		Description: "d",
+	}
+	r.RegisterResource(res0)
+	// Check that it's OK to register again with the same resource.
+	r.RegisterResource(res0)
+
+	res1 := res0
+	res1.Path = "other.tgz"
+	c.Assert(func() {
+		r.RegisterResource(res1)
+	}, gc.PanicMatches, `resource "res0" is already registered with different details .*`)
+
+	c.Assert(func() {
+		r.RegisterResource(resource.Meta{Name: "res1"})
+	}, gc.PanicMatches, `invalid resource "res1": .*`)
+
+	res1.Name = "res1"
+	r.RegisterResource(res1)
+
+	// The type defaults to TypeFile.
+	res0.Type = resource.TypeFile
+	res1.Type = resource.TypeFile
+	c.Assert(r.RegisteredResources(), jc.DeepEquals, map[string]resource.Meta{
+		"res0": res0,
+		"res1": res1,
+	})
+}
+
+func (s *HookSuite) TestRegisterExtraBinding(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterExtraBinding("admin")
+	// Check that it's OK to register the same binding again.
+	r.RegisterExtraBinding("admin")
+	r.RegisterExtraBinding("data-net")
+
+	c.Assert(func() {
+		r.RegisterExtraBinding("Bad")
+	}, gc.PanicMatches, `invalid extra binding name "Bad"`)
+
+	c.Assert(r.RegisteredExtraBindings(), jc.DeepEquals, map[string]charm.ExtraBinding{
+		"admin":    {Name: "admin"},
+		"data-net": {Name: "data-net"},
+	})
+}
+
+func (s *HookSuite) TestRegisterMetric(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterMetric("requests", charm.MetricTypeAbsolute, "number of requests")
+	// Check that it's OK to register again with the same details.
+	r.RegisterMetric("requests", charm.MetricTypeAbsolute, "number of requests")
+	r.RegisterMetric("users", charm.MetricTypeGauge, "current users")
+
+	c.Assert(func() {
+		r.RegisterMetric("requests", charm.MetricTypeGauge, "number of requests")
+	}, gc.PanicMatches, `metric "requests" is already registered with different details .*`)
+	c.Assert(func() {
+		r.RegisterMetric("juju-units", charm.MetricTypeGauge, "")
+	}, gc.PanicMatches, `invalid metric name "juju-units"`)
+	c.Assert(func() {
+		r.RegisterMetric("foo", "bad", "")
+	}, gc.PanicMatches, `invalid type "bad" in metric "foo"`)
+
+	c.Assert(r.RegisteredMetrics(), jc.DeepEquals, map[string]charm.Metric{
+		"requests": {
+			Type:        charm.MetricTypeAbsolute,
+			Description: "number of requests",
+		},
+		"users": {
+			Type:        charm.MetricTypeGauge,
+			Description: "current users",
+		},
+	})
+}
+
+type actionParams struct {
+	Name     string `json:"name" description:"the name"`
+	Count    int    `json:"count,omitempty"`
+	Verbose  bool
+	Ignored  string `json:"-"`
+	internal int
+}
+
+var registerActionTests = []struct {
+	about       string
+	name        string
+	params      interface{}
+	expect      charm.ActionSpec
+	expectPanic string
+}{{
+	about: "no parameters",
+	name:  "snapshot",
+	expect: charm.ActionSpec{
+		Description: "an action",
+		Params: map[string]interface{}{
+			"title":                "snapshot",
+			"description":          "an action",
+			"type":                 "object",
+			"properties":           map[string]interface{}{},
+			"additionalProperties": false,
+		},
+	},
+}, {
+	about:  "struct parameters",
+	name:   "do-something",
+	params: (*actionParams)(nil),
+	expect: charm.ActionSpec{
+		Description: "an action",
+		Params: map[string]interface{}{
+			"title":       "do-something",
+			"description": "an action",
+			"type":        "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "the name",
+				},
+				"count": map[string]interface{}{
+					"type": "integer",
+				},
+				"Verbose": map[string]interface{}{
+					"type": "boolean",
+				},
+			},
+			"additionalProperties": false,
+			"required":             []string{"name", "Verbose"},
+		},
 	},
 }, {
-	about: "no name",
-	rel: charm.Relation{
-		Interface: "bar",
-		Role:      charm.RoleProvider,
-		Limit:     2,
-		Scope:     charm.ScopeContainer,
-		Optional:  true,
-	},
-	expectPanic: "no relation name given in .*",
+	about:       "invalid name",
+	name:        "Bad_name",
+	expectPanic: `invalid action name "Bad_name"`,
+}, {
+	about:       "non-struct parameters",
+	name:        "foo",
+	params:      "hello",
+	expectPanic: `invalid parameters for action "foo": parameters have type string, not struct`,
+}, {
+	about: "unsupported parameter type",
+	name:  "foo",
+	params: struct {
+		F func()
+	}{},
+	expectPanic: `invalid parameters for action "foo": field F has unsupported type func\(\)`,
+}}
+
+func (s *HookSuite) TestRegisterAction(c *gc.C) {
+	for i, test := range registerActionTests {
+		c.Logf("%d: %s", i, test.about)
+		r := hook.NewRegistry()
+		if test.expectPanic != "" {
+			c.Assert(func() {
+				r.RegisterAction(test.name, "an action", test.params)
+			}, gc.PanicMatches, test.expectPanic)
+			continue
+		}
+		r.RegisterAction(test.name, "an action", test.params)
+		c.Assert(r.RegisteredActions(), jc.DeepEquals, map[string]charm.ActionSpec{
+			test.name: test.expect,
+		})
+	}
+}
+
+func (s *HookSuite) TestRegisterSameNameDifferentAction(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterAction("foo", "an action", nil)
+	// Check that it's OK to register again with the same details.
+	r.RegisterAction("foo", "an action", nil)
+
+	c.Assert(func() {
+		r.RegisterAction("foo", "another action", nil)
+	}, gc.PanicMatches, `action "foo" is already registered with different details .*`)
+}
+
+func (s *HookSuite) TestActionHookNotRegisteredAsHook(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterHook("install", func() error { return nil })
+	r.RegisterHook("foo-action", func() error { return nil })
+	c.Assert(r.RegisteredHooks(), gc.DeepEquals, []string{"install"})
+}
+
+func (s *HookSuite) TestActionParams(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "foo-action")
+	defer ctxt.Close()
+	var params struct {
+		ActionParam string `json:"actionParam"`
+	}
+	err := ctxt.ActionParams(&params)
+	c.Assert(err, gc.IsNil)
+	c.Assert(params.ActionParam, gc.Equals, "something")
+}
+
+func (s *HookSuite) TestIsLeader(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "leader-elected")
+	defer ctxt.Close()
+
+	isLeader, err := ctxt.IsLeader()
+	c.Assert(err, gc.IsNil)
+	c.Assert(isLeader, gc.Equals, false)
+
+	s.srvCtxt.isLeader = true
+	isLeader, err = ctxt.IsLeader()
+	c.Assert(err, gc.IsNil)
+	c.Assert(isLeader, gc.Equals, true)
+}
+
+func (s *HookSuite) TestSetAppRelationWhenNotLeader(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "peer0-relation-changed")
+	defer ctxt.Close()
+
+	err := ctxt.SetAppRelation("foo", "bar")
+	c.Assert(errgo.Cause(err), gc.Equals, hook.ErrNotLeader)
+	c.Assert(err, gc.ErrorMatches, `cannot set application settings on relation peer0:0: unit is not the leader`)
+}
+
+func (s *HookSuite) TestLeaderSettings(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	ctxt := s.newContext(c, "leader-elected")
+	defer ctxt.Close()
+
+	err := ctxt.LeaderSet(map[string]string{"foo": "bar"})
+	c.Assert(err, gc.ErrorMatches, "cannot set leadership settings: .*")
+
+	s.srvCtxt.isLeader = true
+	err = ctxt.LeaderSet(map[string]string{
+		"foo": "bar",
+		"baz": "arble",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.srvCtxt.leaderSettings, jc.DeepEquals, map[string]string{
+		"foo": "bar",
+		"baz": "arble",
+	})
+
+	val, err := ctxt.LeaderGet("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(val, gc.Equals, "bar")
+
+	// Setting a value to the empty string removes it.
+	err = ctxt.LeaderSet(map[string]string{"foo": ""})
+	c.Assert(err, gc.IsNil)
+	val, err = ctxt.LeaderGet("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(val, gc.Equals, "")
+}
+
+type configStruct struct {
+	Monsters  bool    `config:"monsters" description:"Whether there are monsters"`
+	Title     string  `config:"title" description:"The title" default:"Untitled"`
+	Count     int     `config:"red-balloon-count" type:"int" default:"99"`
+	Splines   float64 `config:"spline-reticulation" default:"0.5"`
+	Unset     string  `config:"unset"`
+	NotConfig string
+}
+
+func (s *HookSuite) TestRegisterConfigStruct(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterConfigStruct(&configStruct{})
+	c.Assert(r.RegisteredConfig(), jc.DeepEquals, map[string]charm.Option{
+		"monsters": {
+			Type:        "boolean",
+			Description: "Whether there are monsters",
+		},
+		"title": {
+			Type:        "string",
+			Description: "The title",
+			Default:     "Untitled",
+		},
+		"red-balloon-count": {
+			Type:    "int",
+			Default: 99,
+		},
+		"spline-reticulation": {
+			Type:    "float",
+			Default: 0.5,
+		},
+		"unset": {
+			Type: "string",
+		},
+	})
+}
+
+var registerConfigStructErrorTests = []struct {
+	about       string
+	cfg         interface{}
+	expectPanic string
+}{{
+	about:       "not a pointer",
+	cfg:         configStruct{},
+	expectPanic: `configuration value is not pointer to struct but type hook_test.configStruct`,
+}, {
+	about: "unsupported field type",
+	cfg: &struct {
+		X []string `config:"x"`
+	}{},
+	expectPanic: `invalid configuration struct .*: field X has unsupported type \[\]string`,
+}, {
+	about: "incompatible type tag",
+	cfg: &struct {
+		X string `config:"x" type:"int"`
+	}{},
+	expectPanic: `invalid configuration struct .*: field X has type string, incompatible with option type "int"`,
+}, {
+	about: "bad default",
+	cfg: &struct {
+		X int `config:"x" default:"foo"`
+	}{},
+	expectPanic: `invalid configuration struct .*: invalid default value for field X: .*`,
+}, {
+	about: "duplicate name",
+	cfg: &struct {
+		X int `config:"x"`
+		Y int `config:"x"`
+	}{},
+	expectPanic: `invalid configuration struct .*: duplicate option name "x"`,
+}}
+
+func (s *HookSuite) TestRegisterConfigStructError(c *gc.C) {
+	for i, test := range registerConfigStructErrorTests {
+		c.Logf("%d: %s", i, test.about)
+		r := hook.NewRegistry()
+		c.Assert(func() {
+			r.RegisterConfigStruct(test.cfg)
+		}, gc.PanicMatches, test.expectPanic)
+	}
+}
+
+func (s *HookSuite) TestConfigStructFilledBeforeHooks(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	r := hook.NewRegistry()
+	registerDefaultRelations(r)
+	var cfg configStruct
+	r.RegisterConfigStruct(&cfg)
+	called := false
+	r.RegisterHook("config-changed", func() error {
+		c.Check(cfg, jc.DeepEquals, configStruct{
+			Monsters: true,
+			Title:    "My Title",
+			Count:    99,
+			Splines:  45,
+		})
+		called = true
+		return nil
+	})
+	err := s.runMain(c, r, "config-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, gc.Equals, true)
+}
+
+var configRuleTests = []struct {
+	about       string
+	rule        hook.ConfigRule
+	config      map[string]interface{}
+	expectError string
+}{{
+	about:  "min ok",
+	rule:   hook.ConfigMin(1),
+	config: map[string]interface{}{"x": 1.0},
+}, {
+	about:       "min fail",
+	rule:        hook.ConfigMin(1),
+	config:      map[string]interface{}{"x": 0.0},
+	expectError: `0 is less than minimum 1`,
 }, {
-	about: "no interface name",
-	rel: charm.Relation{
-		Name:     "foo",
-		Role:     charm.RoleProvider,
-		Limit:    2,
-		Scope:    charm.ScopeContainer,
-		Optional: true,
-	},
-	expectPanic: "no interface name given in .*",
+	about:  "min unset",
+	rule:   hook.ConfigMin(1),
+	config: map[string]interface{}{},
 }, {
-	about: "no role",
-	rel: charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Limit:     2,
-		Scope:     charm.ScopeContainer,
-		Optional:  true,
-	},
-	expectPanic: "no role given in .*",
+	about:       "min not a number",
+	rule:        hook.ConfigMin(1),
+	config:      map[string]interface{}{"x": "foo"},
+	expectError: `foo is not a number`,
+}, {
+	about:  "max ok",
+	rule:   hook.ConfigMax(10),
+	config: map[string]interface{}{"x": 10.0},
+}, {
+	about:       "max fail",
+	rule:        hook.ConfigMax(10),
+	config:      map[string]interface{}{"x": 10.5},
+	expectError: `10.5 is greater than maximum 10`,
+}, {
+	about:  "enum ok",
+	rule:   hook.ConfigEnum("a", "b"),
+	config: map[string]interface{}{"x": "b"},
+}, {
+	about:  "enum empty",
+	rule:   hook.ConfigEnum("a", "b"),
+	config: map[string]interface{}{"x": ""},
+}, {
+	about:       "enum fail",
+	rule:        hook.ConfigEnum("a", "b"),
+	config:      map[string]interface{}{"x": "c"},
+	expectError: `"c" is not one of \["a" "b"\]`,
+}, {
+	about:  "pattern ok",
+	rule:   hook.ConfigPattern("[a-z]+"),
+	config: map[string]interface{}{"x": "abc"},
+}, {
+	about:       "pattern is anchored",
+	rule:        hook.ConfigPattern("[a-z]+"),
+	config:      map[string]interface{}{"x": "abc1"},
+	expectError: `"abc1" does not match pattern "\[a-z\]\+"`,
+}, {
+	about:  "required-if other unset",
+	rule:   hook.ConfigRequiredIf("y"),
+	config: map[string]interface{}{"y": ""},
+}, {
+	about:  "required-if both set",
+	rule:   hook.ConfigRequiredIf("y"),
+	config: map[string]interface{}{"x": "a", "y": "b"},
+}, {
+	about:       "required-if fail",
+	rule:        hook.ConfigRequiredIf("y"),
+	config:      map[string]interface{}{"y": "b"},
+	expectError: `must be set when "y" is set`,
 }}
 
-func (s *HookSuite) TestRegisterRelation(c *gc.C) {
-	all := hook.NewRegistry()
-	allExpect := make(map[string]charm.Relation)
-	for i, test := range registerRelationTests {
+func (s *HookSuite) TestConfigRules(c *gc.C) {
+	for i, test := range configRuleTests {
 		c.Logf("%d: %s", i, test.about)
-		r := hook.NewRegistry()
-		if test.expectPanic != "" {
-			c.Assert(func() { r.RegisterRelation(test.rel) }, gc.PanicMatches, test.expectPanic)
+		err := test.rule("x", test.config)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
 		} else {
-			r.RegisterRelation(test.rel)
-			c.Assert(r.RegisteredRelations(), jc.DeepEquals, map[string]charm.Relation{
-				test.rel.Name: test.expect,
-			})
-			rel := test.rel
-			rel.Name = fmt.Sprintf("%s%d", test.rel.Name, i)
-			all.RegisterRelation(rel)
-			expect := test.expect
-			expect.Name = rel.Name
-			allExpect[expect.Name] = expect
+			c.Assert(err, gc.IsNil)
 		}
 	}
-	c.Assert(all.RegisteredRelations(), jc.DeepEquals, allExpect)
 }
 
-func (s *HookSuite) TestRegisterSameNameDifferentRelation(c *gc.C) {
+func (s *HookSuite) TestInvalidConfigSetsBlockedStatus(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
 	r := hook.NewRegistry()
-	rel := charm.Relation{
-		Name:      "foo",
-		Interface: "bar",
-		Role:      charm.RoleRequirer,
+	registerDefaultRelations(r)
+	r.RegisterConfigRule("red-balloon-count", hook.ConfigMax(50))
+	r.RegisterHook("config-changed", func() error {
+		c.Errorf("hook function called unexpectedly")
+		return nil
+	})
+	err := s.runMain(c, r, "config-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.srvCtxt.status, gc.DeepEquals, jujuc.StatusInfo{
+		Status: "blocked",
+		Info:   `invalid configuration: option "red-balloon-count": 99 is greater than maximum 50`,
+	})
+}
+
+func (s *HookSuite) TestInvalidConfigSkipsOnlyRegistryHooks(c *gc.C) {
+	var called []string
+	record := func(name string) func() error {
+		return func() error {
+			called = append(called, name)
+			return nil
+		}
 	}
-	r.RegisterRelation(rel)
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterHook("install", record("root install"))
+			r.RegisterHook("config-changed", record("root config-changed"))
+			sub := r.Clone("sub")
+			sub.RegisterConfig("port", charm.Option{
+				Type: "int",
+			})
+			sub.RegisterConfigRule("port", hook.ConfigMax(65535))
+			sub.RegisterHook("install", record("sub install"))
+			sub.RegisterHook("config-changed", record("sub config-changed"))
+			sub.Clone("inner").RegisterHook("config-changed", record("inner config-changed"))
+		},
+		Config: map[string]interface{}{
+			"port": 99999,
+		},
+		HookStateDir: "/dev/null",
+		Logger:       c,
+	}
+	// The install hook runs even though the configuration is invalid.
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.DeepEquals, []string{"root install", "sub install"})
+	c.Assert(runner.Status.Status, gc.Equals, hook.StatusBlocked)
 
-	// Check that it's OK to register again with the same relation.
-	r.RegisterRelation(rel)
+	// Only the functions registered with the registry
+	// that registered the failing rule and its clones
+	// are skipped.
+	called = nil
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.DeepEquals, []string{"root config-changed"})
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusBlocked,
+		Message: `invalid configuration: option "port": 99999 is greater than maximum 65535`,
+	})
 
-	// Check that it panics when something changes.
-	rel.Interface = "baz"
-	c.Assert(func() {
-		r.RegisterRelation(rel)
-	}, gc.PanicMatches, `relation "foo" is already registered with different details .*`)
+	// When the configuration becomes valid, they run again.
+	called = nil
+	runner.Config["port"] = 8080
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.DeepEquals, []string{"root config-changed", "sub config-changed", "inner config-changed"})
 }
 
-func (s *HookSuite) TestRegisterConfig(c *gc.C) {
+func (s *HookSuite) TestValidConfigRestoresStatus(c *gc.C) {
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterConfig("port", charm.Option{
+				Type: "int",
+			})
+			r.RegisterConfigRule("port", hook.ConfigMax(65535))
+			r.RegisterHook("config-changed", func() error {
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"port": 99999,
+		},
+		Status: hook.StatusInfo{
+			Status:  hook.StatusWaiting,
+			Message: "waiting for database",
+		},
+		HookStateDir: "/dev/null",
+		Logger:       c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Status.Status, gc.Equals, hook.StatusBlocked)
+
+	// The status is saved only once while the
+	// configuration remains invalid.
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Status.Status, gc.Equals, hook.StatusBlocked)
+
+	runner.Config["port"] = 8080
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Status, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusWaiting,
+		Message: "waiting for database",
+	})
+}
+
+func (s *HookSuite) TestConfigChanges(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
 	r := hook.NewRegistry()
-	opt0 := charm.Option{
-		Type:        "string",
-		Description: "d",
-		Default:     134,
+	r.RegisterConfig("title", charm.Option{
+		Type: "string",
+	})
+	var ctxt *hook.Context
+	r.RegisterContext(func(hctxt *hook.Context) error {
+		ctxt = hctxt
+		return nil
+	}, nil)
+	fail := true
+	var changed, titleChanged bool
+	var changes map[string]hook.ConfigChange
+	r.RegisterHook("config-changed", func() error {
+		changed = ctxt.ConfigChanged()
+		titleChanged = ctxt.ConfigChanged("title", "other")
+		changes = ctxt.ConfigChanges()
+		if fail {
+			return errgo.New("hook failed")
+		}
+		return nil
+	})
+	expectChanges := map[string]hook.ConfigChange{
+		"monsters":            {New: true},
+		"spline-reticulation": {New: 45.0},
+		"red-balloon-count":   {New: 99.0},
+		"title":               {New: "My Title"},
+		"username":            {New: "admin001"},
 	}
-	r.RegisterConfig("opt0", opt0)
-	// Check that it's OK to register again with the same option.
-	r.RegisterConfig("opt0", opt0)
 
-	opt1 := opt0
-	opt1.Default = 135
-	c.Assert(func() {
-		r.RegisterConfig("opt0", opt1)
-	}, gc.PanicMatches, `configuration option "opt0" is already registered with different details .*`)
+	// The first time the hook runs, everything has changed.
+	err := s.runMain(c, r, "config-changed")
+	c.Assert(err, gc.ErrorMatches, "config-changed hook failed in root on unit local/55: hook failed")
+	c.Assert(changed, jc.IsTrue)
+	c.Assert(titleChanged, jc.IsTrue)
+	c.Assert(changes, jc.DeepEquals, expectChanges)
+
+	// The hook failed, so the changes are still
+	// reported when it is retried.
+	fail = false
+	err = s.runMain(c, r, "config-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(changed, jc.IsTrue)
+	c.Assert(titleChanged, jc.IsTrue)
+	c.Assert(changes, jc.DeepEquals, expectChanges)
 
-	r.RegisterConfig("opt1", opt1)
+	// The hook succeeded, so now nothing has changed.
+	err = s.runMain(c, r, "config-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(changed, jc.IsFalse)
+	c.Assert(titleChanged, jc.IsFalse)
+	c.Assert(changes, gc.HasLen, 0)
+}
 
-	c.Assert(r.RegisteredConfig(), jc.DeepEquals, map[string]charm.Option{
-		"opt0": opt0,
-		"opt1": opt1,
+func (s *HookSuite) TestConfigChangedWithoutRegisteredConfig(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	r := hook.NewRegistry()
+	var ctxt *hook.Context
+	r.RegisterContext(func(hctxt *hook.Context) error {
+		ctxt = hctxt
+		return nil
+	}, nil)
+	r.RegisterHook("config-changed", func() error {
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		err := s.runMain(c, r, "config-changed")
+		c.Assert(err, gc.IsNil)
+		c.Assert(ctxt.ConfigChanged(), jc.IsTrue)
+		c.Assert(ctxt.ConfigChanges(), gc.IsNil)
+	}
+}
+
+func (s *HookSuite) TestRelationDeltas(c *gc.C) {
+	s.StartServer(c, 0, "peer0/0")
+	r := hook.NewRegistry()
+	registerDefaultRelations(r)
+	r.SetLazyRelations()
+	var ctxt *hook.Context
+	r.RegisterContext(func(hctxt *hook.Context) error {
+		ctxt = hctxt
+		return nil
+	}, nil)
+	var peer0, peer1 map[hook.RelationId]hook.RelationDelta
+	r.RegisterHook("peer0-relation-changed", func() error {
+		peer0 = ctxt.RelationDeltas("peer0")
+		peer1 = ctxt.RelationDeltas("peer1")
+		return nil
+	})
+	r.RegisterHook("config-changed", func() error {
+		return nil
+	})
+
+	// The first time the hook runs, all units have joined.
+	err := s.runMain(c, r, "peer0-relation-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer0, jc.DeepEquals, map[hook.RelationId]hook.RelationDelta{
+		"peer0:0": {
+			Joined: []hook.UnitId{"peer0/0", "peer0/1"},
+			Changed: map[hook.UnitId]hook.SettingsDelta{
+				"peer0/0": {
+					Added: map[string]string{"private-address": "peer0-0.example.com"},
+				},
+				"peer0/1": {
+					Added: map[string]string{"private-address": "peer0-1.example.com"},
+				},
+			},
+		},
+	})
+	c.Assert(peer1, gc.HasLen, 1)
+
+	// Nothing has changed since the last hook.
+	err = s.runMain(c, r, "peer0-relation-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer0, gc.HasLen, 0)
+	c.Assert(peer1, gc.HasLen, 0)
+
+	units := s.srvCtxt.rels[0].units
+	units["peer0/0"] = Settings{
+		"private-address": "peer0-0.other.com",
+		"foo":             "bar",
+	}
+	units["peer0/2"] = Settings{}
+	delete(units, "peer0/1")
+
+	// With lazy relation loading, a hook that does not
+	// look at the relations does not consume the changes.
+	err = s.runMain(c, r, "config-changed")
+	c.Assert(err, gc.IsNil)
+
+	err = s.runMain(c, r, "peer0-relation-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer0, jc.DeepEquals, map[hook.RelationId]hook.RelationDelta{
+		"peer0:0": {
+			Joined:   []hook.UnitId{"peer0/2"},
+			Departed: []hook.UnitId{"peer0/1"},
+			Changed: map[hook.UnitId]hook.SettingsDelta{
+				"peer0/0": {
+					Added:   map[string]string{"foo": "bar"},
+					Changed: map[string]string{"private-address": "peer0-0.other.com"},
+				},
+			},
+		},
+	})
+	c.Assert(peer1, gc.HasLen, 0)
+
+	units["peer0/0"] = Settings{
+		"private-address": "peer0-0.other.com",
+	}
+	err = s.runMain(c, r, "peer0-relation-changed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer0, jc.DeepEquals, map[hook.RelationId]hook.RelationDelta{
+		"peer0:0": {
+			Changed: map[hook.UnitId]hook.SettingsDelta{
+				"peer0/0": {
+					Removed: []string{"foo"},
+				},
+			},
+		},
 	})
 }
 
@@ -701,6 +2530,209 @@ func (s *HookSuite) TestRunUnimplementedCommand(c *gc.C) {
 	c.Assert(errgo.Cause(err), gc.Equals, hook.ErrUnimplemented)
 }
 
+func (s *HookSuite) TestToolCaching(c *gc.C) {
+	runner := &countingRunner{
+		outputs: map[string]string{
+			"config-get":   `{"a": "x", "b": 99}`,
+			"unit-get":     `"10.0.0.1"`,
+			"relation-get": `{"foo": "bar"}`,
+		},
+	}
+	ctxt := &hook.Context{
+		Runner: hook.NewCachingToolRunner(runner),
+	}
+	a, err := ctxt.GetConfigString("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(a, gc.Equals, "x")
+	b, err := ctxt.GetConfigInt("b")
+	c.Assert(err, gc.IsNil)
+	c.Assert(b, gc.Equals, 99)
+	missing, err := ctxt.GetConfigString("missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(missing, gc.Equals, "")
+	for i := 0; i < 2; i++ {
+		_, err = ctxt.PrivateAddress()
+		c.Assert(err, gc.IsNil)
+		_, err = ctxt.PublicAddress()
+		c.Assert(err, gc.IsNil)
+	}
+	_, err = ctxt.Runner.Run("relation-get", "-r", "peer0:0", "--format", "json", "--", "-", "peer0/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.calls, jc.DeepEquals, []string{
+		"config-get",
+		"unit-get",
+		"unit-get",
+		"relation-get",
+	})
+
+	// Changing the output returned by the runner
+	// does not change the cached output.
+	out, err := ctxt.Runner.Run("unit-get", "private-address")
+	c.Assert(err, gc.IsNil)
+	out[1] = 'X'
+	out, err = ctxt.Runner.Run("unit-get", "private-address")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(out), gc.Equals, `"10.0.0.1"`)
+
+	// Logging does not invalidate anything.
+	runner.calls = nil
+	err = ctxt.Logf("hello")
+	c.Assert(err, gc.IsNil)
+	_, err = ctxt.PrivateAddress()
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.calls, jc.DeepEquals, []string{"juju-log"})
+
+	// Setting relation values invalidates only the relation settings.
+	runner.calls = nil
+	err = ctxt.SetRelationWithId("peer0:0", "foo", "baz")
+	c.Assert(err, gc.IsNil)
+	_, err = ctxt.Runner.Run("relation-get", "-r", "peer0:0", "--format", "json", "--", "-", "peer0/0")
+	c.Assert(err, gc.IsNil)
+	_, err = ctxt.GetConfigString("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.calls, jc.DeepEquals, []string{"relation-set", "relation-get"})
+
+	// An unknown tool invalidates everything.
+	runner.calls = nil
+	_, err = ctxt.Runner.Run("some-tool")
+	c.Assert(err, gc.IsNil)
+	_, err = ctxt.GetConfigString("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.calls, jc.DeepEquals, []string{"some-tool", "config-get"})
+
+	// Errors are not cached.
+	runner.calls = nil
+	_, err = ctxt.Runner.Run("storage-list", "data")
+	c.Assert(err, gc.ErrorMatches, "no output for storage-list")
+	_, err = ctxt.Runner.Run("storage-list", "data")
+	c.Assert(err, gc.ErrorMatches, "no output for storage-list")
+	c.Assert(runner.calls, jc.DeepEquals, []string{"storage-list", "storage-list"})
+}
+
+func (s *HookSuite) TestSetRelationWritesOnlyChanges(c *gc.C) {
+	r := hook.NewRegistry()
+	registerDefaultRelations(r)
+	var ctxt *hook.Context
+	r.RegisterContext(func(hctxt *hook.Context) error {
+		ctxt = hctxt
+		return nil
+	}, nil)
+	var setRelation func() error
+	r.RegisterHook("config-changed", func() error {
+		return setRelation()
+	})
+	state := hook.NewDiskState(c.MkDir())
+	runner := &countingRunner{}
+	run := func(f func() error) [][]string {
+		setRelation = f
+		runner.record = nil
+		_, err := hook.Main(r, &hook.Context{
+			HookName: "config-changed",
+			Runner:   runner,
+		}, state)
+		c.Assert(err, gc.IsNil)
+		var sets [][]string
+		for _, args := range runner.record {
+			if args[0] == "relation-set" {
+				sets = append(sets, args[1:])
+			}
+		}
+		return sets
+	}
+	sets := run(func() error {
+		return ctxt.SetRelationWithId("peer0:0", "a", "1", "b", "2")
+	})
+	c.Assert(sets, jc.DeepEquals, [][]string{{"-r", "peer0:0", "--", "a=1", "b=2"}})
+
+	sets = run(func() error {
+		return ctxt.SetRelationWithId("peer0:0", "a", "1", "b", "2")
+	})
+	c.Assert(sets, gc.HasLen, 0)
+
+	sets = run(func() error {
+		return ctxt.SetRelationWithId("peer0:0", "a", "1", "b", "")
+	})
+	c.Assert(sets, jc.DeepEquals, [][]string{{"-r", "peer0:0", "--", "b="}})
+
+	sets = run(func() error {
+		return ctxt.SetRelationWithId("peer0:0", "b", "")
+	})
+	c.Assert(sets, gc.HasLen, 0)
+
+	sets = run(func() error {
+		return ctxt.SetRelationSettings("peer0:0", map[string]string{"c": "3"})
+	})
+	c.Assert(sets, jc.DeepEquals, [][]string{{"-r", "peer0:0", "--", "a=", "c=3"}})
+
+	// Settings are not recorded when the hook fails.
+	setRelation = func() error {
+		err := ctxt.SetRelationWithId("peer0:0", "c", "4")
+		c.Assert(err, gc.IsNil)
+		return errgo.New("failure")
+	}
+	_, err := hook.Main(r, &hook.Context{
+		HookName: "config-changed",
+		Runner:   runner,
+	}, state)
+	c.Assert(err, gc.ErrorMatches, "config-changed hook failed in root: failure")
+	sets = run(func() error {
+		return ctxt.SetRelationWithId("peer0:0", "c", "4")
+	})
+	c.Assert(sets, jc.DeepEquals, [][]string{{"-r", "peer0:0", "--", "c=4"}})
+}
+
+func (s *HookSuite) TestSetAppRelationSettingsAfterLeadershipChange(c *gc.C) {
+	var ctxt *hook.Context
+	settings := map[string]string{"a": "1"}
+	setSettings := func() error {
+		err := ctxt.SetAppRelationSettings("peer0:0", settings)
+		return errgo.Mask(err, errgo.Is(hook.ErrNotLeader))
+	}
+	runner := &hooktest.Runner{
+		RegisterHooks: func(r *hook.Registry) {
+			registerDefaultRelations(r)
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("leader-elected", setSettings)
+			r.RegisterHook("config-changed", func() error {
+				if err := setSettings(); errgo.Cause(err) != hook.ErrNotLeader {
+					return err
+				}
+				return nil
+			})
+		},
+		IsLeader:     true,
+		HookStateDir: "/dev/null",
+		Logger:       c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LocalAppRelations["peer0:0"], jc.DeepEquals, map[string]string{"a": "1"})
+
+	// Another unit becomes the leader and changes the settings.
+	runner.IsLeader = false
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	runner.LocalAppRelations["peer0:0"] = map[string]string{"a": "2", "b": "x"}
+
+	// When the local unit becomes the leader again,
+	// all its settings are written.
+	runner.IsLeader = true
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LocalAppRelations["peer0:0"], jc.DeepEquals, map[string]string{"a": "1", "b": "x"})
+
+	// The settings are also written in full after
+	// leader-elected even if no other hook has run
+	// while the local unit was not the leader.
+	runner.LocalAppRelations["peer0:0"] = map[string]string{"a": "3"}
+	err = runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LocalAppRelations["peer0:0"], jc.DeepEquals, map[string]string{"a": "1"})
+}
+
 func (s *HookSuite) TestCommandCall(c *gc.C) {
 	s.StartServer(c, 0, "peer0/0")
 
@@ -793,17 +2825,31 @@ func (s *HookSuite) TestLongRunningCommand(c *gc.C) {
 }
 
 var validHookNameTests = map[string]bool{
-	"config-changed":        true,
-	"changed-config":        false,
-	"install":               true,
-	"relation-changed":      false,
-	"foo-relation-changed":  true,
-	"relation-foo-changed":  false,
-	"foo0-relation-changed": true,
-	"-relation-changed":     false,
-	"foo-xrelation-changed": false,
-	"foo-relation-changedx": false,
-	"foo-relation-departed": true,
+	"config-changed":          true,
+	"changed-config":          false,
+	"install":                 true,
+	"relation-changed":        false,
+	"foo-relation-changed":    true,
+	"relation-foo-changed":    false,
+	"foo0-relation-changed":   true,
+	"-relation-changed":       false,
+	"foo-xrelation-changed":   false,
+	"foo-relation-changedx":   false,
+	"foo-relation-departed":   true,
+	"foo-action":              true,
+	"foo-bar-action":          true,
+	"-action":                 false,
+	"Foo-action":              false,
+	"leader-elected":          true,
+	"leader-deposed":          true,
+	"leader-settings-changed": true,
+	"foo-leader-elected":      false,
+	"data-storage-attached":   true,
+	"data-storage-detaching":  true,
+	"data-0-storage-attached": false,
+	"storage-attached":        false,
+	"-storage-attached":       false,
+	"data-storage-foo":        false,
 }
 
 func (s *HookSuite) TestValidHookName(c *gc.C) {
@@ -959,6 +3005,30 @@ func registerSimpleHook(r *hook.Registry, hookName string, hookFunc func(ctxt *h
 	})
 }
 
+// countingRunner is a ToolRunner that records
+// the tools that are run.
+type countingRunner struct {
+	outputs map[string]string
+	calls   []string
+	record  [][]string
+}
+
+func (r *countingRunner) Run(cmd string, args ...string) (stdout []byte, err error) {
+	r.calls = append(r.calls, cmd)
+	r.record = append(r.record, append([]string{cmd}, args...))
+	if out, ok := r.outputs[cmd]; ok {
+		return []byte(out), nil
+	}
+	if strings.HasSuffix(cmd, "-get") || strings.HasSuffix(cmd, "-list") {
+		return nil, errgo.Newf("no output for %s", cmd)
+	}
+	return nil, nil
+}
+
+func (r *countingRunner) Close() error {
+	return nil
+}
+
 type nopRunner struct{}
 
 func (nopRunner) Run(cmd string, args ...string) (stdout []byte, err error) {
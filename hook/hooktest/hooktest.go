@@ -3,6 +3,12 @@ package hooktest
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 
 	"gopkg.in/errgo.v1"
@@ -20,19 +26,113 @@ import (
 // Any calls to juju-log are logged using Logger, but otherwise ignored.
 // Calls to config-get from the Config field and not invoked through RunFunc.
 // Likewise, calls to unit-get will be satisfied from the PublicAddress
-// and PrivateAddress fields.
+// and PrivateAddress fields, and calls to action-get will be
+// satisfied from the ActionParams field.
+//
+// Leadership is simulated with the IsLeader and LeaderSettings fields:
+// calls to is-leader and leader-get are satisfied from them, and
+// calls to leader-set update LeaderSettings, failing if
+// IsLeader is false.
+//
+// Calls to state-get, state-set and state-delete read
+// and update the UnitState field.
+//
+// Calls to secret-get, secret-info-get, secret-add and secret-set
+// read and update the Secrets field. Secrets can only be
+// referred to by label; the id of each secret is its label
+// with a "secret:" prefix. The content of a secret must be
+// passed with the --file flag in a file that is not accessible
+// by other users; the values must not appear in the arguments.
+//
+// Calls to storage-get and storage-list are satisfied
+// from the Storage field, and calls to resource-get
+// from the Resources field.
+//
+// Calls to network-get are satisfied from the Networks field.
+// If there is no entry for the requested binding, the returned
+// network information will use PrivateAddress.
+//
+// Calls to status-set, status-get and application-version-set
+// update and read the Status, ApplicationStatus and WorkloadVersion
+// fields. Setting the application status fails if IsLeader is false.
+// The calls are still recorded in the Record field, and status-set
+// and application-version-set are also passed to RunFunc.
+//
+// Calls to relation-set with the --app flag update the
+// LocalAppRelations field, failing if IsLeader is false.
 type Runner struct {
 	RegisterHooks func(r *hook.Registry)
 
+	// Unit holds the id of the local unit.
+	// If it is empty, "someunit/0" will be used.
+	Unit hook.UnitId
+
 	// The following fields hold information that will
 	// be available through the hook context.
 	Relations   map[hook.RelationId]map[hook.UnitId]map[string]string
 	RelationIds map[string][]hook.RelationId
 	Config      map[string]interface{}
 
+	// AppRelations holds the application-level settings of
+	// the remote application for each relation id.
+	AppRelations map[hook.RelationId]map[string]string
+
+	// LocalAppRelations holds the application-level settings
+	// of the local application for each relation id.
+	// It is updated when the charm calls relation-set
+	// with the --app flag.
+	LocalAppRelations map[hook.RelationId]map[string]string
+
+	// ActionParams holds the parameters of the currently
+	// running action.
+	ActionParams map[string]interface{}
+
+	// IsLeader holds whether the unit is currently
+	// the service leader.
+	IsLeader bool
+
+	// LeaderSettings holds the current leadership settings.
+	// It is updated when the charm calls leader-set.
+	LeaderSettings map[string]string
+
+	// UnitState holds the unit state stored in
+	// the controller. It is updated when the charm
+	// calls state-set or state-delete.
+	UnitState map[string]string
+
+	// Secrets holds the content of the secrets owned by the
+	// unit, keyed by label. It is updated when the charm
+	// calls secret-add or secret-set.
+	Secrets map[string]map[string]string
+
+	// Storage holds the storage instances that are
+	// currently attached to the unit.
+	Storage map[hook.StorageId]hook.StorageInstance
+
+	// StorageId holds the id of the storage instance
+	// that a storage hook will be run for.
+	StorageId hook.StorageId
+
+	// Status holds the current unit status.
+	Status hook.StatusInfo
+
+	// ApplicationStatus holds the current application status.
+	ApplicationStatus hook.StatusInfo
+
+	// WorkloadVersion holds the current workload version.
+	WorkloadVersion string
+
+	// Resources maps from resource name to the path
+	// of a local file holding the resource's contents.
+	Resources map[string]string
+
 	PublicAddress  string
 	PrivateAddress string
 
+	// Networks holds the network information for
+	// each endpoint binding, keyed by binding name.
+	Networks map[string]hook.NetworkInfo
+
 	// HookStateDir holds the directory in which state
 	// other than hook state will be stored (for instance,
 	// this is used by the service package to store service
@@ -52,6 +152,10 @@ type Runner struct {
 
 	// Logger should be set to a logger. The Logf method
 	// will be called when the charm generates log messages.
+	// If the logger also has an Errorf method (as *testing.T
+	// and *gocheck.C do), it will be called to report a test
+	// failure, including the stack trace, when a hook function,
+	// context setter or command panics.
 	Logger interface {
 		Logf(string, ...interface{})
 	}
@@ -72,12 +176,16 @@ func (runner *Runner) RunHook(hookName string, relId hook.RelationId, relUnit ho
 	if runner.State == nil {
 		runner.State = make(MemState)
 	}
+	unit := runner.Unit
+	if unit == "" {
+		unit = "someunit/0"
+	}
 	r := hook.NewRegistry()
 	runner.RegisterHooks(r)
 	hook.RegisterMainHooks(r)
 	hctxt := &hook.Context{
 		UUID:         UUID,
-		Unit:         "someunit/0",
+		Unit:         unit,
 		CharmDir:     "/dev/null",
 		HookStateDir: runner.HookStateDir,
 
@@ -85,6 +193,11 @@ func (runner *Runner) RunHook(hookName string, relId hook.RelationId, relUnit ho
 		Runner:      runner,
 		Relations:   runner.Relations,
 		RelationIds: runner.RelationIds,
+
+		AppRelations: runner.AppRelations,
+	}
+	if strings.HasSuffix(hookName, "-storage-attached") || strings.HasSuffix(hookName, "-storage-detaching") {
+		hctxt.StorageId = runner.StorageId
 	}
 	if relId != "" {
 		hctxt.RelationId = relId
@@ -106,6 +219,7 @@ func (runner *Runner) RunHook(hookName string, relId hook.RelationId, relUnit ho
 	if c != nil {
 		panic(errgo.Newf("non-command hook returned Command"))
 	}
+	runner.reportPanic(err)
 	return err
 }
 
@@ -122,7 +236,23 @@ func (runner *Runner) RunCommand(cmdName string, args []string) (hook.Command, e
 		RunCommandName: strings.TrimPrefix(cmdName, "cmd-"),
 		RunCommandArgs: args,
 	}
-	return hook.Main(r, hctxt, nil)
+	cmd, err := hook.Main(r, hctxt, nil)
+	runner.reportPanic(err)
+	return cmd, err
+}
+
+// reportPanic reports a test failure if the given error
+// was caused by a panic and the logger supports it.
+func (runner *Runner) reportPanic(err error) {
+	perr, ok := errgo.Cause(err).(*hook.PanicError)
+	if !ok {
+		return
+	}
+	if t, ok := runner.Logger.(interface {
+		Errorf(string, ...interface{})
+	}); ok {
+		t.Errorf("%v\n%s", err, perr.Stack)
+	}
 }
 
 // Run implements hook.Runner.Run.
@@ -150,6 +280,244 @@ func (r *Runner) Run(cmd string, args ...string) ([]byte, error) {
 			panic(err)
 		}
 		return data, nil
+	case "action-get":
+		// action-get --format json
+		data, err := json.Marshal(r.ActionParams)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "is-leader":
+		// is-leader --format json
+		data, err := json.Marshal(r.IsLeader)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "leader-get":
+		// leader-get --format json -- key
+		if len(args) != 4 {
+			panic("expected exactly one key argument to leader-get")
+		}
+		data, err := json.Marshal(r.LeaderSettings[args[3]])
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "leader-set":
+		// leader-set -- key=value...
+		if !r.IsLeader {
+			return nil, errgo.New("cannot write leadership settings: not the leader")
+		}
+		if r.LeaderSettings == nil {
+			r.LeaderSettings = make(map[string]string)
+		}
+		for _, arg := range args[1:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				panic(errgo.Newf("invalid leader-set argument %q", arg))
+			}
+			if kv[1] == "" {
+				delete(r.LeaderSettings, kv[0])
+			} else {
+				r.LeaderSettings[kv[0]] = kv[1]
+			}
+		}
+		return nil, nil
+	case "state-get":
+		// state-get --format json -- key
+		if len(args) != 4 {
+			panic("expected exactly one key argument to state-get")
+		}
+		data, err := json.Marshal(r.UnitState[args[3]])
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "state-set":
+		// state-set -- key=value...
+		if r.UnitState == nil {
+			r.UnitState = make(map[string]string)
+		}
+		for _, arg := range args[1:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				panic(errgo.Newf("invalid state-set argument %q", arg))
+			}
+			r.UnitState[kv[0]] = kv[1]
+		}
+		return nil, nil
+	case "state-delete":
+		// state-delete -- key
+		if len(args) != 2 {
+			panic("expected exactly one key argument to state-delete")
+		}
+		delete(r.UnitState, args[1])
+		return nil, nil
+	case "secret-get", "secret-info-get":
+		// secret-get --label label --format json
+		if len(args) != 4 || args[0] != "--label" {
+			panic(errgo.Newf("unexpected arguments to %s: %q", cmd, args))
+		}
+		content, ok := r.Secrets[args[1]]
+		if !ok {
+			return nil, errgo.Newf("secret %q not found", args[1])
+		}
+		var val interface{} = content
+		if cmd == "secret-info-get" {
+			val = map[string]interface{}{
+				"secret:" + args[1]: map[string]string{
+					"label": args[1],
+				},
+			}
+		}
+		data, err := json.Marshal(val)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "secret-add":
+		// secret-add --owner unit --label label --file path
+		if len(args) != 6 || args[2] != "--label" || args[4] != "--file" {
+			panic(errgo.Newf("unexpected arguments to secret-add: %q", args))
+		}
+		if _, ok := r.Secrets[args[3]]; ok {
+			return nil, errgo.Newf("secret with label %q already exists", args[3])
+		}
+		if r.Secrets == nil {
+			r.Secrets = make(map[string]map[string]string)
+		}
+		r.Secrets[args[3]] = secretContent(args[5], args)
+		return []byte("secret:" + args[3]), nil
+	case "secret-set":
+		// secret-set id --file path
+		if len(args) != 3 || args[1] != "--file" {
+			panic(errgo.Newf("unexpected arguments to secret-set: %q", args))
+		}
+		label := strings.TrimPrefix(args[0], "secret:")
+		if _, ok := r.Secrets[label]; !ok {
+			return nil, errgo.Newf("secret %q not found", args[0])
+		}
+		r.Secrets[label] = secretContent(args[2], args)
+		return nil, nil
+	case "relation-set":
+		// relation-set -r id [--app] -- key=value...
+		if len(args) < 3 || args[2] != "--app" {
+			break
+		}
+		if !r.IsLeader {
+			return nil, errgo.New("cannot write application relation settings: not the leader")
+		}
+		id := hook.RelationId(args[1])
+		if r.LocalAppRelations == nil {
+			r.LocalAppRelations = make(map[hook.RelationId]map[string]string)
+		}
+		settings := r.LocalAppRelations[id]
+		if settings == nil {
+			settings = make(map[string]string)
+			r.LocalAppRelations[id] = settings
+		}
+		for _, arg := range args[4:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				panic(errgo.Newf("invalid relation-set argument %q", arg))
+			}
+			if kv[1] == "" {
+				delete(settings, kv[0])
+			} else {
+				settings[kv[0]] = kv[1]
+			}
+		}
+		return nil, nil
+	case "storage-get":
+		// storage-get --format json -s id
+		if len(args) != 4 {
+			panic("expected exactly one storage id argument to storage-get")
+		}
+		st, ok := r.Storage[hook.StorageId(args[3])]
+		if !ok {
+			return nil, errgo.Newf("storage instance %q not found", args[3])
+		}
+		data, err := json.Marshal(st)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "storage-list":
+		// storage-list --format json [name]
+		ids := []hook.StorageId{}
+		for id := range r.Storage {
+			if len(args) < 3 || strings.HasPrefix(string(id), args[2]+"/") {
+				ids = append(ids, id)
+			}
+		}
+		sort.Sort(storageIds(ids))
+		data, err := json.Marshal(ids)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "resource-get":
+		if len(args) != 1 {
+			panic("expected exactly one argument to resource-get")
+		}
+		path, ok := r.Resources[args[0]]
+		if !ok {
+			return nil, errgo.Newf("resource %q not found", args[0])
+		}
+		return []byte(path), nil
+	case "network-get":
+		// network-get --format json binding
+		if len(args) != 3 {
+			panic("expected exactly one binding argument to network-get")
+		}
+		info, ok := r.Networks[args[2]]
+		if !ok {
+			info = hook.NetworkInfo{
+				BindAddresses: []hook.BindAddress{{
+					InterfaceName: "eth0",
+					Addresses: []hook.InterfaceAddress{{
+						Address: r.PrivateAddress,
+					}},
+				}},
+				IngressAddresses: []string{r.PrivateAddress},
+			}
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "status-set":
+		// status-set [--application] status message
+		st, stArgs := &r.Status, args
+		if len(stArgs) > 0 && stArgs[0] == "--application" {
+			if !r.IsLeader {
+				return nil, errgo.New("cannot set application status: not the leader")
+			}
+			st = &r.ApplicationStatus
+			stArgs = stArgs[1:]
+		}
+		if len(stArgs) != 2 {
+			panic("expected status and message arguments to status-set")
+		}
+		*st = hook.StatusInfo{
+			Status:  hook.Status(stArgs[0]),
+			Message: stArgs[1],
+		}
+	case "status-get":
+		// status-get --format json --include-data
+		r.Record = append(r.Record, append([]string{cmd}, args...))
+		data, err := json.Marshal(r.Status)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "application-version-set":
+		if len(args) != 1 {
+			panic("expected exactly one argument to application-version-set")
+		}
+		r.WorkloadVersion = args[0]
 	case "unit-get":
 		if len(args) != 1 {
 			panic("expected exactly one argument to unit-get")
@@ -182,6 +550,12 @@ func (r *Runner) Close() error {
 	return nil
 }
 
+type storageIds []hook.StorageId
+
+func (ids storageIds) Len() int           { return len(ids) }
+func (ids storageIds) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids storageIds) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+
 // MemState implements hook.PersistentState in memory.
 // Each element of the map holds the value key stored in the state.
 type MemState map[string][]byte
@@ -195,5 +569,131 @@ func (s MemState) Load(name string) ([]byte, error) {
 	return s[name], nil
 }
 
+// minSecretCheckLen holds the minimum length of a secret
+// content value that secretContent checks for in the
+// command arguments.
+const minSecretCheckLen = 8
+
+// secretContent returns the secret content held in the given file,
+// which must be accessible only by its owner. It panics if any of
+// the content values of at least minSecretCheckLen bytes can be
+// found in the given command arguments.
+func secretContent(path string, args []string) map[string]string {
+	info, err := os.Stat(path)
+	if err != nil {
+		panic(errgo.Notef(err, "cannot read secret content"))
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		panic(errgo.Newf("secret content file %q is accessible by other users", path))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(errgo.Notef(err, "cannot read secret content"))
+	}
+	// The file is YAML, but we only support the JSON subset.
+	var content map[string]string
+	if err := json.Unmarshal(data, &content); err != nil {
+		panic(errgo.Notef(err, "invalid secret content"))
+	}
+	for _, val := range content {
+		if len(val) < minSecretCheckLen {
+			// Short values are too likely to
+			// match an argument by chance.
+			continue
+		}
+		for _, arg := range args {
+			if strings.Contains(arg, val) {
+				panic(errgo.Newf("secret content found in command arguments %q", args))
+			}
+		}
+	}
+	return content
+}
+
+// CheckNoCleartext checks that none of the given strings can be
+// found in any state saved by the charm: the persistent state in
+// the State field (when it is a MemState), the unit state, the
+// leader settings and any files in the hook state directory.
+// It returns an error describing where any string was found.
+//
+// It is intended to be used to check that charm secrets are
+// stored only in encrypted form; see hook.Registry.SetStateEncryption.
+func (r *Runner) CheckNoCleartext(secrets ...string) error {
+	check := func(data, where string) error {
+		for _, secret := range secrets {
+			if strings.Contains(data, secret) {
+				return errgo.Newf("%q found in cleartext in %s", secret, where)
+			}
+		}
+		return nil
+	}
+	if state, ok := r.State.(MemState); ok {
+		for name, data := range state {
+			if err := check(string(data), fmt.Sprintf("state %q", name)); err != nil {
+				return err
+			}
+		}
+	}
+	for name, data := range r.UnitState {
+		if err := check(data, fmt.Sprintf("unit state %q", name)); err != nil {
+			return err
+		}
+	}
+	for name, data := range r.LeaderSettings {
+		if err := check(data, fmt.Sprintf("leader setting %q", name)); err != nil {
+			return err
+		}
+	}
+	if r.HookStateDir == "" {
+		return nil
+	}
+	err := filepath.Walk(r.HookStateDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return check(string(data), fmt.Sprintf("file %q", path))
+	})
+	return errgo.Mask(err)
+}
+
+// CheckStateMigration checks that state data saved by an earlier
+// version of a charm is migrated correctly by the state migrations
+// registered with hook.Registry.SetStateVersion.
+//
+// The registerHooks function is called to register the charm's
+// hooks. The old argument holds the state data as saved by the
+// registry with the given name (for example "root" or "root.foo"),
+// and want holds the expected state value after migration, which
+// should be of the same type as the value registered with
+// RegisterContext. It returns an error if the migration fails or
+// produces a different value.
+func CheckStateMigration(registerHooks func(r *hook.Registry), registryName string, old []byte, want interface{}) error {
+	r := hook.NewRegistry()
+	registerHooks(r)
+	data, err := r.MigrateState(registryName, old)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	wantv := reflect.ValueOf(want)
+	got := reflect.New(wantv.Type())
+	if err := json.Unmarshal(data, got.Interface()); err != nil {
+		return errgo.Notef(err, "cannot unmarshal migrated state %q", data)
+	}
+	if !reflect.DeepEqual(got.Elem().Interface(), want) {
+		return errgo.Newf("unexpected migrated state; got %#v want %#v", got.Elem().Interface(), want)
+	}
+	return nil
+}
+
 // UUID holds an arbitrary environment UUID for testing purposes.
 const UUID = "373b309b-4a86-4f13-88e2-c213d97075b8"
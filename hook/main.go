@@ -2,8 +2,10 @@ package hook
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
 
@@ -19,6 +21,8 @@ const (
 	envRelationName  = "JUJU_RELATION"
 	envRelationId    = "JUJU_RELATION_ID"
 	envRemoteUnit    = "JUJU_REMOTE_UNIT"
+	envRemoteApp     = "JUJU_REMOTE_APP"
+	envStorageId     = "JUJU_STORAGE_ID"
 	envSocketPath    = "JUJU_AGENT_SOCKET"
 )
 
@@ -58,29 +62,94 @@ func Main(r *Registry, ctxt *Context, state PersistentState) (_ Command, err err
 		if cmd == nil {
 			return nil, usageError(r)
 		}
-		return cmd(ctxt.RunCommandArgs)
+		var hcmd Command
+		err := CallRecovering(ctxt.RunCommandName, func() error {
+			var err error
+			hcmd, err = cmd(ctxt.RunCommandArgs)
+			return err
+		})
+		if stack := panicStack(err); stack != nil {
+			log.Printf("%v\n%s", err, stack)
+		}
+		return hcmd, err
 	}
 	ctxt.Logf("running hook %s {", ctxt.HookName)
 	defer ctxt.Logf("} %s", ctxt.HookName)
+	if runner, ok := ctxt.Runner.(*cachingToolRunner); ok {
+		defer func() {
+			ctxt.Logf("%s", runner.summary())
+		}()
+	}
+	defer func() {
+		if err != nil {
+			ctxt.reportHookError(r, err)
+		}
+	}()
+	if r.stateKeys != nil {
+		// The state keys are owned by the local unit, so other
+		// units would be unable to decrypt state shared
+		// through the leader settings.
+		if _, ok := state.(*leaderState); ok || r.stateStorage == StateStorageLeader {
+			return nil, errgo.New("state encryption cannot be used with leader state storage")
+		}
+		state = NewEncryptedState(state, ctxt, r.stateKeys)
+	}
+	// All state is saved in a single batch at the end of the
+	// hook so that it can be saved atomically.
+	batch := newStateBatch(state)
+	state = batch
 	// Retrieve all persistent state.
-	// TODO read all of the state in one operation from a single file?
-	if err := loadState(r, state); err != nil {
-		return nil, errgo.Mask(err)
+	if err := ctxt.loadState(r, state); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	// Remember the transactional state so that it
+	// can be restored if the hook fails.
+	initialState, err := transactionalState(r)
+	if err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	// Fill in any registered configuration structs.
+	config, err := ctxt.configValues(r)
+	if err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	if err := fillConfigStructs(r.configStructs, config); err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	if err := ctxt.loadConfigChanges(r, state, config); err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	if err := ctxt.loadRelationChanges(r, state); err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	if err := ctxt.loadPublished(r, state); err != nil {
+		return nil, ctxt.hookError(r.name, err)
 	}
 	// Notify everyone about the context.
 	for _, setter := range r.contexts {
-		if err := setter(ctxt); err != nil {
-			return nil, errgo.Notef(err, "cannot set context")
+		if err := setter.set(ctxt); err != nil {
+			return nil, ctxt.hookError(setter.registryName, errgo.NoteMask(err, "cannot set context", errgo.Any))
 		}
 	}
+	// succeeded records whether all the hooks have
+	// completed successfully.
+	succeeded := false
 	defer func() {
 		// All the hooks have now run; save the state.
-		saveErr := saveState(r, state)
+		if !succeeded {
+			if err := restoreState(r, initialState); err != nil {
+				ctxt.Logf("cannot restore local state: %v", err)
+			}
+		}
+		saveErr := saveState(r, state, succeeded)
+		if saveErr == nil {
+			saveErr = batch.commit()
+		}
 		if saveErr == nil {
 			return
 		}
 		if err == nil {
-			err = errgo.Notef(saveErr, "cannot save local state")
+			err = ctxt.hookError(r.name, errgo.Notef(saveErr, "cannot save local state"))
 			return
 		}
 		ctxt.Logf("cannot save local state: %v", saveErr)
@@ -94,39 +163,90 @@ func Main(r *Registry, ctxt *Context, state PersistentState) (_ Command, err err
 		ctxt.Logf("hook %q not registered", ctxt.HookName)
 		return nil, usageError(r)
 	}
+	invalidConfig, err := ctxt.checkConfig(r, state, config)
+	if err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	if runsWithInvalidConfig(ctxt.HookName) {
+		invalidConfig = nil
+	}
 	hookFuncs = append(hookFuncs, r.hooks["*"]...)
+	skipped := false
 	for _, f := range hookFuncs {
-		if err := f.run(); err != nil {
-			// TODO better error context here, perhaps
-			// including local state name, hook name, etc.
-			return nil, errgo.Mask(err)
+		if configBlocks(invalidConfig, f.registryName) {
+			ctxt.Logf("invalid configuration; not running hook function for %s", f.registryName)
+			skipped = true
+			continue
+		}
+		if err := CallRecovering(f.registryName, f.run); err != nil {
+			return nil, ctxt.hookError(f.registryName, err)
+		}
+		// The hook may have seen incomplete relation data,
+		// so fail if any could not be loaded.
+		if err := ctxt.relationLoadError(); err != nil {
+			return nil, ctxt.hookError(f.registryName, errgo.Notef(err, "cannot load relation data"))
 		}
 	}
+	// Only record the configuration and relation data once
+	// all the hooks have seen it, so that a failed hook will
+	// see the same changes when it is retried. Likewise, when
+	// some functions were skipped because of invalid configuration,
+	// they will see the changes when the configuration becomes valid.
+	// Juju discards relation settings set by a failed hook, so
+	// the same applies to the published settings.
+	if !skipped {
+		if err := saveConfigSnapshot(r, state, config); err != nil {
+			return nil, ctxt.hookError(r.name, err)
+		}
+		if err := ctxt.saveRelationSnapshot(state); err != nil {
+			return nil, ctxt.hookError(r.name, err)
+		}
+	}
+	if err := ctxt.savePublished(state); err != nil {
+		return nil, ctxt.hookError(r.name, err)
+	}
+	succeeded = true
 	return nil, nil
 }
 
-func loadState(r *Registry, state PersistentState) error {
+// loadState loads all the registered state. Any error
+// is annotated with the registry that the failing state
+// was registered with.
+func (ctxt *Context) loadState(r *Registry, state PersistentState) error {
 	for _, val := range r.state {
 		data, err := state.Load(val.registryName)
 		if err != nil {
-			return errgo.Notef(err, "cannot load state for %s", val.registryName)
+			return ctxt.hookError(val.registryName, errgo.Notef(err, "cannot load state"))
 		}
 		if data == nil {
 			continue
 		}
+		data, err = val.decode(data)
+		if err != nil {
+			return ctxt.hookError(val.registryName, errgo.Notef(err, "cannot load state"))
+		}
 		if err := json.Unmarshal(data, val.val); err != nil {
-			return errgo.Notef(err, "cannot unmarshal state for %s", val.registryName)
+			return ctxt.hookError(val.registryName, errgo.Notef(err, "cannot unmarshal state"))
 		}
 	}
 	return nil
 }
 
-func saveState(r *Registry, state PersistentState) (err error) {
+// saveState saves all the registered state. If succeeded is false,
+// transactional state is not saved.
+func saveState(r *Registry, state PersistentState, succeeded bool) (err error) {
 	for _, val := range r.state {
+		if val.transactional && !succeeded {
+			continue
+		}
 		data, err := json.Marshal(val.val)
 		if err != nil {
 			return errgo.Notef(err, "cannot marshal state for %s", val.registryName)
 		}
+		data, err = val.encode(data)
+		if err != nil {
+			return errgo.Notef(err, "cannot marshal state for %s", val.registryName)
+		}
 		if err := state.Save(val.registryName, data); err != nil {
 			return errgo.Notef(err, "cannot save state for %s", val.registryName)
 		}
@@ -134,6 +254,69 @@ func saveState(r *Registry, state PersistentState) (err error) {
 	return nil
 }
 
+// transactionalState returns the current value of all the
+// transactional state in r, keyed by registry name.
+func transactionalState(r *Registry) (map[string][]byte, error) {
+	saved := make(map[string][]byte)
+	for _, val := range r.state {
+		if !val.transactional {
+			continue
+		}
+		data, err := json.Marshal(val.val)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot marshal state for %s", val.registryName)
+		}
+		saved[val.registryName] = data
+	}
+	return saved, nil
+}
+
+// restoreState restores the transactional state in r
+// to the values returned by transactionalState,
+// discarding any changes made by the hook functions.
+func restoreState(r *Registry, saved map[string][]byte) error {
+	for _, val := range r.state {
+		data, ok := saved[val.registryName]
+		if !ok {
+			continue
+		}
+		v := reflect.ValueOf(val.val).Elem()
+		v.Set(reflect.Zero(v.Type()))
+		if err := json.Unmarshal(data, val.val); err != nil {
+			return errgo.Notef(err, "cannot unmarshal state for %s", val.registryName)
+		}
+	}
+	return nil
+}
+
+// hookError returns the given error, encountered when running
+// the current hook on behalf of the registry with the given name,
+// annotated with the hook name, the registry name and the unit.
+// The cause of the error is preserved.
+func (ctxt *Context) hookError(registryName string, err error) error {
+	msg := fmt.Sprintf("%s hook failed in %s", ctxt.HookName, registryName)
+	if ctxt.Unit != "" {
+		msg += fmt.Sprintf(" on unit %s", ctxt.Unit)
+	}
+	return errgo.NoteMask(err, msg, errgo.Any)
+}
+
+// reportHookError logs the full details of the given error,
+// returned when running the current hook, and sets the
+// status registered with SetErrorStatus if there is one.
+func (ctxt *Context) reportHookError(r *Registry, err error) {
+	ctxt.Logf("hook %s failed: %s", ctxt.HookName, errgo.Details(err))
+	if stack := panicStack(err); stack != nil {
+		ctxt.Logf("panic stack trace:\n%s", stack)
+	}
+	if r.errorStatus == "" {
+		return
+	}
+	if err := ctxt.SetStatus(r.errorStatus, err.Error()); err != nil {
+		ctxt.Logf("cannot set error status: %v", err)
+	}
+}
+
 func usageError(r *Registry) error {
 	var allowed []string
 	for cmd := range r.commands {
@@ -170,12 +353,17 @@ func RegisterMainHooks(r *Registry) {
 // NewContextFromEnvironment creates a hook context from the current
 // environment, using the given tool runner to acquire information to
 // populate the context, and the given registry to determine which
-// relations to fetch information for.
+// relations to fetch information for. All the relation data is
+// fetched before NewContextFromEnvironment returns unless
+// Registry.SetLazyRelations has been called, in which case it
+// is fetched when first accessed through the context.
 //
 // The hookName argument holds the name of the hook
 // to invoke, and args holds any additional arguments.
 //
-// The given directory will be used to save persistent state.
+// The persistent state is stored as specified by
+// Registry.SetStateStorage; state stored on disk is saved
+// in the given directory.
 //
 // It also returns the persistent state associated with the context
 // unless called in a command-running context.
@@ -202,6 +390,9 @@ func NewContextFromEnvironment(r *Registry, stateDir string, hookName string, ar
 			vars = append(vars, envRemoteUnit)
 		}
 	}
+	if storageHookPattern.MatchString(hookName) {
+		vars = append(vars, envStorageId)
+	}
 	for _, v := range vars {
 		if os.Getenv(v) == "" {
 			return nil, nil, errgo.Newf("required environment variable %q not set", v)
@@ -218,35 +409,18 @@ func NewContextFromEnvironment(r *Registry, stateDir string, hookName string, ar
 		RelationName: os.Getenv(envRelationName),
 		RelationId:   RelationId(os.Getenv(envRelationId)),
 		RemoteUnit:   UnitId(os.Getenv(envRemoteUnit)),
+		StorageId:    StorageId(os.Getenv(envStorageId)),
 		HookName:     hookName,
-		Runner:       runner,
+		Runner:       newCachingToolRunner(runner),
 		HookStateDir: stateDir,
 	}
 
-	// Populate the relation fields of the ContextInfo
-	ctxt.RelationIds = make(map[string][]RelationId)
-	ctxt.Relations = make(map[RelationId]map[UnitId]map[string]string)
-	for name := range r.RegisteredRelations() {
-		ids, err := ctxt.relationIds(name)
-		if err != nil {
-			return nil, nil, errgo.Notef(err, "cannot get relation ids for relation %q", name)
-		}
-		ctxt.RelationIds[name] = ids
-		for _, id := range ids {
-			units := make(map[UnitId]map[string]string)
-			unitIds, err := ctxt.relationUnits(id)
-			if err != nil {
-				return nil, nil, errgo.Notef(err, "cannot get unit ids for relation id %q", id)
-			}
-			for _, unitId := range unitIds {
-				settings, err := ctxt.getAllRelationUnit(id, unitId)
-				if err != nil {
-					return nil, nil, errgo.Notef(err, "cannot get settings for relation %s, unit %s", id, unitId)
-				}
-				units[unitId] = settings
-			}
-			ctxt.Relations[id] = units
+	ctxt.relations = newRelationLoader(ctxt, r, os.Getenv(envRemoteApp))
+	if !r.lazyRelations {
+		// Populate the relation fields of the context.
+		if err := ctxt.LoadRelations(); err != nil {
+			return nil, nil, errgo.Mask(err)
 		}
 	}
-	return ctxt, NewDiskState(ctxt.StateDir()), nil
+	return ctxt, newPersistentState(r.stateStorage, ctxt), nil
 }
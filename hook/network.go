@@ -0,0 +1,57 @@
+package hook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+)
+
+// NetworkInfo holds information about the network configuration
+// of an endpoint binding, as returned by Context.NetworkGet.
+type NetworkInfo struct {
+	// BindAddresses holds the network interfaces and
+	// addresses that the unit should bind to.
+	BindAddresses []BindAddress `json:"bind-addresses"`
+
+	// IngressAddresses holds the addresses that other
+	// units should use to connect to the unit.
+	IngressAddresses []string `json:"ingress-addresses"`
+
+	// EgressSubnets holds the subnets that outgoing
+	// traffic from the unit will appear to come from.
+	EgressSubnets []string `json:"egress-subnets"`
+}
+
+// BindAddress holds the addresses of a single network
+// interface.
+type BindAddress struct {
+	MACAddress    string             `json:"macaddress"`
+	InterfaceName string             `json:"interfacename"`
+	Addresses     []InterfaceAddress `json:"addresses"`
+}
+
+// InterfaceAddress holds a single address of a network interface.
+type InterfaceAddress struct {
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	CIDR     string `json:"cidr"`
+}
+
+// NetworkGet returns the network configuration for the given
+// binding, which may be the name of a relation or of an extra
+// binding registered with Registry.RegisterExtraBinding.
+//
+// If the version of juju does not support network-get, the
+// returned error will have an ErrUnimplemented cause.
+func (ctxt *Context) NetworkGet(binding string) (*NetworkInfo, error) {
+	out, err := ctxt.Runner.Run("network-get", "--format", "json", binding)
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get network information for %q", binding), errgo.Is(ErrUnimplemented))
+	}
+	var info NetworkInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, errgo.Notef(err, "cannot parse network-get output %q", out)
+	}
+	return &info, nil
+}
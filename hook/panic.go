@@ -0,0 +1,54 @@
+package hook
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"gopkg.in/errgo.v1"
+)
+
+// PanicError is the cause of the error returned by Main when
+// a hook function, context setter or command panics.
+type PanicError struct {
+	// RegistryName holds the name of the registry that the
+	// function that panicked was registered with.
+	RegistryName string
+
+	// Value holds the value passed to panic.
+	Value interface{}
+
+	// Stack holds the stack trace of the goroutine
+	// at the time of the panic.
+	Stack []byte
+}
+
+// Error implements the error interface.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v", e.RegistryName, e.Value)
+}
+
+// CallRecovering calls f and returns its result. If f panics,
+// the panic is recovered and CallRecovering returns an error
+// with a *PanicError cause holding the given registry name
+// and the stack trace of the panic.
+func CallRecovering(registryName string, f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = errgo.WithCausef(nil, &PanicError{
+				RegistryName: registryName,
+				Value:        v,
+				Stack:        debug.Stack(),
+			}, "")
+		}
+	}()
+	return f()
+}
+
+// panicStack returns the stack trace of the panic
+// that caused the given error, if any.
+func panicStack(err error) []byte {
+	if perr, ok := errgo.Cause(err).(*PanicError); ok {
+		return perr.Stack
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 	"gopkg.in/juju/charm.v6-unstable/hooks"
+	"gopkg.in/juju/charm.v6-unstable/resource"
 )
 
 // ContextSetter is the type of a function that can
@@ -37,13 +38,24 @@ type Registry struct {
 // sharedRegistry holds registry values that
 // are shared across all clones of a Registry.
 type sharedRegistry struct {
-	hooks     map[string][]hookFunc
-	commands  map[string]func([]string) (Command, error)
-	relations map[string]charm.Relation
-	config    map[string]charm.Option
-	contexts  []ContextSetter
-	state     []localState
-	charmInfo CharmInfo
+	hooks         map[string][]hookFunc
+	commands      map[string]func([]string) (Command, error)
+	relations     map[string]charm.Relation
+	config        map[string]charm.Option
+	configStructs []configStruct
+	configRules   map[string][]configRule
+	actions       map[string]charm.ActionSpec
+	storage       map[string]charm.Storage
+	resources     map[string]resource.Meta
+	bindings      map[string]charm.ExtraBinding
+	metrics       map[string]charm.Metric
+	contexts      []contextSetter
+	state         []localState
+	stateStorage  StateStorage
+	stateKeys     StateKeySource
+	errorStatus   Status
+	lazyRelations bool
+	charmInfo     CharmInfo
 }
 
 // CharmInfo holds descriptive information associated with
@@ -52,6 +64,11 @@ type CharmInfo struct {
 	Name        string
 	Summary     string
 	Description string
+
+	// Subordinate specifies that the charm is a subordinate
+	// charm. A subordinate charm must register at least one
+	// requirer relation with charm.ScopeContainer scope.
+	Subordinate bool
 }
 
 type hookFunc struct {
@@ -59,10 +76,26 @@ type hookFunc struct {
 	run          func() error
 }
 
+// contextSetter holds a context setter registered
+// with RegisterContext.
+type contextSetter struct {
+	registryName string
+	set          ContextSetter
+}
+
 // localState holds a registered persistent local state value.
 type localState struct {
 	registryName string
 	val          interface{}
+
+	// version and migrations hold the values passed
+	// to SetStateVersion.
+	version    int
+	migrations []StateMigration
+
+	// transactional holds the value passed to
+	// SetTransactionalState.
+	transactional bool
 }
 
 // NewRegistry returns a new hook registry.
@@ -71,10 +104,16 @@ func NewRegistry() *Registry {
 		name:   "root",
 		clones: make(map[string]bool),
 		sharedRegistry: &sharedRegistry{
-			hooks:     make(map[string][]hookFunc),
-			commands:  make(map[string]func([]string) (Command, error)),
-			relations: make(map[string]charm.Relation),
-			config:    make(map[string]charm.Option),
+			hooks:       make(map[string][]hookFunc),
+			commands:    make(map[string]func([]string) (Command, error)),
+			relations:   make(map[string]charm.Relation),
+			config:      make(map[string]charm.Option),
+			configRules: make(map[string][]configRule),
+			actions:     make(map[string]charm.ActionSpec),
+			storage:     make(map[string]charm.Storage),
+			resources:   make(map[string]resource.Meta),
+			bindings:    make(map[string]charm.ExtraBinding),
+			metrics:     make(map[string]charm.Metric),
 			charmInfo: CharmInfo{
 				Name: "anon",
 			},
@@ -101,6 +140,56 @@ func (r *Registry) CharmInfo() CharmInfo {
 	return r.charmInfo
 }
 
+// SetStateStorage sets how the persistent state of the charm
+// is stored. It applies to the whole charm, not just
+// to the registry it is called on. The default is
+// StateStorageFiles.
+//
+// The storage can also be chosen when the charm is
+// built; see the -state-storage flag of gocharm and
+// deploy.MainFlags.
+func (r *Registry) SetStateStorage(storage StateStorage) {
+	r.stateStorage = storage
+}
+
+// SetStateEncryption specifies that all the persistent state of the
+// charm is encrypted with keys obtained from the given source (see
+// StateKeyFile and StateKeySecret). Like SetStateStorage, it applies
+// to the whole charm. See NewEncryptedState for details.
+//
+// The keys are owned by the local unit, so encryption cannot be
+// used with StateStorageLeader: Main returns an error when the
+// two are combined.
+func (r *Registry) SetStateEncryption(keys StateKeySource) {
+	r.stateKeys = keys
+}
+
+// SetErrorStatus specifies that when a hook fails, the status of the
+// unit is set to the given status with a message describing the
+// error. Juju shows the unit in an error state while a hook is
+// failing, but the message remains visible after the hook is
+// resolved, until the charm sets another status. It applies to
+// the whole charm, not just to the registry it is called on.
+// By default, no status is set.
+//
+// The full details of any hook failure are always logged
+// with juju-log.
+func (r *Registry) SetErrorStatus(st Status) {
+	r.errorStatus = st
+}
+
+// SetLazyRelations specifies that relation data is loaded only when
+// it is first accessed through the Context methods RelationIdsFor,
+// RelationSettings, AppRelationSettings and LoadRelations, rather
+// than all being loaded before any hook functions run. The
+// RelationIds, Relations and AppRelations fields of the Context then
+// hold only the data that has been loaded so far, so a charm should
+// only call this if nothing in it reads those fields directly. It
+// applies to the whole charm, not just to the registry it is called on.
+func (r *Registry) SetLazyRelations() {
+	r.lazyRelations = true
+}
+
 // Clone returns a sub-registry of r with the given name. This
 // will use a separate name space for local state and for commands.
 // This should be used when passing a registry to an external
@@ -125,6 +214,14 @@ func (r *Registry) Clone(name string) *Registry {
 	}
 }
 
+// Name returns the name of the registry. The root registry
+// is named "root"; the name of a registry returned by Clone
+// is the name of its parent followed by a dot and the
+// name passed to Clone.
+func (r *Registry) Name() string {
+	return r.name
+}
+
 // RegisterHook registers the given function to be called when the
 // charm hook with the given name is invoked.
 //
@@ -154,6 +251,9 @@ func (r *Registry) RegisterHook(name string, f func() error) {
 // called, any previously saved state is loaded into the value.
 // When all hooks have completed, the state is saved, making
 // it persistent. The data is saved using JSON.Marshal.
+// To change the format of the state between charm revisions,
+// use SetStateVersion. By default the state is saved even
+// when a hook fails; to change that, use SetTransactionalState.
 //
 // This function may not be called more than once for a given Registry;
 // it will panic if it is.
@@ -165,8 +265,13 @@ func (r *Registry) RegisterContext(setter ContextSetter, state interface{}) {
 		panic("RegisterContext called more than once")
 	}
 	r.hasContext = true
-	r.contexts = append(r.contexts, func(ctxt *Context) error {
-		return setter(ctxt.withRegistryName(r.name))
+	r.contexts = append(r.contexts, contextSetter{
+		registryName: r.name,
+		set: func(ctxt *Context) error {
+			return CallRecovering(r.name, func() error {
+				return setter(ctxt.withRegistryName(r.name))
+			})
+		},
 	})
 	if state == nil {
 		return
@@ -257,12 +362,158 @@ func (r *Registry) RegisterConfig(name string, opt charm.Option) {
 	}
 }
 
+// RegisterStorage registers a storage requirement to be included
+// in the charm's metadata.yaml. If storage is registered twice with
+// the same name, all of the details must also match.
+// If st.CountMin and st.CountMax are both zero, exactly
+// one storage instance is assumed. A CountMax of -1 means
+// that there is no upper limit on the number of instances.
+//
+// When a storage instance is attached or about to be detached,
+// the hooks name+"-storage-attached" and name+"-storage-detaching"
+// will be run respectively.
+func (r *Registry) RegisterStorage(st charm.Storage) {
+	if !storageNamePattern.MatchString(st.Name) {
+		panic(errgo.Newf("invalid storage name %q", st.Name))
+	}
+	switch st.Type {
+	case charm.StorageBlock, charm.StorageFilesystem:
+	default:
+		panic(errgo.Newf("invalid type %q in storage %q", st.Type, st.Name))
+	}
+	if st.CountMin == 0 && st.CountMax == 0 {
+		st.CountMin, st.CountMax = 1, 1
+	}
+	if st.CountMax != -1 && st.CountMax < st.CountMin {
+		panic(errgo.Newf("invalid count range %d-%d in storage %q", st.CountMin, st.CountMax, st.Name))
+	}
+	old, ok := r.storage[st.Name]
+	if ok {
+		if !reflect.DeepEqual(old, st) {
+			panic(errgo.Newf("storage %q is already registered with different details (%#v)", st.Name, old))
+		}
+		return
+	}
+	r.storage[st.Name] = st
+}
+
+// RegisterResource registers a resource to be included in the charm's
+// metadata.yaml. If res.Type is zero, resource.TypeFile is assumed.
+// If a resource is registered twice with the same name, all of the
+// details must also match.
+//
+// The resource can be retrieved when the charm is running
+// with Context.ResourceGet.
+func (r *Registry) RegisterResource(res resource.Meta) {
+	if res.Type == 0 {
+		res.Type = resource.TypeFile
+	}
+	if err := res.Validate(); err != nil {
+		panic(errgo.Notef(err, "invalid resource %q", res.Name))
+	}
+	old, ok := r.resources[res.Name]
+	if ok {
+		if old != res {
+			panic(errgo.Newf("resource %q is already registered with different details (%#v)", res.Name, old))
+		}
+		return
+	}
+	r.resources[res.Name] = res
+}
+
+// RegisterExtraBinding registers an extra endpoint binding to be
+// included in the charm's metadata.yaml. Extra bindings allow
+// the charm to be bound to a network space independently of
+// its relations. Registering the same binding twice has no
+// further effect.
+//
+// The network configuration of the binding can be retrieved
+// with Context.NetworkGet.
+func (r *Registry) RegisterExtraBinding(name string) {
+	if !bindingNamePattern.MatchString(name) {
+		panic(errgo.Newf("invalid extra binding name %q", name))
+	}
+	r.bindings[name] = charm.ExtraBinding{
+		Name: name,
+	}
+}
+
+// RegisterMetric registers a metric to be included in the charm's
+// metrics.yaml. If a metric is registered twice with the same name,
+// all of the details must also match.
+//
+// Metric values are sent by calling Context.AddMetric from
+// the collect-metrics hook.
+func (r *Registry) RegisterMetric(name string, typ charm.MetricType, description string) {
+	if name == "" || strings.HasPrefix(name, "juju-") {
+		panic(errgo.Newf("invalid metric name %q", name))
+	}
+	switch typ {
+	case charm.MetricTypeGauge, charm.MetricTypeAbsolute:
+	default:
+		panic(errgo.Newf("invalid type %q in metric %q", typ, name))
+	}
+	m := charm.Metric{
+		Type:        typ,
+		Description: description,
+	}
+	old, ok := r.metrics[name]
+	if ok {
+		if old != m {
+			panic(errgo.Newf("metric %q is already registered with different details (%#v)", name, old))
+		}
+		return
+	}
+	r.metrics[name] = m
+}
+
+// RegisterAction registers an action to be included in the charm's
+// actions.yaml. The description describes the action to the user.
+//
+// The params argument describes the parameters that the action takes.
+// It should be nil (if the action takes no parameters) or a struct or
+// pointer to struct; each exported field of the struct defines one
+// parameter. The parameter name is taken from the field's "json" tag
+// if present, or the field name otherwise; its description is taken from
+// the field's "description" tag. A parameter is required unless
+// its json tag specifies "omitempty".
+//
+// The action is handled by registering a hook named name+"-action".
+// When the action runs, the parameters can be retrieved by
+// passing a pointer to a value of the same type as params
+// to Context.ActionParams.
+//
+// If an action is registered twice with the same name, all of the
+// details must also match.
+func (r *Registry) RegisterAction(name, description string, params interface{}) {
+	if !actionNamePattern.MatchString(name) {
+		panic(errgo.Newf("invalid action name %q", name))
+	}
+	schema, err := actionParamsSchema(name, description, params)
+	if err != nil {
+		panic(errgo.Notef(err, "invalid parameters for action %q", name))
+	}
+	spec := charm.ActionSpec{
+		Description: description,
+		Params:      schema,
+	}
+	old, ok := r.actions[name]
+	if ok {
+		if !reflect.DeepEqual(old, spec) {
+			panic(errgo.Newf("action %q is already registered with different details (%#v)", name, old))
+		}
+		return
+	}
+	r.actions[name] = spec
+}
+
 // RegisteredHooks returns the names of all currently
-// registered hooks, excluding wildcard ("*") hooks.
+// registered hooks, excluding wildcard ("*") hooks
+// and action hooks.
 func (r *Registry) RegisteredHooks() []string {
 	var names []string
 	for name := range r.hooks {
-		if name != "*" {
+		if name != "*" && !actionHookPattern.MatchString(name) {
 			names = append(names, name)
 		}
 	}
@@ -281,24 +532,78 @@ func (r *Registry) RegisteredConfig() map[string]charm.Option {
 	return r.config
 }
 
+// RegisteredStorage returns the storage that has been
+// registered with RegisterStorage, keyed by storage name.
+func (r *Registry) RegisteredStorage() map[string]charm.Storage {
+	return r.storage
+}
+
+// RegisteredResources returns the resources that have been
+// registered with RegisterResource, keyed by resource name.
+func (r *Registry) RegisteredResources() map[string]resource.Meta {
+	return r.resources
+}
+
+// RegisteredExtraBindings returns the extra bindings that have been
+// registered with RegisterExtraBinding, keyed by binding name.
+func (r *Registry) RegisteredExtraBindings() map[string]charm.ExtraBinding {
+	return r.bindings
+}
+
+// RegisteredMetrics returns the metrics that have been
+// registered with RegisterMetric, keyed by metric name.
+func (r *Registry) RegisteredMetrics() map[string]charm.Metric {
+	return r.metrics
+}
+
+// RegisteredActions returns the actions that have been
+// registered with RegisterAction, keyed by action name.
+// The Params field of each action holds its parameters
+// as a JSON schema.
+func (r *Registry) RegisteredActions() map[string]charm.ActionSpec {
+	return r.actions
+}
+
 var relationHookPattern = regexp.MustCompile("^(?:(" + names.RelationSnippet + ")-)?(relation-[a-z]+)$")
 
+var bindingNamePattern = regexp.MustCompile("^" + names.RelationSnippet + "$")
+
+var (
+	storageNamePattern = regexp.MustCompile("^" + names.StorageNameSnippet + "$")
+	storageHookPattern = regexp.MustCompile("^" + names.StorageNameSnippet + "-(storage-[a-z]+)$")
+)
+
+const actionNameSnippet = "[a-z](?:[a-z-]*[a-z])?"
+
+var (
+	actionNamePattern = regexp.MustCompile("^" + actionNameSnippet + "$")
+	actionHookPattern = regexp.MustCompile("^" + actionNameSnippet + "-" + string(hooks.Action) + "$")
+)
+
 var hookNames = map[hooks.Kind]bool{
-	hooks.Install:            true,
-	hooks.Start:              true,
-	hooks.ConfigChanged:      true,
-	hooks.UpgradeCharm:       true,
-	hooks.Stop:               true,
-	hooks.Action:             true,
-	hooks.CollectMetrics:     true,
-	hooks.MeterStatusChanged: true,
-	hooks.RelationJoined:     true,
-	hooks.RelationChanged:    true,
-	hooks.RelationDeparted:   true,
-	hooks.RelationBroken:     true,
+	hooks.Install:               true,
+	hooks.Start:                 true,
+	hooks.ConfigChanged:         true,
+	hooks.UpgradeCharm:          true,
+	hooks.Stop:                  true,
+	hooks.Action:                true,
+	hooks.CollectMetrics:        true,
+	hooks.MeterStatusChanged:    true,
+	hooks.LeaderElected:         true,
+	hooks.LeaderDeposed:         true,
+	hooks.LeaderSettingsChanged: true,
+	hooks.RelationJoined:        true,
+	hooks.RelationChanged:       true,
+	hooks.RelationDeparted:      true,
+	hooks.RelationBroken:        true,
+	hooks.StorageAttached:       true,
+	hooks.StorageDetaching:      true,
 }
 
 func validHookName(s string) bool {
+	if actionHookPattern.MatchString(s) {
+		return true
+	}
 	if m := relationHookPattern.FindStringSubmatch(s); m != nil {
 		if m[1] == "" {
 			// The user has specified a relation hook name with
@@ -306,6 +611,12 @@ func validHookName(s string) bool {
 			return false
 		}
 		s = m[2]
+	} else if m := storageHookPattern.FindStringSubmatch(s); m != nil {
+		s = m[1]
+	} else if kind := hooks.Kind(s); kind == hooks.StorageAttached || kind == hooks.StorageDetaching {
+		// The user has specified a storage hook name with
+		// no storage.
+		return false
 	}
 	return hookNames[hooks.Kind(s)]
 }
@@ -0,0 +1,208 @@
+package hook
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// relationsStateName holds the name under which the last-seen
+// relation data is stored in the persistent state.
+// Like configStateName, it cannot clash with any registry name.
+const relationsStateName = "_relations"
+
+// RelationDelta holds the changes to a relation since the last time
+// that a hook completed successfully.
+type RelationDelta struct {
+	// Joined holds the units that have joined the relation,
+	// sorted by unit id.
+	Joined []UnitId
+
+	// Departed holds the units that have departed the relation,
+	// sorted by unit id.
+	Departed []UnitId
+
+	// Changed holds the settings changes for each unit
+	// whose settings have changed, including units that
+	// have just joined. It does not include departed units.
+	Changed map[UnitId]SettingsDelta
+}
+
+// IsEmpty reports whether the delta holds no changes.
+func (d RelationDelta) IsEmpty() bool {
+	return len(d.Joined) == 0 && len(d.Departed) == 0 && len(d.Changed) == 0
+}
+
+// SettingsDelta holds the changes to a unit's relation settings.
+type SettingsDelta struct {
+	// Added holds the settings that have been added.
+	Added map[string]string
+
+	// Changed holds the new values of settings that have changed.
+	Changed map[string]string
+
+	// Removed holds the keys of settings that have been
+	// removed, in sorted order.
+	Removed []string
+}
+
+// RelationDelta returns the changes to the relation with the given id
+// since the last time that a hook that observed the relation completed
+// successfully. When no such hook has previously completed, all the
+// units in the relation are reported as joined.
+//
+// Relation changes are only tracked when the charm has registered
+// relations. If it has not, RelationDelta always returns an empty delta.
+func (ctxt *Context) RelationDelta(id RelationId) RelationDelta {
+	return ctxt.RelationDeltas(relationIdName(id))[id]
+}
+
+// RelationDeltas returns the changes to all the relations with the
+// given name (as declared in the charm metadata), keyed by relation id.
+// Relations that have been removed since the last successful hook are
+// included; relations that have not changed are omitted.
+//
+// Calling RelationDeltas loads all the data for the named relation.
+func (ctxt *Context) RelationDeltas(relationName string) map[RelationId]RelationDelta {
+	deltas := make(map[RelationId]RelationDelta)
+	if ctxt.relationSnapshot == nil {
+		return deltas
+	}
+	ids := ctxt.RelationIdsFor(relationName)
+	current := make(map[RelationId]bool)
+	for _, id := range ids {
+		current[id] = true
+		if delta := relationDelta(ctxt.relationSnapshot[id], ctxt.RelationSettings(id)); !delta.IsEmpty() {
+			deltas[id] = delta
+		}
+	}
+	for id, units := range ctxt.relationSnapshot {
+		if current[id] || relationIdName(id) != relationName {
+			continue
+		}
+		if delta := relationDelta(units, nil); !delta.IsEmpty() {
+			deltas[id] = delta
+		}
+	}
+	return deltas
+}
+
+// relationIdName returns the relation name part of
+// the given relation id.
+func relationIdName(id RelationId) string {
+	if i := strings.LastIndex(string(id), ":"); i >= 0 {
+		return string(id[0:i])
+	}
+	return string(id)
+}
+
+// loadRelationChanges loads the relation snapshot saved in state
+// so that RelationDeltas can compare the current relation
+// data against it.
+func (ctxt *Context) loadRelationChanges(r *Registry, state PersistentState) error {
+	if len(r.relations) == 0 {
+		return nil
+	}
+	data, err := state.Load(relationsStateName)
+	if err != nil {
+		return errgo.Notef(err, "cannot load relation snapshot")
+	}
+	old := make(map[RelationId]map[UnitId]map[string]string)
+	if data != nil {
+		if err := json.Unmarshal(data, &old); err != nil {
+			return errgo.Notef(err, "cannot unmarshal relation snapshot")
+		}
+	}
+	ctxt.relationSnapshot = old
+	return nil
+}
+
+// saveRelationSnapshot saves the relation data in ctxt
+// so that the next hook can find out what has changed.
+// When relation data is loaded on demand, only the relations
+// that have been observed by the current hook are updated.
+func (ctxt *Context) saveRelationSnapshot(state PersistentState) error {
+	if ctxt.relationSnapshot == nil {
+		return nil
+	}
+	snapshot := ctxt.Relations
+	if l := ctxt.relations; l != nil {
+		l.mu.Lock()
+		snapshot = l.snapshot(ctxt.relationSnapshot)
+		l.mu.Unlock()
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal relation snapshot")
+	}
+	if err := state.Save(relationsStateName, data); err != nil {
+		return errgo.Notef(err, "cannot save relation snapshot")
+	}
+	return nil
+}
+
+// relationDelta returns the changes needed to get from the
+// old unit settings to the new.
+func relationDelta(old, new map[UnitId]map[string]string) RelationDelta {
+	var delta RelationDelta
+	for unitId, settings := range new {
+		oldSettings, ok := old[unitId]
+		if !ok {
+			delta.Joined = append(delta.Joined, unitId)
+		}
+		if sdelta := settingsDelta(oldSettings, settings); !sdelta.isEmpty() {
+			if delta.Changed == nil {
+				delta.Changed = make(map[UnitId]SettingsDelta)
+			}
+			delta.Changed[unitId] = sdelta
+		}
+	}
+	for unitId := range old {
+		if _, ok := new[unitId]; !ok {
+			delta.Departed = append(delta.Departed, unitId)
+		}
+	}
+	sort.Sort(unitIdSlice(delta.Joined))
+	sort.Sort(unitIdSlice(delta.Departed))
+	return delta
+}
+
+// settingsDelta returns the changes needed to get from the
+// old settings to the new.
+func settingsDelta(old, new map[string]string) SettingsDelta {
+	var delta SettingsDelta
+	for key, val := range new {
+		oldVal, ok := old[key]
+		switch {
+		case !ok:
+			if delta.Added == nil {
+				delta.Added = make(map[string]string)
+			}
+			delta.Added[key] = val
+		case oldVal != val:
+			if delta.Changed == nil {
+				delta.Changed = make(map[string]string)
+			}
+			delta.Changed[key] = val
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			delta.Removed = append(delta.Removed, key)
+		}
+	}
+	sort.Strings(delta.Removed)
+	return delta
+}
+
+func (d SettingsDelta) isEmpty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+type unitIdSlice []UnitId
+
+func (u unitIdSlice) Len() int           { return len(u) }
+func (u unitIdSlice) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u unitIdSlice) Less(i, j int) bool { return u[i] < u[j] }
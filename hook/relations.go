@@ -0,0 +1,309 @@
+package hook
+
+import (
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxConcurrentToolCalls holds the maximum number of hook
+// tools that will be run concurrently when loading relation data.
+const maxConcurrentToolCalls = 10
+
+// relationLoader loads relation data from the hook tools on demand.
+// It is shared between all the copies of the Context that it
+// was created for, and stores the data that it loads in that
+// Context's RelationIds, Relations and AppRelations fields.
+//
+// The loader runs hook tools concurrently, so the context's Runner
+// must be safe to call concurrently. This is true of the runners
+// created by NewContextFromEnvironment.
+type relationLoader struct {
+	ctxt *Context
+
+	// names holds the names of all the registered relations.
+	names []string
+
+	// remoteApp holds the name of the remote application
+	// for the current relation hook, if known.
+	remoteApp string
+
+	// mu guards the fields below and the relation fields of ctxt.
+	mu sync.Mutex
+
+	// err holds the first error encountered when loading.
+	err error
+
+	// idsLoaded records the relation names whose
+	// ids have been loaded.
+	idsLoaded map[string]bool
+
+	// loaded records the relation ids whose settings
+	// have been loaded.
+	loaded map[RelationId]bool
+}
+
+func newRelationLoader(ctxt *Context, r *Registry, remoteApp string) *relationLoader {
+	l := &relationLoader{
+		ctxt:      ctxt,
+		remoteApp: remoteApp,
+		idsLoaded: make(map[string]bool),
+		loaded:    make(map[RelationId]bool),
+	}
+	for name := range r.RegisteredRelations() {
+		l.names = append(l.names, name)
+	}
+	ctxt.RelationIds = make(map[string][]RelationId)
+	ctxt.Relations = make(map[RelationId]map[UnitId]map[string]string)
+	ctxt.AppRelations = make(map[RelationId]map[string]string)
+	return l
+}
+
+// RelationIdsFor returns the current ids of the relation with
+// the given name, as declared in the charm metadata.
+//
+// When the charm has called Registry.SetLazyRelations, relation
+// data is loaded lazily the first time that it is accessed.
+// If loading fails, the returned data will be
+// incomplete and the current hook will fail after the hook
+// function returns.
+func (ctxt *Context) RelationIdsFor(relationName string) []RelationId {
+	if l := ctxt.relations; l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.loadIds([]string{relationName})
+	}
+	return ctxt.RelationIds[relationName]
+}
+
+// RelationSettings returns the relation settings of all the remote
+// units in the relation with the given id, keyed by unit id. See
+// RelationIdsFor for a discussion of how relation data is loaded.
+func (ctxt *Context) RelationSettings(id RelationId) map[UnitId]map[string]string {
+	if l := ctxt.relations; l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.loadRelations([]RelationId{id})
+	}
+	return ctxt.Relations[id]
+}
+
+// AppRelationSettings returns the application-level relation settings
+// of the remote application in the relation with the given id. See
+// RelationIdsFor for a discussion of how relation data is loaded.
+func (ctxt *Context) AppRelationSettings(id RelationId) map[string]string {
+	if l := ctxt.relations; l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.loadRelations([]RelationId{id})
+	}
+	return ctxt.AppRelations[id]
+}
+
+// LoadRelations loads the data for all registered relations into
+// the RelationIds, Relations and AppRelations fields, running
+// the hook tools concurrently. This is more efficient than loading
+// each relation in turn when most relation data will be needed.
+func (ctxt *Context) LoadRelations() error {
+	l := ctxt.relations
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadIds(l.names)
+	var ids []RelationId
+	for _, name := range l.names {
+		ids = append(ids, ctxt.RelationIds[name]...)
+	}
+	l.loadRelations(ids)
+	return errgo.Mask(l.err)
+}
+
+// relationLoadError returns any error encountered
+// when loading relation data.
+func (ctxt *Context) relationLoadError() error {
+	l := ctxt.relations
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// loadIds loads the relation ids for all the given relation names.
+// It must be called with l.mu held.
+func (l *relationLoader) loadIds(names []string) {
+	var todo []string
+	for _, name := range names {
+		if !l.idsLoaded[name] {
+			todo = append(todo, name)
+		}
+	}
+	ids := make([][]RelationId, len(todo))
+	errs := make([]error, len(todo))
+	parallel(len(todo), func(i int) {
+		ids[i], errs[i] = l.ctxt.relationIds(todo[i])
+	})
+	for i, name := range todo {
+		if errs[i] != nil {
+			l.setError(errgo.Notef(errs[i], "cannot get relation ids for relation %q", name))
+			continue
+		}
+		l.ctxt.RelationIds[name] = ids[i]
+		l.idsLoaded[name] = true
+	}
+}
+
+// settingsRequest holds a request for the settings
+// of a unit or application in a relation.
+type settingsRequest struct {
+	id       RelationId
+	unit     UnitId
+	app      string
+	settings map[string]string
+	err      error
+}
+
+// loadRelations loads the settings of all the units and applications
+// in all the relations with the given ids. It must be called with l.mu
+// held.
+func (l *relationLoader) loadRelations(ids []RelationId) {
+	var todo []RelationId
+	for _, id := range ids {
+		if id != "" && !l.loaded[id] {
+			todo = append(todo, id)
+		}
+	}
+	unitIds := make([][]UnitId, len(todo))
+	errs := make([]error, len(todo))
+	parallel(len(todo), func(i int) {
+		unitIds[i], errs[i] = l.ctxt.relationUnits(todo[i])
+	})
+	var reqs []settingsRequest
+	for i, id := range todo {
+		if errs[i] != nil {
+			l.setError(errgo.Notef(errs[i], "cannot get unit ids for relation id %q", id))
+			continue
+		}
+		for _, unitId := range unitIds[i] {
+			reqs = append(reqs, settingsRequest{
+				id:   id,
+				unit: unitId,
+			})
+		}
+		app := remoteApp(unitIds[i])
+		if app == "" && id == l.ctxt.RelationId {
+			app = l.remoteApp
+		}
+		if app != "" {
+			reqs = append(reqs, settingsRequest{
+				id:  id,
+				app: app,
+			})
+		}
+	}
+	parallel(len(reqs), func(i int) {
+		req := &reqs[i]
+		if req.app != "" {
+			req.settings, req.err = l.ctxt.getAllRelationApp(req.id, req.app)
+		} else {
+			req.settings, req.err = l.ctxt.getAllRelationUnit(req.id, req.unit)
+		}
+	})
+	failed := make(map[RelationId]bool)
+	units := make(map[RelationId]map[UnitId]map[string]string)
+	for _, req := range reqs {
+		switch {
+		case req.err != nil && req.app != "":
+			// Older versions of juju do not support
+			// application relation data.
+			l.ctxt.Logf("cannot get application settings for relation %s: %v", req.id, req.err)
+		case req.err != nil:
+			l.setError(errgo.Notef(req.err, "cannot get settings for relation %s, unit %s", req.id, req.unit))
+			failed[req.id] = true
+		case req.app != "":
+			l.ctxt.AppRelations[req.id] = req.settings
+		default:
+			if units[req.id] == nil {
+				units[req.id] = make(map[UnitId]map[string]string)
+			}
+			units[req.id][req.unit] = req.settings
+		}
+	}
+	for i, id := range todo {
+		if errs[i] != nil || failed[id] {
+			continue
+		}
+		if units[id] == nil {
+			units[id] = make(map[UnitId]map[string]string)
+		}
+		l.ctxt.Relations[id] = units[id]
+		l.loaded[id] = true
+	}
+}
+
+// snapshot returns the given relation snapshot updated
+// with all the relation data that has been loaded.
+// It must be called with l.mu held.
+func (l *relationLoader) snapshot(old map[RelationId]map[UnitId]map[string]string) map[RelationId]map[UnitId]map[string]string {
+	snapshot := make(map[RelationId]map[UnitId]map[string]string)
+	for id, units := range old {
+		if !l.idsLoaded[relationIdName(id)] {
+			snapshot[id] = units
+		}
+	}
+	for name := range l.idsLoaded {
+		for _, id := range l.ctxt.RelationIds[name] {
+			if units, ok := old[id]; ok {
+				snapshot[id] = units
+			}
+		}
+	}
+	for id := range l.loaded {
+		snapshot[id] = l.ctxt.Relations[id]
+	}
+	return snapshot
+}
+
+func (l *relationLoader) setError(err error) {
+	l.ctxt.Logf("%v", err)
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// remoteApp returns the name of the application
+// that the given units belong to, or the empty string
+// if there are none.
+func remoteApp(unitIds []UnitId) string {
+	if len(unitIds) == 0 {
+		return ""
+	}
+	return unitIds[0].Application()
+}
+
+// parallel calls f for each integer in [0, n), running
+// at most maxConcurrentToolCalls calls concurrently,
+// and waits for them all to complete.
+func parallel(n int, f func(i int)) {
+	if n == 1 {
+		f(0)
+		return
+	}
+	sem := make(chan struct{}, maxConcurrentToolCalls)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				<-sem
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
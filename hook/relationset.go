@@ -0,0 +1,221 @@
+package hook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable/hooks"
+)
+
+// publishedStateName holds the name under which the relation
+// settings published by the local unit are stored in the
+// persistent state. Like configStateName, it cannot clash
+// with any registry name.
+const publishedStateName = "_published"
+
+// publishedSettings records the relation settings most
+// recently published by the local unit, so that only
+// changed settings need to be written.
+type publishedSettings struct {
+	// Unit holds the unit settings for each relation id.
+	Unit map[RelationId]map[string]string `json:",omitempty"`
+
+	// App holds the application-level settings for
+	// each relation id.
+	App map[RelationId]map[string]string `json:",omitempty"`
+}
+
+// get returns the published settings for the given
+// relation id.
+func (p *publishedSettings) get(id RelationId, app bool) map[string]string {
+	if app {
+		return p.App[id]
+	}
+	return p.Unit[id]
+}
+
+// update records that the given key-value pairs have been
+// published to the relation with the given id.
+func (p *publishedSettings) update(id RelationId, app bool, keyvals []string) {
+	all := &p.Unit
+	if app {
+		all = &p.App
+	}
+	if *all == nil {
+		*all = make(map[RelationId]map[string]string)
+	}
+	settings := (*all)[id]
+	if settings == nil {
+		settings = make(map[string]string)
+		(*all)[id] = settings
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		if keyvals[i+1] == "" {
+			delete(settings, keyvals[i])
+		} else {
+			settings[keyvals[i]] = keyvals[i+1]
+		}
+	}
+}
+
+// SetRelationSettings makes the settings of the local unit in the
+// relation with the given id match the given settings. Only settings
+// that have changed since they were last published are written, and
+// any previously published settings that are not mentioned are
+// removed.
+func (ctxt *Context) SetRelationSettings(relationId RelationId, settings map[string]string) error {
+	err := ctxt.setRelationSettings(relationId, false, settings)
+	return errgo.Mask(err)
+}
+
+// SetAppRelationSettings is like SetRelationSettings except
+// that it sets the application-level settings. It returns an
+// error with an ErrNotLeader cause if the current unit is
+// not the leader.
+//
+// Only settings published by the current leader are
+// known, so settings published by a previous leader
+// will not be removed. The record of the published
+// settings is discarded when leadership changes, so
+// the first call after the local unit becomes the
+// leader writes all the given settings.
+func (ctxt *Context) SetAppRelationSettings(relationId RelationId, settings map[string]string) error {
+	if err := ctxt.checkLeader(relationId); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotLeader))
+	}
+	err := ctxt.setRelationSettings(relationId, true, settings)
+	return errgo.Mask(err)
+}
+
+func (ctxt *Context) setRelationSettings(relationId RelationId, app bool, settings map[string]string) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	if ctxt.published != nil {
+		for key := range ctxt.published.get(relationId, app) {
+			if _, ok := settings[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	keyvals := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		keyvals = append(keyvals, key, settings[key])
+	}
+	return ctxt.setRelation(relationId, app, keyvals)
+}
+
+// setRelation sets the given key-value pairs on the relation with
+// the given id, omitting any that are unchanged since they were
+// last published.
+func (ctxt *Context) setRelation(relationId RelationId, app bool, keyvals []string) error {
+	if len(keyvals)%2 != 0 {
+		return errgo.Newf("invalid key/value count")
+	}
+	if ctxt.published != nil {
+		keyvals = changedKeyvals(ctxt.published.get(relationId, app), keyvals)
+	}
+	if len(keyvals) == 0 {
+		return nil
+	}
+	args := make([]string, 0, 4+len(keyvals)/2)
+	args = append(args, "-r", string(relationId))
+	if app {
+		args = append(args, "--app")
+	}
+	args = append(args, "--")
+	for i := 0; i < len(keyvals); i += 2 {
+		args = append(args, fmt.Sprintf("%s=%s", keyvals[i], keyvals[i+1]))
+	}
+	if _, err := ctxt.Runner.Run("relation-set", args...); err != nil {
+		return errgo.Mask(err)
+	}
+	if ctxt.published != nil {
+		ctxt.published.update(relationId, app, keyvals)
+	}
+	return nil
+}
+
+// changedKeyvals returns the key-value pairs from keyvals
+// that differ from the given published settings. An empty value
+// is treated the same as an absent key. If a key is mentioned
+// more than once, the last value wins.
+func changedKeyvals(published map[string]string, keyvals []string) []string {
+	vals := make(map[string]string)
+	var keys []string
+	for i := 0; i < len(keyvals); i += 2 {
+		if _, ok := vals[keyvals[i]]; !ok {
+			keys = append(keys, keyvals[i])
+		}
+		vals[keyvals[i]] = keyvals[i+1]
+	}
+	changed := make([]string, 0, len(keyvals))
+	for _, key := range keys {
+		if val := vals[key]; published[key] != val {
+			changed = append(changed, key, val)
+		}
+	}
+	return changed
+}
+
+// loadPublished loads the record of the relation settings
+// published by the local unit.
+func (ctxt *Context) loadPublished(r *Registry, state PersistentState) error {
+	if len(r.relations) == 0 {
+		return nil
+	}
+	data, err := state.Load(publishedStateName)
+	if err != nil {
+		return errgo.Notef(err, "cannot load published relation settings")
+	}
+	published := new(publishedSettings)
+	if data != nil {
+		if err := json.Unmarshal(data, published); err != nil {
+			return errgo.Notef(err, "cannot unmarshal published relation settings")
+		}
+	}
+	switch hooks.Kind(ctxt.HookName) {
+	case hooks.LeaderElected, hooks.LeaderDeposed, hooks.LeaderSettingsChanged:
+		// Another unit may have been the leader
+		// and changed the application settings.
+		published.App = nil
+	}
+	ctxt.published = published
+	return nil
+}
+
+// savePublished saves the record of the relation settings
+// published by the local unit. Settings for a relation
+// that has been broken are forgotten, as are application
+// settings when the local unit is no longer the leader.
+func (ctxt *Context) savePublished(state PersistentState) error {
+	if ctxt.published == nil {
+		return nil
+	}
+	if strings.HasSuffix(ctxt.HookName, "-"+string(hooks.RelationBroken)) {
+		delete(ctxt.published.Unit, ctxt.RelationId)
+		delete(ctxt.published.App, ctxt.RelationId)
+	}
+	if len(ctxt.published.App) > 0 {
+		isLeader, err := ctxt.IsLeader()
+		if err != nil {
+			ctxt.Logf("cannot determine leadership: %v", err)
+		}
+		if !isLeader {
+			ctxt.published.App = nil
+		}
+	}
+	data, err := json.Marshal(ctxt.published)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal published relation settings")
+	}
+	if err := state.Save(publishedStateName, data); err != nil {
+		return errgo.Notef(err, "cannot save published relation settings")
+	}
+	return nil
+}
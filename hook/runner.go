@@ -17,6 +17,7 @@ type ToolRunner interface {
 	// and arguments, and returns its standard output.
 	// If the command is unimplemented, it should
 	// return an error with an ErrUnimplemented cause.
+	// Run may be called concurrently.
 	Run(cmd string, args ...string) (stdout []byte, err error)
 	Close() error
 }
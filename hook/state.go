@@ -1,9 +1,12 @@
 package hook
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"gopkg.in/errgo.v1"
 )
@@ -11,10 +14,11 @@ import (
 // TODO should we add a CleanUp or Remove method on
 // this type to remove all the state?
 
-// PersistentState is used to save persistent charm state
-// to disk. It is defined as an interface so that it can
-// be defined differently for tests. The customary implementation
-// is DiskState.
+// PersistentState is used to save persistent charm state.
+// It is defined as an interface so that it can be defined
+// differently for tests and so that state can be stored in
+// different places. The customary implementation is the one
+// returned by NewDiskState.
 type PersistentState interface {
 	// Save saves the given state data with the given name.
 	Save(name string, data []byte) error
@@ -25,6 +29,99 @@ type PersistentState interface {
 	Load(name string) ([]byte, error)
 }
 
+// BatchState may be implemented by a PersistentState that
+// can save several items of state in a single atomic operation.
+// When the persistent state passed to Main implements BatchState,
+// all the state saved by a hook is saved with a single
+// call to SaveAll.
+type BatchState interface {
+	PersistentState
+
+	// SaveAll saves all the given state data, keyed by name.
+	// Either all the data should be saved or none of it.
+	SaveAll(items map[string][]byte) error
+}
+
+// StateStorage specifies how the persistent state
+// returned by NewContextFromEnvironment is stored.
+type StateStorage int
+
+const (
+	// StateStorageFiles stores the state for each registry
+	// in a separate file. Each file is written atomically,
+	// but a hook that saves several items of state may
+	// leave some saved and others not if it is interrupted.
+	// This is the default.
+	StateStorageFiles StateStorage = iota
+
+	// StateStorageSingleFile stores all the state
+	// in a single file which is written atomically
+	// once at the end of each hook.
+	StateStorageSingleFile
+
+	// StateStorageUnit stores the state in the Juju
+	// controller using the unit state hook tools.
+	// See NewUnitState.
+	StateStorageUnit
+
+	// StateStorageLeader stores the state in the
+	// application's leader settings, so that it is
+	// shared by all units. See NewLeaderState.
+	// It cannot be used with Registry.SetStateEncryption.
+	StateStorageLeader
+)
+
+var stateStorageNames = []string{
+	StateStorageFiles:      "files",
+	StateStorageSingleFile: "single-file",
+	StateStorageUnit:       "unit",
+	StateStorageLeader:     "leader",
+}
+
+// String returns the name of the storage kind,
+// as accepted by ParseStateStorage.
+func (s StateStorage) String() string {
+	if s >= 0 && int(s) < len(stateStorageNames) {
+		return stateStorageNames[s]
+	}
+	return fmt.Sprintf("StateStorage(%d)", int(s))
+}
+
+// ParseStateStorage returns the storage kind with the given
+// name, one of "files", "single-file", "unit" or "leader".
+func ParseStateStorage(name string) (StateStorage, error) {
+	for i, n := range stateStorageNames {
+		if n == name {
+			return StateStorage(i), nil
+		}
+	}
+	return 0, errgo.Newf("unknown state storage %q", name)
+}
+
+// singleStateFile holds the name of the file used to
+// store the state when StateStorageSingleFile is used.
+// It cannot clash with the files used by StateStorageFiles
+// because registry names always start with "root" and
+// reserved names start with "_".
+const singleStateFile = "state.json"
+
+// newPersistentState returns the persistent state for the given
+// storage kind. State stored on disk is stored in the context's
+// state directory; other state is accessed with hook tools
+// run by the context.
+func newPersistentState(storage StateStorage, ctxt *Context) PersistentState {
+	switch storage {
+	case StateStorageSingleFile:
+		return NewSingleFileState(ctxt.StateDir())
+	case StateStorageUnit:
+		return NewUnitState(ctxt)
+	case StateStorageLeader:
+		return NewLeaderState(ctxt)
+	default:
+		return NewDiskState(ctxt.StateDir())
+	}
+}
+
 // diskState is an implementation of PersistentState that
 // stores the state in the filesystem.
 type diskState struct {
@@ -38,28 +135,251 @@ func NewDiskState(dir string) PersistentState {
 }
 
 // Save implements PersistentState.Save.
+// The data is written atomically, so a crash
+// will leave either the old data or the new.
 func (s *diskState) Save(name string, data []byte) error {
 	if err := os.MkdirAll(s.dir, 0700); err != nil {
 		return errgo.Mask(err)
 	}
-	if err := ioutil.WriteFile(s.path(name), data, 0600); err != nil {
-		return errgo.Mask(err)
+	if err := writeFileAtomic(s.path(name), data); err != nil {
+		return errgo.Notef(err, "cannot save state %q", name)
 	}
 	return nil
 }
 
-// Load implements PersistentState.Load
+// Load implements PersistentState.Load.
+// It returns an error if the stored data is
+// not valid JSON.
 func (s *diskState) Load(name string) ([]byte, error) {
-	data, err := ioutil.ReadFile(s.path(name))
+	path := s.path(name)
+	data, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if !json.Valid(data) {
+		return nil, errgo.Newf("state file %q is corrupt", path)
+	}
 	return data, nil
 }
 
 func (s *diskState) path(name string) string {
 	return filepath.Join(s.dir, name+".json")
 }
+
+// singleFileState is an implementation of BatchState that
+// stores all the state in a single JSON file.
+type singleFileState struct {
+	dir string
+
+	// items holds all the state items, keyed by name.
+	// It is nil until the state has been read.
+	items map[string]json.RawMessage
+}
+
+// NewSingleFileState returns an implementation of BatchState
+// that stores all the state in a single file in the given directory.
+// All the data saved must be valid JSON.
+//
+// If the file does not exist, the state is read from any
+// files saved by a PersistentState returned by NewDiskState
+// in the same directory, so that a charm can switch from
+// one to the other without losing its state.
+func NewSingleFileState(dir string) BatchState {
+	return &singleFileState{
+		dir: dir,
+	}
+}
+
+// Load implements PersistentState.Load.
+func (s *singleFileState) Load(name string) ([]byte, error) {
+	if err := s.read(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data, ok := s.items[name]
+	if !ok {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// Save implements PersistentState.Save.
+func (s *singleFileState) Save(name string, data []byte) error {
+	return s.SaveAll(map[string][]byte{name: data})
+}
+
+// SaveAll implements BatchState.SaveAll.
+func (s *singleFileState) SaveAll(items map[string][]byte) error {
+	if err := s.read(); err != nil {
+		return errgo.Mask(err)
+	}
+	all := make(map[string]json.RawMessage)
+	for name, data := range s.items {
+		all[name] = data
+	}
+	for name, data := range items {
+		if !json.Valid(data) {
+			return errgo.Newf("cannot save state %q: data is not valid JSON", name)
+		}
+		all[name] = data
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := writeFileAtomic(s.path(), data); err != nil {
+		return errgo.Notef(err, "cannot save state")
+	}
+	s.items = all
+	return nil
+}
+
+// read reads the state file if it has not already been read.
+// If the file does not exist, the items are read from
+// the files saved by NewDiskState, so that they are
+// carried over when the state file is first written.
+func (s *singleFileState) read() error {
+	if s.items != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		return s.readDiskState()
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var items map[string]json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return errgo.Notef(err, "state file %q is corrupt", s.path())
+	}
+	if items == nil {
+		items = make(map[string]json.RawMessage)
+	}
+	s.items = items
+	return nil
+}
+
+// readDiskState reads all the items saved in s.dir by
+// NewDiskState.
+func (s *singleFileState) readDiskState() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	disk := NewDiskState(s.dir)
+	items := make(map[string]json.RawMessage)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		if name+".json" == singleStateFile {
+			continue
+		}
+		data, err := disk.Load(name)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if data != nil {
+			items[name] = data
+		}
+	}
+	s.items = items
+	return nil
+}
+
+func (s *singleFileState) path() string {
+	return filepath.Join(s.dir, singleStateFile)
+}
+
+// stateBatch is a PersistentState that holds saved
+// state in memory until commit is called.
+type stateBatch struct {
+	state   PersistentState
+	pending map[string][]byte
+}
+
+func newStateBatch(state PersistentState) *stateBatch {
+	return &stateBatch{
+		state:   state,
+		pending: make(map[string][]byte),
+	}
+}
+
+// Load implements PersistentState.Load.
+func (b *stateBatch) Load(name string) ([]byte, error) {
+	if data, ok := b.pending[name]; ok {
+		return data, nil
+	}
+	return b.state.Load(name)
+}
+
+// Save implements PersistentState.Save.
+func (b *stateBatch) Save(name string, data []byte) error {
+	b.pending[name] = data
+	return nil
+}
+
+// commit saves all the pending state to the underlying state,
+// atomically if it implements BatchState.
+func (b *stateBatch) commit() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	if bs, ok := b.state.(BatchState); ok {
+		if err := bs.SaveAll(b.pending); err != nil {
+			return errgo.Mask(err)
+		}
+		b.pending = make(map[string][]byte)
+		return nil
+	}
+	for _, name := range sortedNames(b.pending) {
+		if err := b.state.Save(name, b.pending[name]); err != nil {
+			return errgo.Mask(err)
+		}
+		delete(b.pending, name)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the given data to the file with the
+// given path by writing it to a temporary file in the same
+// directory, syncing it and renaming it into place.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := f.Sync(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errgo.Mask(err)
+	}
+	// Sync the directory so that the rename is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
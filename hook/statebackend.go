@@ -0,0 +1,205 @@
+package hook
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// unitState is an implementation of BatchState that
+// stores state using Juju's unit state hook tools.
+type unitState struct {
+	ctxt *Context
+}
+
+// NewUnitState returns an implementation of BatchState that stores
+// state in the Juju controller using the state-get, state-set and
+// state-delete hook tools run by the given context. Unlike state on
+// the machine's disk, the state survives if the unit is moved to
+// another machine.
+//
+// Saving empty data removes the item.
+func NewUnitState(ctxt *Context) BatchState {
+	return &unitState{ctxt}
+}
+
+// Load implements PersistentState.Load.
+func (s *unitState) Load(name string) ([]byte, error) {
+	var val string
+	if err := s.ctxt.runJSON(&val, "state-get", "--format", "json", "--", name); err != nil {
+		return nil, errgo.Notef(err, "cannot get state %q", name)
+	}
+	if val == "" {
+		return nil, nil
+	}
+	return []byte(val), nil
+}
+
+// Save implements PersistentState.Save.
+func (s *unitState) Save(name string, data []byte) error {
+	return s.SaveAll(map[string][]byte{name: data})
+}
+
+// SaveAll implements BatchState.SaveAll.
+// All the non-empty items are saved with a single
+// call to state-set.
+func (s *unitState) SaveAll(items map[string][]byte) error {
+	args := []string{"--"}
+	for _, name := range sortedNames(items) {
+		if len(items[name]) == 0 {
+			if _, err := s.ctxt.Runner.Run("state-delete", "--", name); err != nil {
+				return errgo.Notef(err, "cannot delete state %q", name)
+			}
+			continue
+		}
+		args = append(args, fmt.Sprintf("%s=%s", name, items[name]))
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	if _, err := s.ctxt.Runner.Run("state-set", args...); err != nil {
+		return errgo.Notef(err, "cannot set state")
+	}
+	return nil
+}
+
+// leaderStatePrefix is prepended to the name of each item of
+// state stored in the leader settings so that it cannot clash
+// with settings made by the charm itself.
+const leaderStatePrefix = "gocharm-state."
+
+// leaderState is an implementation of BatchState that
+// stores state in the application's leader settings.
+type leaderState struct {
+	ctxt *Context
+
+	// unit holds the state used for the reserved state names,
+	// which hold information specific to the local unit.
+	unit PersistentState
+
+	// loaded holds the data most recently loaded or
+	// saved for each name.
+	loaded map[string][]byte
+}
+
+// NewLeaderState returns an implementation of BatchState that
+// stores state in the leader settings of the application, using
+// the hook tools run by the given context, so the state is shared
+// by all units of the application. Only the leader may change the
+// state; when the local unit is not the leader, changed data is
+// not saved and a message is logged instead, so that other units
+// can run hooks that change their copy of the state without failing.
+// Saving unchanged data does nothing.
+//
+// State that is private to gocharm and describes the local unit
+// only, such as the last configuration and relation settings seen
+// by the unit, is stored with NewUnitState instead, so the
+// state as a whole is not saved atomically.
+func NewLeaderState(ctxt *Context) BatchState {
+	return &leaderState{
+		ctxt:   ctxt,
+		unit:   NewUnitState(ctxt),
+		loaded: make(map[string][]byte),
+	}
+}
+
+// Load implements PersistentState.Load.
+func (s *leaderState) Load(name string) ([]byte, error) {
+	if isReservedStateName(name) {
+		data, err := s.unit.Load(name)
+		return data, errgo.Mask(err)
+	}
+	if data, ok := s.loaded[name]; ok {
+		return data, nil
+	}
+	val, err := s.ctxt.LeaderGet(leaderStatePrefix + name)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get state %q", name)
+	}
+	var data []byte
+	if val != "" {
+		data = []byte(val)
+	}
+	s.loaded[name] = data
+	return data, nil
+}
+
+// Save implements PersistentState.Save.
+func (s *leaderState) Save(name string, data []byte) error {
+	return s.SaveAll(map[string][]byte{name: data})
+}
+
+// SaveAll implements BatchState.SaveAll.
+func (s *leaderState) SaveAll(items map[string][]byte) error {
+	unitItems := make(map[string][]byte)
+	settings := make(map[string]string)
+	for name, data := range items {
+		if isReservedStateName(name) {
+			unitItems[name] = data
+			continue
+		}
+		old, err := s.Load(name)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !bytes.Equal(old, data) {
+			settings[leaderStatePrefix+name] = string(data)
+		}
+	}
+	if len(settings) > 0 {
+		isLeader, err := s.ctxt.IsLeader()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !isLeader {
+			for _, name := range sortedSettingNames(settings) {
+				s.ctxt.Logf("not the leader; not saving application state %q", strings.TrimPrefix(name, leaderStatePrefix))
+			}
+			settings = nil
+		}
+	}
+	if len(settings) > 0 {
+		if err := s.ctxt.LeaderSet(settings); err != nil {
+			return errgo.Mask(err)
+		}
+		for name, val := range settings {
+			s.loaded[strings.TrimPrefix(name, leaderStatePrefix)] = []byte(val)
+		}
+	}
+	if len(unitItems) > 0 {
+		if err := s.unit.(BatchState).SaveAll(unitItems); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// isReservedStateName reports whether the given state name
+// is used for state private to the hook package rather
+// than state registered with RegisterContext.
+func isReservedStateName(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// sortedSettingNames returns the keys of the given map in sorted order.
+func sortedSettingNames(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedNames returns the keys of the given map in sorted order.
+func sortedNames(items map[string][]byte) []string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,507 @@
+package hook
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// stateKeySize holds the size of the keys used to encrypt
+// state. State is encrypted with AES-256 in GCM mode.
+const stateKeySize = 32
+
+// StateKeys holds the keys used to encrypt persistent state.
+type StateKeys struct {
+	// Current holds the id of the key used to encrypt state
+	// when it is saved.
+	Current string
+
+	// Keys holds all the known keys, keyed by id. Keys other
+	// than the current key are used only to decrypt state
+	// saved before the key was rotated.
+	Keys map[string][]byte
+}
+
+// rotate adds a new randomly generated key to k
+// and makes it the current key.
+func (k *StateKeys) rotate() error {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return errgo.Mask(err)
+	}
+	key := make([]byte, stateKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return errgo.Mask(err)
+	}
+	if k.Keys == nil {
+		k.Keys = make(map[string][]byte)
+	}
+	k.Current = hex.EncodeToString(id)
+	k.Keys[k.Current] = key
+	return nil
+}
+
+// check checks that k is well formed.
+func (k *StateKeys) check() error {
+	for id, key := range k.Keys {
+		if len(key) != stateKeySize {
+			return errgo.Newf("key %q has invalid length %d", id, len(key))
+		}
+	}
+	if k.Keys[k.Current] == nil {
+		return errgo.Newf("current key %q not found", k.Current)
+	}
+	return nil
+}
+
+// StateKeySource is used to obtain the keys used to
+// encrypt persistent state. See Registry.SetStateEncryption.
+type StateKeySource interface {
+	// StateKeys returns the keys, creating them
+	// if they do not exist yet.
+	StateKeys(ctxt *Context) (*StateKeys, error)
+
+	// RotateStateKey adds a new key and makes it the
+	// current key. Older keys are retained so that
+	// state encrypted with them can still be read.
+	RotateStateKey(ctxt *Context) error
+}
+
+// StateKeyFile returns a StateKeySource that keeps the keys in the
+// file with the given path, which is relative to the charm's state
+// directory if it is not absolute. The file is created with a new
+// key the first time the keys are needed, which will usually be
+// in the install hook. The file must not be accessible by users
+// other than its owner.
+func StateKeyFile(path string) StateKeySource {
+	return stateKeyFile(path)
+}
+
+type stateKeyFile string
+
+// StateKeys implements StateKeySource.StateKeys.
+func (f stateKeyFile) StateKeys(ctxt *Context) (*StateKeys, error) {
+	path := f.path(ctxt)
+	keys, err := readStateKeyFile(path)
+	if err == nil || !os.IsNotExist(errgo.Cause(err)) {
+		return keys, errgo.Mask(err)
+	}
+	keys = new(StateKeys)
+	if err := keys.rotate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := writeStateKeyFile(path, keys, os.O_EXCL); err != nil {
+		if os.IsExist(errgo.Cause(err)) {
+			// Someone else created it first.
+			keys, err := readStateKeyFile(path)
+			return keys, errgo.Mask(err)
+		}
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// RotateStateKey implements StateKeySource.RotateStateKey.
+func (f stateKeyFile) RotateStateKey(ctxt *Context) error {
+	keys, err := f.StateKeys(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := keys.rotate(); err != nil {
+		return errgo.Mask(err)
+	}
+	path := f.path(ctxt)
+	// Write the new file alongside the old one and rename it
+	// so that a crash cannot lose the keys.
+	tmpPath := path + ".new"
+	os.Remove(tmpPath)
+	if err := writeStateKeyFile(tmpPath, keys, os.O_EXCL); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errgo.Notef(err, "cannot rotate state key")
+	}
+	return nil
+}
+
+func (f stateKeyFile) path(ctxt *Context) string {
+	if filepath.IsAbs(string(f)) {
+		return string(f)
+	}
+	return filepath.Join(ctxt.StateDir(), string(f))
+}
+
+func readStateKeyFile(path string) (*StateKeys, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, errgo.Newf("state key file %q is accessible by other users", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var keys StateKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errgo.Notef(err, "cannot parse state key file %q", path)
+	}
+	if err := keys.check(); err != nil {
+		return nil, errgo.Notef(err, "bad state key file %q", path)
+	}
+	return &keys, nil
+}
+
+func writeStateKeyFile(path string, keys *StateKeys, flag int) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0600)
+	if err != nil {
+		return errgo.Mask(err, os.IsExist)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Close())
+}
+
+// StateKeySecret returns a StateKeySource that keeps the keys in
+// the Juju secret with the given label, owned by the local unit.
+// The secret is created with a new key the first time the keys
+// are needed, which will usually be in the install hook.
+func StateKeySecret(label string) StateKeySource {
+	return stateKeySecret(label)
+}
+
+type stateKeySecret string
+
+// secretCurrentKey holds the secret content key that
+// holds the id of the current key. Each key is stored
+// under its id prefixed by secretKeyPrefix.
+const (
+	secretCurrentKey = "current"
+	secretKeyPrefix  = "key-"
+)
+
+// StateKeys implements StateKeySource.StateKeys.
+func (s stateKeySecret) StateKeys(ctxt *Context) (*StateKeys, error) {
+	keys, err := s.get(ctxt)
+	if err == nil || errgo.Cause(err) != errSecretNotFound {
+		return keys, errgo.Mask(err)
+	}
+	keys = new(StateKeys)
+	if err := keys.rotate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := runSecretCommand(ctxt, keys, "secret-add", "--owner", "unit", "--label", string(s)); err != nil {
+		return nil, errgo.Notef(err, "cannot create state key secret")
+	}
+	return keys, nil
+}
+
+// RotateStateKey implements StateKeySource.RotateStateKey.
+func (s stateKeySecret) RotateStateKey(ctxt *Context) error {
+	keys, err := s.StateKeys(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := keys.rotate(); err != nil {
+		return errgo.Mask(err)
+	}
+	var info map[string]json.RawMessage
+	if err := ctxt.runJSON(&info, "secret-info-get", "--label", string(s), "--format", "json"); err != nil {
+		return errgo.Notef(err, "cannot get state key secret info")
+	}
+	if len(info) != 1 {
+		return errgo.Newf("found %d state key secrets with label %q", len(info), string(s))
+	}
+	var id string
+	for id = range info {
+		break
+	}
+	if err := runSecretCommand(ctxt, keys, "secret-set", id); err != nil {
+		return errgo.Notef(err, "cannot rotate state key")
+	}
+	return nil
+}
+
+var errSecretNotFound = errgo.New("secret not found")
+
+// get returns the keys held in the secret. It returns an error
+// with an errSecretNotFound cause if the secret does not exist.
+func (s stateKeySecret) get(ctxt *Context) (*StateKeys, error) {
+	var content map[string]string
+	if err := ctxt.runJSON(&content, "secret-get", "--label", string(s), "--format", "json"); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, errgo.WithCausef(nil, errSecretNotFound, "state key secret %q not found", string(s))
+		}
+		return nil, errgo.Notef(err, "cannot get state key secret")
+	}
+	keys := &StateKeys{
+		Current: content[secretCurrentKey],
+		Keys:    make(map[string][]byte),
+	}
+	for name, val := range content {
+		if !strings.HasPrefix(name, secretKeyPrefix) {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, errgo.Notef(err, "bad key %q in state key secret", name)
+		}
+		keys.Keys[strings.TrimPrefix(name, secretKeyPrefix)] = key
+	}
+	if err := keys.check(); err != nil {
+		return nil, errgo.Notef(err, "bad state key secret %q", string(s))
+	}
+	return keys, nil
+}
+
+// runSecretCommand runs the given secret-add or secret-set command
+// with the content that stores the given keys in a secret. So that
+// the keys cannot be seen in the command line of the hook tool, the
+// content is passed in a private temporary file, which is removed
+// afterwards.
+func runSecretCommand(ctxt *Context, keys *StateKeys, cmd string, args ...string) error {
+	content := map[string]string{
+		secretCurrentKey: keys.Current,
+	}
+	for id, key := range keys.Keys {
+		content[secretKeyPrefix+id] = base64.StdEncoding.EncodeToString(key)
+	}
+	// JSON is a subset of YAML, the format expected by --file.
+	data, err := json.Marshal(content)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile("", "gocharm-secret")
+	if err != nil {
+		return errgo.Notef(err, "cannot create secret content file")
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot write secret content file")
+	}
+	args = append(args, "--file", f.Name())
+	if _, err := ctxt.Runner.Run(cmd, args...); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// encryptedData is the form in which encrypted state is saved.
+// The field names are chosen so that they are unlikely to clash
+// with any fields in unencrypted state.
+type encryptedData struct {
+	// KeyId holds the id of the key used to
+	// encrypt the data.
+	KeyId string `json:"_key"`
+
+	// Data holds the nonce followed by the
+	// encrypted data.
+	Data []byte `json:"_encrypted"`
+}
+
+// encryptedState is an implementation of BatchState that encrypts
+// state before saving it to another PersistentState.
+type encryptedState struct {
+	state PersistentState
+	ctxt  *Context
+	keys  StateKeySource
+
+	// loaded holds the plaintext and saved data for each
+	// item that has been loaded or saved, so that unchanged
+	// state can be saved without encrypting it again.
+	loaded map[string]loadedItem
+}
+
+type loadedItem struct {
+	plain []byte
+	saved []byte
+	keyId string
+}
+
+// NewEncryptedState returns an implementation of BatchState that
+// encrypts all state before saving it to the given state and
+// decrypts it when loading it. The encryption keys are obtained
+// from the given source using the given context.
+//
+// State that was saved without encryption is read as is and
+// will be encrypted when it is next saved. State that was
+// encrypted with an older key is encrypted with the current key
+// when it is next saved, so after a key rotation all state will
+// be encrypted with the new key once a hook has completed.
+func NewEncryptedState(state PersistentState, ctxt *Context, keys StateKeySource) BatchState {
+	return &encryptedState{
+		state:  state,
+		ctxt:   ctxt,
+		keys:   keys,
+		loaded: make(map[string]loadedItem),
+	}
+}
+
+// Load implements PersistentState.Load.
+func (s *encryptedState) Load(name string) ([]byte, error) {
+	if item, ok := s.loaded[name]; ok {
+		return item.plain, nil
+	}
+	data, err := s.state.Load(name)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var enc encryptedData
+	if err := json.Unmarshal(data, &enc); err != nil || enc.KeyId == "" {
+		// The state was saved before encryption was enabled.
+		return data, nil
+	}
+	keys, err := s.keys.StateKeys(s.ctxt)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get state keys")
+	}
+	key := keys.Keys[enc.KeyId]
+	if key == nil {
+		return nil, errgo.Newf("cannot decrypt state %q: unknown key %q", name, enc.KeyId)
+	}
+	plain, err := decryptState(key, name, enc.Data)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt state %q with key %q", name, enc.KeyId)
+	}
+	s.loaded[name] = loadedItem{
+		plain: plain,
+		saved: data,
+		keyId: enc.KeyId,
+	}
+	return plain, nil
+}
+
+// Save implements PersistentState.Save.
+func (s *encryptedState) Save(name string, data []byte) error {
+	return s.SaveAll(map[string][]byte{name: data})
+}
+
+// SaveAll implements BatchState.SaveAll.
+func (s *encryptedState) SaveAll(items map[string][]byte) error {
+	// Get the keys each time in case they have been
+	// rotated since the state was loaded.
+	keys, err := s.keys.StateKeys(s.ctxt)
+	if err != nil {
+		return errgo.Notef(err, "cannot get state keys")
+	}
+	saved := make(map[string]loadedItem)
+	encItems := make(map[string][]byte)
+	for name, plain := range items {
+		item, ok := s.loaded[name]
+		if ok && item.keyId == keys.Current && bytes.Equal(item.plain, plain) {
+			// Avoid making it look as if the state has changed.
+			encItems[name] = item.saved
+			continue
+		}
+		enc, err := encryptState(keys.Keys[keys.Current], name, plain)
+		if err != nil {
+			return errgo.Notef(err, "cannot encrypt state %q", name)
+		}
+		data, err := json.Marshal(encryptedData{
+			KeyId: keys.Current,
+			Data:  enc,
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		encItems[name] = data
+		saved[name] = loadedItem{
+			plain: plain,
+			saved: data,
+			keyId: keys.Current,
+		}
+	}
+	if bs, ok := s.state.(BatchState); ok {
+		if err := bs.SaveAll(encItems); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	} else {
+		for _, name := range sortedNames(encItems) {
+			if err := s.state.Save(name, encItems[name]); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+	}
+	for name, item := range saved {
+		s.loaded[name] = item
+	}
+	return nil
+}
+
+// encryptState encrypts the state with the given name. The name is
+// authenticated along with the data so that encrypted state cannot
+// be moved from one name to another.
+func encryptState(key []byte, name string, plain []byte) ([]byte, error) {
+	aead, err := newStateCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(name)), nil
+}
+
+// decryptState decrypts the state with the given name
+// that has been encrypted by encryptState.
+func decryptState(key []byte, name string, data []byte) ([]byte, error) {
+	aead, err := newStateCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errgo.Newf("encrypted data too short")
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, []byte(name))
+	if err != nil {
+		return nil, errgo.Newf("wrong key or corrupt data")
+	}
+	return plain, nil
+}
+
+func newStateCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
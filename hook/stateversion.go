@@ -0,0 +1,127 @@
+package hook
+
+import (
+	"encoding/json"
+
+	"gopkg.in/errgo.v1"
+)
+
+// StateMigration is the type of a function that migrates
+// persistent state from one version to the next. It is passed
+// the JSON-encoded state at the old version and should return the
+// JSON-encoded state at the new version.
+type StateMigration func(old []byte) ([]byte, error)
+
+// versionedState is the form in which state with a non-zero
+// version is saved. The field names are chosen so that
+// they are unlikely to clash with any fields in unversioned
+// state.
+type versionedState struct {
+	Version *int            `json:"_version"`
+	State   json.RawMessage `json:"_state"`
+}
+
+// SetStateVersion sets the version of the persistent state
+// registered with RegisterContext, which must have been
+// called on r with a non-nil state value.
+//
+// The migrations slice must hold exactly one function for
+// each version change; migrations[i] migrates the state from
+// version i to version i+1. State saved before a version was
+// set is treated as version zero.
+//
+// When a hook runs, any migrations required to bring the
+// saved state up to date are run before the state is loaded,
+// and the state is saved with the current version when all
+// hooks have completed. If the saved state has a later
+// version than the current one (for example, because the charm
+// has been downgraded), the hook will fail.
+func (r *Registry) SetStateVersion(version int, migrations ...StateMigration) {
+	if version < 0 {
+		panic(errgo.Newf("negative state version %d", version))
+	}
+	if len(migrations) != version {
+		panic(errgo.Newf("state version %d requires %d migrations, but %d provided", version, version, len(migrations)))
+	}
+	val := r.localState("SetStateVersion")
+	val.version = version
+	val.migrations = migrations
+}
+
+// SetTransactionalState sets whether the persistent state registered
+// with RegisterContext, which must have been called on r with a
+// non-nil state value, is saved only when the hook succeeds.
+//
+// When transactional is true and any hook function fails (or
+// panics), changes made to the state during the hook are discarded
+// and the state value is restored to the value it held when the
+// hook started, so that the retried hook starts from the same state
+// as the failed one.
+func (r *Registry) SetTransactionalState(transactional bool) {
+	val := r.localState("SetTransactionalState")
+	val.transactional = transactional
+}
+
+// localState returns the state registered with r. It
+// panics if there is none.
+func (r *Registry) localState(caller string) *localState {
+	for i := range r.state {
+		if r.state[i].registryName == r.name {
+			return &r.state[i]
+		}
+	}
+	panic(errgo.Newf("%s called with no registered state", caller))
+}
+
+// MigrateState returns the result of migrating the given state data,
+// as saved by the registry with the given name, to the current state
+// version. It does not change any persistent state.
+//
+// This method is intended to be used by tests;
+// see hooktest.CheckStateMigration.
+func (r *Registry) MigrateState(registryName string, data []byte) ([]byte, error) {
+	for _, val := range r.state {
+		if val.registryName == registryName {
+			return val.decode(data)
+		}
+	}
+	return nil, errgo.Newf("no state registered for %q", registryName)
+}
+
+// decode returns the state data from the given saved data,
+// migrating it to the current version if needed.
+func (val localState) decode(data []byte) ([]byte, error) {
+	version := 0
+	var vstate versionedState
+	if err := json.Unmarshal(data, &vstate); err == nil && vstate.Version != nil {
+		version = *vstate.Version
+		data = vstate.State
+	}
+	if version > val.version {
+		return nil, errgo.Newf("saved state has version %d, which is newer than current version %d", version, val.version)
+	}
+	for ; version < val.version; version++ {
+		newData, err := val.migrations[version](data)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot migrate state from version %d to %d", version, version+1)
+		}
+		data = newData
+	}
+	return data, nil
+}
+
+// encode returns the data to save for the given state data.
+func (val localState) encode(data []byte) ([]byte, error) {
+	if val.version == 0 {
+		return data, nil
+	}
+	version := val.version
+	data, err := json.Marshal(versionedState{
+		Version: &version,
+		State:   data,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return data, nil
+}
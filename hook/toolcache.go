@@ -0,0 +1,167 @@
+package hook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// cachedTools holds the hook tools whose results can be cached
+// for the duration of a hook because they do not change
+// anything and their results can only change as a result of
+// other hook tools run by the same hook.
+//
+// Note that is-leader is deliberately not included,
+// because leadership can be lost while a hook is running.
+var cachedTools = map[string]bool{
+	"config-get":      true,
+	"unit-get":        true,
+	"relation-ids":    true,
+	"relation-list":   true,
+	"relation-get":    true,
+	"leader-get":      true,
+	"state-get":       true,
+	"secret-get":      true,
+	"secret-info-get": true,
+	"status-get":      true,
+	"storage-get":     true,
+	"storage-list":    true,
+	"resource-get":    true,
+	"network-get":     true,
+	"action-get":      true,
+}
+
+// invalidatedTools maps from a hook tool to the cached tools
+// whose results may be changed by running it. Hook tools not
+// mentioned here or in cachedTools invalidate the entire cache.
+var invalidatedTools = map[string][]string{
+	"relation-set":            {"relation-get"},
+	"leader-set":              {"leader-get"},
+	"state-set":               {"state-get"},
+	"state-delete":            {"state-get"},
+	"secret-add":              {"secret-get", "secret-info-get"},
+	"secret-set":              {"secret-get", "secret-info-get"},
+	"status-set":              {"status-get"},
+	"storage-add":             {"storage-get", "storage-list"},
+	"juju-log":                nil,
+	"open-port":               nil,
+	"close-port":              nil,
+	"add-metric":              nil,
+	"action-set":              nil,
+	"action-fail":             nil,
+	"application-version-set": nil,
+	"is-leader":               nil,
+}
+
+// cachingToolRunner is a ToolRunner that caches the results
+// of read-only hook tools and counts the hook tools that are run.
+type cachingToolRunner struct {
+	runner ToolRunner
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// cache holds the output of each cached tool invocation,
+	// keyed by tool name and then by arguments.
+	cache map[string]map[string][]byte
+
+	// calls holds the number of times each tool has been run.
+	calls map[string]int
+
+	// hits holds the number of calls that were served from
+	// the cache.
+	hits int
+
+	// generation is incremented whenever the cache is
+	// invalidated, so that results from tools that were
+	// running at the time are not cached.
+	generation int
+}
+
+// newCachingToolRunner returns a ToolRunner that runs tools
+// using the given runner, caching the results of read-only tools
+// until a tool is run that might change them.
+func newCachingToolRunner(runner ToolRunner) *cachingToolRunner {
+	return &cachingToolRunner{
+		runner: runner,
+		cache:  make(map[string]map[string][]byte),
+		calls:  make(map[string]int),
+	}
+}
+
+// Run implements ToolRunner.Run.
+func (r *cachingToolRunner) Run(cmd string, args ...string) ([]byte, error) {
+	key := strings.Join(args, "\x00")
+	r.mu.Lock()
+	if out, ok := r.cache[cmd][key]; ok {
+		r.hits++
+		r.mu.Unlock()
+		// Return a copy so that the caller cannot
+		// change the cached output.
+		return append([]byte(nil), out...), nil
+	}
+	r.calls[cmd]++
+	r.invalidate(cmd)
+	generation := r.generation
+	r.mu.Unlock()
+
+	out, err := r.runner.Run(cmd, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !cachedTools[cmd] {
+		// Invalidate again in case any cached tools
+		// were run concurrently with this one.
+		r.invalidate(cmd)
+		return out, err
+	}
+	if err != nil || r.generation != generation {
+		return out, err
+	}
+	if r.cache[cmd] == nil {
+		r.cache[cmd] = make(map[string][]byte)
+	}
+	r.cache[cmd][key] = append([]byte(nil), out...)
+	return out, nil
+}
+
+// invalidate removes any cached results that might be
+// changed by running the given tool. It must be called
+// with r.mu held.
+func (r *cachingToolRunner) invalidate(cmd string) {
+	if cachedTools[cmd] {
+		return
+	}
+	tools, ok := invalidatedTools[cmd]
+	if ok && len(tools) == 0 {
+		return
+	}
+	r.generation++
+	if !ok {
+		r.cache = make(map[string]map[string][]byte)
+		return
+	}
+	for _, tool := range tools {
+		delete(r.cache, tool)
+	}
+}
+
+// Close implements ToolRunner.Close.
+func (r *cachingToolRunner) Close() error {
+	return r.runner.Close()
+}
+
+// summary returns a summary of the hook tools that
+// have been run.
+func (r *cachingToolRunner) summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total := 0
+	tools := make([]string, 0, len(r.calls))
+	for cmd, n := range r.calls {
+		total += n
+		tools = append(tools, fmt.Sprintf("%s=%d", cmd, n))
+	}
+	sort.Strings(tools)
+	return fmt.Sprintf("%d hook tool calls, %d cached [%s]", total, r.hits, strings.Join(tools, " "))
+}
@@ -97,6 +97,9 @@ type ServerContext struct {
 	remote string
 	rels   map[int]*ServerContextRelation
 	status jujuc.StatusInfo
+
+	isLeader       bool
+	leaderSettings map[string]string
 }
 
 func (s *ServerContext) ActionParams() (map[string]interface{}, error) {
@@ -105,6 +108,35 @@ func (s *ServerContext) ActionParams() (map[string]interface{}, error) {
 	}, nil
 }
 
+func (c *ServerContext) IsLeader() (bool, error) {
+	return c.isLeader, nil
+}
+
+func (c *ServerContext) LeaderSettings() (map[string]string, error) {
+	result := make(map[string]string)
+	for key, val := range c.leaderSettings {
+		result[key] = val
+	}
+	return result, nil
+}
+
+func (c *ServerContext) WriteLeaderSettings(settings map[string]string) error {
+	if !c.isLeader {
+		return fmt.Errorf("not the leader")
+	}
+	if c.leaderSettings == nil {
+		c.leaderSettings = make(map[string]string)
+	}
+	for key, val := range settings {
+		if val == "" {
+			delete(c.leaderSettings, key)
+		} else {
+			c.leaderSettings[key] = val
+		}
+	}
+	return nil
+}
+
 func (c *ServerContext) OwnerTag() string {
 	return "unknown"
 }
@@ -113,6 +145,11 @@ func (c *ServerContext) UnitName() string {
 	return "u/0"
 }
 
+func (c *ServerContext) UnitStatus() (*jujuc.StatusInfo, error) {
+	status := c.status
+	return &status, nil
+}
+
 func (c *ServerContext) SetUnitStatus(status jujuc.StatusInfo) error {
 	c.status = status
 	return nil